@@ -0,0 +1,319 @@
+// Package account registers users with a name and a password and signs them in.
+// Accounts are kept in a storage.Store and passwords are hashed with argon2id. A
+// sign in is kept in the browser's session, see package session.
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/storage"
+)
+
+const (
+	// Scope is the migration scope of the account buckets, see Migrate
+	Scope = "account"
+
+	// accountsBucket holds the accounts by id
+	accountsBucket = "account.users"
+
+	// namesBucket maps lower case account names to account ids
+	namesBucket = "account.names"
+
+	// maxPasswordLength bounds the work of hashing a password
+	maxPasswordLength = 128
+)
+
+var (
+	// ErrInvalidName is returned for an account name that does not match the allowed pattern
+	ErrInvalidName = errors.New("names must be 3 to 32 letters, digits, '.', '_' or '-'")
+
+	// ErrNameTaken is returned when signing up with the name of an existing account
+	ErrNameTaken = errors.New("name is taken")
+
+	// ErrWeakPassword is returned for a password that is too short or too long
+	ErrWeakPassword = errors.New("password is too short or too long")
+
+	// ErrInvalidCredentials is returned when the name or password is wrong
+	ErrInvalidCredentials = errors.New("invalid name or password")
+
+	// ErrNoAccount is returned for an account that does not exist
+	ErrNoAccount = errors.New("no such account")
+)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,31}$`)
+
+// Account is a registered user
+type Account struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"passwordHash"`
+	Created      time.Time `json:"created"`
+}
+
+// Config holds the settings of accounts
+type Config struct {
+	// MinPasswordLength is the shortest password accepted on sign up
+	MinPasswordLength int `mapstructure:"minPasswordLength"`
+}
+
+// DefaultConfig returns the settings used for keys that are not set
+func DefaultConfig() Config {
+	return Config{
+		MinPasswordLength: 8,
+	}
+}
+
+// Validate checks the limits of c
+func (c *Config) Validate() error {
+	verr := &config.ValidationError{}
+	if c.MinPasswordLength < 1 || c.MinPasswordLength > maxPasswordLength {
+		verr.Errors = append(verr.Errors, config.FieldError{Key: "minPasswordLength", Msg: fmt.Sprintf("must be between 1 and %v", maxPasswordLength)})
+	}
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// Accounts registers, authenticates and deletes accounts
+type Accounts struct {
+	store  storage.Store
+	cfg    Config
+	params HashParams
+
+	mu       sync.Mutex
+	signedUp []func(*Account)
+	deleted  []func(*Account)
+
+	// dummyHash is checked for unknown names so they take as long as wrong passwords
+	dummyHash string
+}
+
+// New returns Accounts kept in store
+func New(store storage.Store, cfg Config) *Accounts {
+	return NewWithParams(store, cfg, DefaultHashParams)
+}
+
+// NewWithParams returns Accounts that hash new passwords with params
+func NewWithParams(store storage.Store, cfg Config, params HashParams) *Accounts {
+	dummy, err := HashPassword("", params)
+	if err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return &Accounts{store: store, cfg: cfg, params: params, dummyHash: dummy}
+}
+
+// migrations evolve the account buckets, see storage.Migrate
+var migrations = []storage.Migration{
+	{Version: 1, Name: "create account buckets", Up: storage.CreateBuckets(accountsBucket, namesBucket)},
+}
+
+// Migrate brings the account buckets of store up to date. Run it before New.
+func Migrate(ctx context.Context, store storage.Store) error {
+	return storage.Migrate(ctx, store, Scope, migrations)
+}
+
+// newID returns a random id
+func newID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// SignUp registers an account called name
+func (a *Accounts) SignUp(ctx context.Context, name, password string) (*Account, error) {
+	if !namePattern.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	if len(password) < a.cfg.MinPasswordLength || len(password) > maxPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	hash, err := HashPassword(password, a.params)
+	if err != nil {
+		return nil, err
+	}
+	acct := &Account{ID: newID(), Name: name, PasswordHash: hash, Created: time.Now().UTC()}
+
+	err = a.store.Update(ctx, func(tx storage.Tx) error {
+		names, err := tx.Bucket(namesBucket)
+		if err != nil {
+			return err
+		}
+		key := []byte(strings.ToLower(name))
+		if _, err := names.Get(key); err == nil {
+			return ErrNameTaken
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		if err := names.Put(key, []byte(acct.ID)); err != nil {
+			return err
+		}
+
+		docs, err := storage.Docs(tx, accountsBucket)
+		if err != nil {
+			return err
+		}
+		return docs.Put(acct.ID, acct)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error signing up %v : %w", name, err)
+	}
+
+	a.mu.Lock()
+	fns := a.signedUp
+	a.mu.Unlock()
+	for _, fn := range fns {
+		fn(acct)
+	}
+	return acct, nil
+}
+
+// Authenticate returns the account called name if password is its password, or
+// ErrInvalidCredentials
+func (a *Accounts) Authenticate(ctx context.Context, name, password string) (*Account, error) {
+	acct, err := a.ByName(ctx, name)
+	if errors.Is(err, ErrNoAccount) {
+		// spend the same time as for a wrong password so names cannot be probed
+		_, _ = CheckPassword(password, a.dummyHash)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := CheckPassword(password, acct.PasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("error checking password of %v : %w", acct.ID, err)
+	}
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return acct, nil
+}
+
+// Get returns the account id or ErrNoAccount
+func (a *Accounts) Get(ctx context.Context, id string) (*Account, error) {
+	var acct Account
+	err := a.store.View(ctx, func(tx storage.Tx) error {
+		docs, err := storage.Docs(tx, accountsBucket)
+		if err != nil {
+			return err
+		}
+		return docs.Get(id, &acct)
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNoAccount
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading account %v : %w", id, err)
+	}
+	return &acct, nil
+}
+
+// ByName returns the account called name, ignoring case, or ErrNoAccount
+func (a *Accounts) ByName(ctx context.Context, name string) (*Account, error) {
+	var id string
+	err := a.store.View(ctx, func(tx storage.Tx) error {
+		names, err := tx.Bucket(namesBucket)
+		if err != nil {
+			return err
+		}
+		b, err := names.Get([]byte(strings.ToLower(name)))
+		id = string(b)
+		return err
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNoAccount
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up account %v : %w", name, err)
+	}
+	return a.Get(ctx, id)
+}
+
+// Delete removes the account id. Sessions signed in to it are signed out on their next request.
+func (a *Accounts) Delete(ctx context.Context, id string) error {
+	var acct Account
+	err := a.store.Update(ctx, func(tx storage.Tx) error {
+		docs, err := storage.Docs(tx, accountsBucket)
+		if err != nil {
+			return err
+		}
+		if err := docs.Get(id, &acct); err != nil {
+			return err
+		}
+		if err := docs.Delete(id); err != nil {
+			return err
+		}
+
+		names, err := tx.Bucket(namesBucket)
+		if err != nil {
+			return err
+		}
+		return names.Delete([]byte(strings.ToLower(acct.Name)))
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		return ErrNoAccount
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting account %v : %w", id, err)
+	}
+
+	a.mu.Lock()
+	fns := a.deleted
+	a.mu.Unlock()
+	for _, fn := range fns {
+		fn(&acct)
+	}
+	return nil
+}
+
+// ForEach calls fn with every account until fn returns an error
+func (a *Accounts) ForEach(ctx context.Context, fn func(*Account) error) error {
+	err := a.store.View(ctx, func(tx storage.Tx) error {
+		docs, err := storage.Docs(tx, accountsBucket)
+		if err != nil {
+			return err
+		}
+		return docs.ForEach(func(id string, raw json.RawMessage) error {
+			var acct Account
+			if err := json.Unmarshal(raw, &acct); err != nil {
+				return fmt.Errorf("error decoding account %v : %w", id, err)
+			}
+			return fn(&acct)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error listing accounts : %w", err)
+	}
+	return nil
+}
+
+// OnSignUp registers fn to be called after an account is created
+func (a *Accounts) OnSignUp(fn func(*Account)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.signedUp = append(a.signedUp, fn)
+}
+
+// OnDelete registers fn to be called after an account is deleted
+func (a *Accounts) OnDelete(fn func(*Account)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.deleted = append(a.deleted, fn)
+}
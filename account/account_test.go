@@ -0,0 +1,157 @@
+package account
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/session"
+	"github.com/aljo242/koch/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// testParams keeps hashing cheap in tests
+var testParams = HashParams{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func newTestAccounts(t *testing.T) *Accounts {
+	t.Helper()
+	return NewWithParams(storage.NewMemory(), DefaultConfig(), testParams)
+}
+
+func TestPassword(t *testing.T) {
+	t.Parallel()
+
+	hash, err := HashPassword("correct horse", testParams)
+	require.NoError(t, err)
+	other, err := HashPassword("correct horse", testParams)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other, "hashes are salted")
+
+	ok, err := CheckPassword("correct horse", hash)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = CheckPassword("battery staple", hash)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = CheckPassword("x", "$2a$10$bcrypt")
+	require.ErrorIs(t, err, ErrInvalidHash)
+}
+
+func TestAccounts(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	a := newTestAccounts(t)
+
+	var signedUp []string
+	a.OnSignUp(func(acct *Account) { signedUp = append(signedUp, acct.Name) })
+	acct, err := a.SignUp(ctx, "alice", "password1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice"}, signedUp)
+	_, err = a.SignUp(ctx, "ALICE", "password2")
+	require.ErrorIs(t, err, ErrNameTaken)
+	_, err = a.SignUp(ctx, "a!", "password2")
+	require.ErrorIs(t, err, ErrInvalidName)
+	_, err = a.SignUp(ctx, "bob", "short")
+	require.ErrorIs(t, err, ErrWeakPassword)
+
+	got, err := a.Authenticate(ctx, "Alice", "password1")
+	require.NoError(t, err)
+	require.Equal(t, acct.ID, got.ID)
+	_, err = a.Authenticate(ctx, "alice", "password2")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = a.Authenticate(ctx, "nobody", "password1")
+	require.ErrorIs(t, err, ErrInvalidCredentials)
+
+	var ids []string
+	require.NoError(t, a.ForEach(ctx, func(acct *Account) error {
+		ids = append(ids, acct.ID)
+		return nil
+	}))
+	require.Equal(t, []string{acct.ID}, ids)
+
+	var deleted []string
+	a.OnDelete(func(acct *Account) { deleted = append(deleted, acct.Name) })
+	require.NoError(t, a.Delete(ctx, acct.ID))
+	require.Equal(t, []string{"alice"}, deleted)
+	_, err = a.Get(ctx, acct.ID)
+	require.ErrorIs(t, err, ErrNoAccount)
+	require.ErrorIs(t, a.Delete(ctx, acct.ID), ErrNoAccount)
+
+	// the name is free again
+	_, err = a.SignUp(ctx, "alice", "password3")
+	require.NoError(t, err)
+}
+
+func TestHandlers(t *testing.T) {
+	t.Parallel()
+	a := newTestAccounts(t)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signup", a.SignUpHandler())
+	mux.HandleFunc("/signin", a.SignInHandler())
+	mux.HandleFunc("/signout", a.SignOutHandler())
+	mux.HandleFunc("/delete", a.DeleteHandler())
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		if _, acct, err := a.FromRequest(r); err == nil {
+			_, _ = w.Write([]byte(acct.Name))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	sessions, err := session.New(config.Default().Session, false, session.NewMemoryStore())
+	require.NoError(t, err)
+	srv := httptest.NewServer(sessions.Middleware(mux))
+	t.Cleanup(srv.Close)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+	post := func(path string, form url.Values) int {
+		resp, err := client.PostForm(srv.URL+path, form)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	me := func() int {
+		resp, err := client.Get(srv.URL + "/me")
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	creds := url.Values{"name": {"alice"}, "password": {"password1"}}
+
+	cookie := func() string {
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		for _, c := range jar.Cookies(u) {
+			return c.Value
+		}
+		return ""
+	}
+
+	require.Equal(t, http.StatusCreated, post("/signup", creds))
+	require.Equal(t, http.StatusOK, me())
+	require.Equal(t, http.StatusConflict, post("/signup", creds))
+
+	require.Equal(t, http.StatusNoContent, post("/signout", nil))
+	require.Equal(t, http.StatusUnauthorized, me())
+	require.Equal(t, http.StatusUnauthorized, post("/signin", url.Values{"name": {"alice"}, "password": {"nope"}}))
+	require.Equal(t, http.StatusOK, post("/signin", creds))
+	require.Equal(t, http.StatusOK, me())
+
+	// signing in again renews the session id
+	before := cookie()
+	require.Equal(t, http.StatusOK, post("/signin", creds))
+	require.NotEqual(t, before, cookie())
+	require.Equal(t, http.StatusOK, me())
+
+	require.Equal(t, http.StatusUnauthorized, post("/delete", url.Values{"password": {"nope"}}))
+	require.Equal(t, http.StatusNoContent, post("/delete", url.Values{"password": {"password1"}}))
+	require.Equal(t, http.StatusUnauthorized, me())
+	require.Equal(t, http.StatusUnauthorized, post("/signin", creds))
+}
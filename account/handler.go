@@ -0,0 +1,148 @@
+package account
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/aljo242/koch/session"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// sessionKey is the session value holding the id of the signed in account
+	sessionKey = "account"
+
+	// maxFormSize bounds the body of the account forms
+	maxFormSize = 4096
+)
+
+var (
+	// ErrNoSession is returned for a request that is not signed in
+	ErrNoSession = errors.New("not signed in")
+
+	// errNoSessions is returned when the handlers are not served through session.Manager.Middleware
+	errNoSessions = errors.New("request has no session")
+)
+
+// info is what the handlers tell a client about its account
+type info struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// FromRequest returns the session of r and the account signed in to it, or ErrNoSession
+func (a *Accounts) FromRequest(r *http.Request) (*session.Session, *Account, error) {
+	s := session.FromContext(r.Context())
+	if s == nil || s.Get(sessionKey) == "" {
+		return nil, nil, ErrNoSession
+	}
+
+	acct, err := a.Get(r.Context(), s.Get(sessionKey))
+	if errors.Is(err, ErrNoAccount) {
+		s.Delete(sessionKey)
+		return nil, nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, acct, nil
+}
+
+// SignUpHandler registers an account from the name and password form values and signs it in
+func (a *Accounts) SignUpHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+		acct, err := a.SignUp(r.Context(), r.FormValue("name"), r.FormValue("password"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Info().Str("account", acct.ID).Str("name", acct.Name).Msg("signed up")
+		a.signIn(w, r, acct, http.StatusCreated)
+	}
+}
+
+// SignInHandler signs in the account of the name and password form values, giving
+// the session of the browser a new id
+func (a *Accounts) SignInHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+		acct, err := a.Authenticate(r.Context(), r.FormValue("name"), r.FormValue("password"))
+		if err != nil {
+			if errors.Is(err, ErrInvalidCredentials) {
+				log.Warn().Str("name", r.FormValue("name")).Str("remote", r.RemoteAddr).Msg("failed sign in")
+			}
+			writeError(w, err)
+			return
+		}
+		a.signIn(w, r, acct, http.StatusOK)
+	}
+}
+
+// SignOutHandler destroys the session of the browser
+func (a *Accounts) SignOutHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s := session.FromContext(r.Context()); s != nil {
+			s.Destroy()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteHandler deletes the signed in account after checking the password form value
+func (a *Accounts) DeleteHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxFormSize)
+		s, acct, err := a.FromRequest(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if _, err := a.Authenticate(r.Context(), acct.Name, r.FormValue("password")); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := a.Delete(r.Context(), acct.ID); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		log.Info().Str("account", acct.ID).Str("name", acct.Name).Msg("deleted account")
+		s.Destroy()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// signIn signs acct in to the session of the browser under a new session id, and writes the account
+func (a *Accounts) signIn(w http.ResponseWriter, r *http.Request, acct *Account, status int) {
+	s := session.FromContext(r.Context())
+	if s == nil {
+		writeError(w, errNoSessions)
+		return
+	}
+	s.Renew()
+	s.Set(sessionKey, acct.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(info{ID: acct.ID, Name: acct.Name}); err != nil {
+		log.Error().Err(err).Msg("error writing account")
+	}
+}
+
+// writeError maps the errors of Accounts to HTTP statuses
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrWeakPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNameTaken):
+		http.Error(w, ErrNameTaken.Error(), http.StatusConflict)
+	case errors.Is(err, ErrInvalidCredentials), errors.Is(err, ErrNoSession):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		log.Error().Err(err).Msg("error handling account request")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,84 @@
+// Package admin guards administrative endpoints with the bearer token set by
+// server.adminToken. Without a token the endpoints are off.
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aljo242/koch/config"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrDisabled rejects admin requests while no token is set
+	ErrDisabled = errors.New("admin endpoints are disabled")
+
+	// ErrUnauthorized rejects admin requests without the admin token
+	ErrUnauthorized = errors.New("missing or invalid admin token")
+)
+
+// Guard checks the bearer token of admin requests. The token can be replaced while
+// requests are served, as when the config is reloaded.
+type Guard struct {
+	mu    sync.RWMutex
+	token string
+}
+
+// New returns a Guard accepting token
+func New(token config.Secret) *Guard {
+	g := &Guard{}
+	g.Set(token)
+	return g
+}
+
+// Set replaces the accepted token, turning the endpoints off if it is empty
+func (g *Guard) Set(token config.Secret) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.token = token.Value()
+}
+
+// Check returns ErrDisabled or ErrUnauthorized if r must be rejected
+func (g *Guard) Check(r *http.Request) error {
+	g.mu.RLock()
+	token := g.token
+	g.mu.RUnlock()
+
+	if token == "" {
+		return ErrDisabled
+	}
+	got := r.Header.Get("Authorization")
+	if !strings.HasPrefix(got, "Bearer ") {
+		return ErrUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(got, "Bearer ")), []byte(token)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Middleware answers requests that fail Check with 404 Not Found while the
+// endpoints are off, and 401 Unauthorized otherwise
+func (g *Guard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch err := g.Check(r); {
+		case errors.Is(err, ErrDisabled):
+			http.NotFound(w, r)
+		case err != nil:
+			log.Warn().Err(err).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Str("remote", r.RemoteAddr).
+				Msg("rejected admin request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
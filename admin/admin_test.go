@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	g := New("")
+	h := g.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	status := func(auth string) int {
+		r := httptest.NewRequest(http.MethodPost, "/admin", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusNotFound, status("Bearer "), "off without a token")
+
+	g.Set("hunter2")
+	require.Equal(t, http.StatusUnauthorized, status(""))
+	require.Equal(t, http.StatusUnauthorized, status("Bearer hunter3"))
+	require.Equal(t, http.StatusUnauthorized, status("Basic hunter2"))
+	require.Equal(t, http.StatusNoContent, status("Bearer hunter2"))
+
+	g.Set("rotated")
+	require.Equal(t, http.StatusUnauthorized, status("Bearer hunter2"))
+	require.Equal(t, http.StatusNoContent, status("Bearer rotated"))
+}
@@ -3,106 +3,288 @@ package config
 import (
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/aljo242/koch/util/file_util"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
 const (
 	DefaultConfigPath = "$HOME/.koch/config/"
+
+	// defaultConfigName is the file name searched for when Load is given a directory
+	defaultConfigName = "config"
 )
 
 // ErrInvalidConfig indicates that the config file is invalid
 var ErrInvalidConfig = errors.New("invalid config")
 
-func New(path string) error {
-	// check if path exists
-	if !file_util.Exists(path) {
+// ErrUnsupportedFormat indicates that the config file extension is not a known format
+var ErrUnsupportedFormat = errors.New("unsupported config format")
+
+// Formats lists the supported config file extensions in the order they are searched for
+var Formats = []string{"toml", "json", "yaml", "yml"}
+
+// current is the config loaded by the last successful call to New
+var current = Default()
+
+// Load reads the config found at path into a new, independent Config instance.
+//
+// path may be a config file or a directory containing config.{toml,json,yaml,yml};
+// the format is detected from the file extension. A missing config is an error
+// wrapping os.ErrNotExist unless WithWriteDefault is given; use Init to create one.
+//
+// A file may list fragments to merge beneath it with a top-level include key, and
+// WithProfile layers a profile file such as config.prod.toml over the base file.
+// Every key can then be overridden by an environment variable such as KOCH_SERVER_PORT,
+// and by a command-line flag when WithFlags is given.
+func Load(path string, opts ...Option) (*Config, error) {
+	o := &loadOptions{envPrefix: DefaultEnvPrefix}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	file, err := resolveFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !file_util.Exists(file) {
+		if !o.writeDefault {
+			return nil, fmt.Errorf("config file %v : %w", file, os.ErrNotExist)
+		}
+		if err := writeDefault(file); err != nil {
+			return nil, err
+		}
+		log.Warn().Str("file", file).Msg("no config found, wrote default config")
+	}
+
+	settings, files, err := layers(file, o.profile)
+	if err != nil {
+		return nil, err
+	}
+
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, fmt.Errorf("error merging config files %v : %w", files, err)
+	}
+
+	sources := applyOverrides(v, o)
+
+	cfg, err := decode(v.AllSettings(), filepath.Dir(file))
+	if err != nil {
+		return nil, fmt.Errorf("%v : %w", file, err)
+	}
+	cfg.sources = sources
+	cfg.file = file
+	cfg.files = files
+	cfg.profile = o.profile
+
+	return cfg, nil
+}
+
+// File returns the path of the config file the config was loaded from
+func (c *Config) File() string {
+	return c.file
+}
+
+// Files returns every file merged into the config, including includes and the profile
+func (c *Config) Files() []string {
+	return c.files
+}
+
+// Profile returns the name of the profile layered over the base config, if any
+func (c *Config) Profile() string {
+	return c.profile
+}
+
+// resolveFile maps path to the config file to load. Directories are searched for
+// config.<format>; a directory without one resolves to config.toml inside it.
+func resolveFile(path string) (string, error) {
+	if path == "" {
 		path = DefaultConfigPath
 	}
+	path = filepath.Clean(os.ExpandEnv(path))
 
-	viper.SetConfigName("config")
-	viper.SetConfigType("toml")
-	viper.AddConfigPath(path)
-	err := viper.ReadInConfig()
+	info, err := os.Stat(path)
+	isDir := err == nil && info.IsDir()
+	if !isDir && filepath.Ext(path) == "" {
+		// a path without an extension that does not exist yet is treated as a directory
+		isDir = err != nil
+	}
+
+	if !isDir {
+		if !contains(Formats, formatOf(path)) {
+			return "", fmt.Errorf("%w %q : expected one of %v", ErrUnsupportedFormat, filepath.Ext(path), Formats)
+		}
+		return path, nil
+	}
 
-	// if no config file, write default to default cfg path
-	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-		// default config
-		err = viper.SafeWriteConfigAs(path) // write current config to path
+	for _, format := range Formats {
+		file := filepath.Join(path, defaultConfigName+"."+format)
+		if file_util.Exists(file) {
+			return file, nil
+		}
 	}
+	return filepath.Join(path, defaultConfigName+"."+Formats[0]), nil
+}
+
+// formatOf returns the config format of file based on its extension
+func formatOf(file string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(file)), ".")
+}
+
+// writeDefault writes the commented default config template to file in the format
+// given by its extension. It never overwrites an existing file.
+func writeDefault(file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return fmt.Errorf("error creating config directory : %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Clean(file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		return fmt.Errorf("fatal error config file %w", err)
+		return fmt.Errorf("error creating config file %v : %w", file, err)
 	}
 
-	// TODO ensure min config exists
-	if !ensureMinConfig() {
-		return ErrInvalidConfig
+	if err := WriteTemplate(f, formatOf(file)); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing default config %v : %w", file, err)
 	}
+	return f.Close()
+}
 
-	return nil
+// Init writes the commented default config to path, which may be a file or a
+// directory as accepted by Load, and returns the file written. It fails if the
+// file already exists.
+func Init(path string) (string, error) {
+	file, err := resolveFile(path)
+	if err != nil {
+		return "", err
+	}
+	if file_util.Exists(file) {
+		return "", fmt.Errorf("config file %v : %w", file, os.ErrExist)
+	}
+	return file, writeDefault(file)
 }
 
-func ensureMinConfig() bool {
+// New loads the config at path and makes it the package-level config read by the getters
+//
+// Deprecated: use Load and pass the returned *Config around instead
+func New(path string) error {
+	cfg, err := Load(path, WithWriteDefault())
+	if err != nil {
+		return err
+	}
+	current = cfg
+
+	return nil
+}
 
-	return true
+// Get returns the package-level config loaded by New
+//
+// Deprecated: use Load and pass the returned *Config around instead
+func Get() *Config {
+	return current
 }
 
+// LogLevel returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func LogLevel() string {
-	return viper.GetString("logger.level")
+	return current.Logger.Level
 }
 
+// ServerSecure returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerSecure() bool {
-	return viper.GetBool("server.secure")
+	return current.Server.Secure
 }
 
+// ServerIP returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerIP() string {
-	return viper.GetString("server.IP")
+	return current.Server.IP
 }
 
+// ServerChooseIP returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerChooseIP() bool {
-	return viper.GetBool("server.chooseIP")
+	return current.Server.ChooseIP
 }
 
+// ServerPort returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerPort() string {
-	return viper.GetString("server.port")
+	return current.Server.Port
 }
 
+// ServerCertFile returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerCertFile() string {
-	return viper.GetString("server.certFile")
+	return current.Server.CertFile
 }
 
+// ServerKeyFile returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerKeyFile() string {
-	return viper.GetString("server.keyFile")
+	return current.Server.KeyFile
 }
 
+// ServerRootCA returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerRootCA() string {
-	return viper.GetString("server.rootCA")
+	return current.Server.RootCA
 }
 
+// ServerHost returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerHost() string {
-	return viper.GetString("server.host")
+	return current.Server.Host
 }
 
+// ServerShutdownCode returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerShutdownCode() int {
-	return viper.GetInt("server.shutdownCode")
+	return current.Server.ShutdownCode
 }
 
+// ServerCmdEnable returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerCmdEnable() bool {
-	return viper.GetBool("server.cmdEnable")
+	return current.Server.CmdEnable
 }
 
+// ServerCacheMaxAge returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func ServerCacheMaxAge() int {
-	return viper.GetInt("server.cacheMaxAge")
+	return current.Server.CacheMaxAge
 }
 
+// AppName returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func AppName() string {
-	return viper.GetString("app")
+	return current.App
 }
 
+// OwnerName returns the matching key of the package-level config
+//
+// Deprecated: read the field from a *Config returned by Load instead
 func OwnerName() string {
-	return viper.GetString("owner.name")
+	return current.Owner.Name
 }
-
-// TODO add more as config gets fleshed out
@@ -1,24 +1,373 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 )
 
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	cfg, err := Load("./sample/")
+	require.NoError(t, err)
+	require.Equal(t, "myApp", cfg.App)
+	require.Equal(t, "80", cfg.Server.Port)
+	require.Equal(t, "debug", cfg.Logger.Level)
+
+	// every call returns an independent instance
+	other, err := Load("./sample/")
+	require.NoError(t, err)
+	other.Server.Port = "8080"
+	require.Equal(t, "80", cfg.Server.Port)
+}
+
 func TestNew(t *testing.T) {
 	err := New("./sample/")
 	require.NoError(t, err)
+
+	require.Equal(t, "myApp", Get().App)
+	require.Equal(t, 180, ServerCacheMaxAge())
+}
+
+func TestDecodeTLS(t *testing.T) {
+	v := viper.New()
+	v.SetConfigFile("./sample/config_tls.toml")
+	require.NoError(t, v.ReadInConfig())
+
+	cfg, err := decode(v.AllSettings(), filepath.Dir(v.ConfigFileUsed()))
+	require.NoError(t, err)
+	require.True(t, cfg.Server.Secure)
+	require.Equal(t, filepath.Join("sample", "../../server/sample/localhost.crt"), cfg.Server.CertFile)
 }
 
-// TODO reimplement
-/*
-func TestConfig(t *testing.T) {
-	// provide nonexistent file to get incorrect file error
-	_, err := config.LoadConfig(incorrectConfigFile)
+func TestDecodeAggregatesErrors(t *testing.T) {
+	settings := map[string]interface{}{
+		"bogus": true,
+		"database": map[string]interface{}{
+			"driver": "postgres",
+		},
+		"logger": map[string]interface{}{
+			"level": "loud",
+		},
+		"server": map[string]interface{}{
+			"port":           "99999",
+			"ip":             "not-an-ip",
+			"secure":         true,
+			"certfile":       "missing.crt",
+			"cachemaxage":    "soon",
+			"extra":          1,
+			"allowedorigins": []interface{}{"example.com"},
+		},
+		"session": map[string]interface{}{
+			"idletimeout": "48h",
+			"maxlifetime": "24h",
+			"secret":      "too short",
+		},
+	}
+
+	_, err := decode(settings, "")
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrInvalidConfig))
+
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr))
+
+	keys := make(map[string]bool)
+	for _, fe := range verr.Errors {
+		keys[fe.Key] = true
+	}
+	for _, want := range []string{
+		"bogus",
+		"server.extra",
+		"server.cacheMaxAge",
+		"database.driver",
+		"logger.level",
+		"server.port",
+		"server.IP",
+		"server.certFile",
+		"server.keyFile",
+		"server.rootCA",
+		"server.allowedOrigins",
+		"session.maxLifetime",
+		"session.secret",
+	} {
+		require.True(t, keys[want], "missing error for %v in %v", want, err)
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	t.Setenv("KOCH_SERVER_PORT", "8080")
+	t.Setenv("KOCH_LOGGER_LEVEL", "info")
+	t.Setenv("KOCH_SERVER_SECURE", "false")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	RegisterFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-logger.level", "warn", "-server.cacheMaxAge=60"}))
+
+	cfg, err := Load("./sample/", WithFlags(fs))
+	require.NoError(t, err)
+
+	// flag beats env beats file
+	require.Equal(t, "warn", cfg.Logger.Level)
+	require.Equal(t, SourceFlag, cfg.Source("logger.level"))
+	require.Equal(t, 60, cfg.Server.CacheMaxAge)
+	require.Equal(t, SourceFlag, cfg.Source("server.cacheMaxAge"))
+	require.Equal(t, "8080", cfg.Server.Port)
+	require.Equal(t, SourceEnv, cfg.Source("server.port"))
+	require.Equal(t, SourceFile, cfg.Source("server.host"))
+
+	// flags left at their default do not override the file
+	require.Equal(t, "localhost", cfg.Server.IP)
+	require.Equal(t, SourceFile, cfg.Source("server.IP"))
+}
+
+func TestLoadFormats(t *testing.T) {
+	t.Parallel()
+
+	// the demo config is JSON
+	cfg, err := Load("../demo/config/config.json")
+	require.NoError(t, err)
+	require.Equal(t, "kochd", cfg.App)
+	require.Equal(t, 3, cfg.Server.ShutdownCode)
+	require.Equal(t, "../demo/config/config.json", cfg.File())
+
+	// directories are searched for config.<format>
+	cfg, err = Load("./sample")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("sample", "config.toml"), cfg.File())
+
+	_, err = Load("./sample/test.ini")
+	require.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestLoadWritesDefault(t *testing.T) {
+	t.Parallel()
+
+	// missing configs are an error unless asked to write a default
+	_, err := Load(filepath.Join(t.TempDir(), "config.toml"))
 	require.ErrorIs(t, err, os.ErrNotExist)
 
-	_, err = config.LoadConfig(sampleHTML)
-	require.ErrorIs(t, err, config.ErrConfigNotJSON)
+	for _, format := range []string{"toml", "json", "yaml"} {
+		file := filepath.Join(t.TempDir(), "nested", "koch."+format)
+		cfg, err := Load(file, WithWriteDefault())
+		require.NoError(t, err, format)
+		require.Equal(t, file, cfg.File())
+		require.Equal(t, Default().Server, cfg.Server, format)
+		require.Equal(t, Default().Logger, cfg.Logger, format)
+
+		// the written file is picked up by the next load
+		cfg, err = Load(file)
+		require.NoError(t, err)
+		require.Equal(t, SourceFile, cfg.Source("server.port"))
+	}
+}
+
+func TestInit(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	file, err := Init(dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "config.toml"), file)
+
+	// the template documents every key
+	b, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Contains(t, string(b), "# port to listen on")
+	require.Contains(t, string(b), "(one of trace, debug, info")
+
+	cfg, err := Load(dir)
+	require.NoError(t, err)
+	require.Equal(t, Default().Server, cfg.Server)
+
+	_, err = Init(dir)
+	require.ErrorIs(t, err, os.ErrExist)
+
+	yamlFile, err := Init(filepath.Join(dir, "config.yaml"))
+	require.NoError(t, err)
+	cfg, err = Load(yamlFile)
+	require.NoError(t, err)
+	require.Equal(t, Default().Logger, cfg.Logger)
+}
+
+func TestJSONSchema(t *testing.T) {
+	t.Parallel()
+
+	b, err := JSONSchema()
+	require.NoError(t, err)
+
+	var schema struct {
+		Properties map[string]struct {
+			Properties map[string]struct {
+				Type string   `json:"type"`
+				Enum []string `json:"enum"`
+			} `json:"properties"`
+			AdditionalProperties interface{} `json:"additionalProperties"`
+		} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(b, &schema))
+	require.Equal(t, "integer", schema.Properties["server"].Properties["cacheMaxAge"].Type)
+	require.Equal(t, "boolean", schema.Properties["server"].Properties["secure"].Type)
+	require.Equal(t, "string", schema.Properties["session"].Properties["idleTimeout"].Type)
+	require.Contains(t, schema.Properties["logger"].Properties["level"].Enum, "debug")
+	require.Equal(t, false, schema.Properties["server"].AdditionalProperties)
+
+	// module sections share enabled and prefix and may add their own keys
+	modules, ok := schema.Properties["modules"].AdditionalProperties.(map[string]interface{})
+	require.True(t, ok)
+	require.Equal(t, true, modules["additionalProperties"])
+	require.Contains(t, modules["properties"], "enabled")
+}
+
+func TestLoadProfilesAndIncludes(t *testing.T) {
+	t.Setenv("KOCH_TEST_ADMIN_TOKEN", "from-env")
+
+	// includes are merged beneath the including file
+	cfg, err := Load("./sample/profiles")
+	require.NoError(t, err)
+	require.Equal(t, "info", cfg.Logger.Level)
+	require.Equal(t, "8080", cfg.Server.Port)
+	require.Equal(t, "localhost", cfg.Server.Host)
+	require.Equal(t, "from-env", cfg.Server.AdminToken.Value())
+	require.Len(t, cfg.Files(), 2)
+
+	// the profile is layered over the base config
+	cfg, err = Load("./sample/profiles", WithProfile("prod"))
+	require.NoError(t, err)
+	require.Equal(t, "prod", cfg.Profile())
+	require.Equal(t, "example.com", cfg.Server.Host)
+	require.Equal(t, "8080", cfg.Server.Port)
+	require.Equal(t, "s3cret", cfg.Server.AdminToken.Value())
+
+	// secrets never print
+	require.Equal(t, Redacted, fmt.Sprintf("%v", cfg.Server.AdminToken))
+	require.NotContains(t, fmt.Sprintf("%#v", cfg.Server), "s3cret")
+	for _, s := range cfg.Effective() {
+		if s.Key == "server.adminToken" {
+			require.Equal(t, Redacted, s.Value)
+		}
+	}
+
+	_, err = Load("./sample/profiles", WithProfile("missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadSecretErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+[server]
+adminToken = "env:KOCH_TEST_UNSET_SECRET"
+keyPassphrase = "file:missing.pass"
+`), 0600))
+
+	_, err := Load(file)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr), err)
+	keys := make([]string, 0, len(verr.Errors))
+	for _, fe := range verr.Errors {
+		keys = append(keys, fe.Key)
+	}
+	require.ElementsMatch(t, []string{"server.adminToken", "server.keyPassphrase"}, keys)
+}
+
+func TestLoadEnumCase(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+[database]
+driver = "Memory"
+
+[logger]
+level = "DEBUG"
+
+[session]
+store = "Database"
+`), 0600))
+
+	_, err := Load(file)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr), err)
+	keys := make([]string, 0, len(verr.Errors))
+	for _, fe := range verr.Errors {
+		keys = append(keys, fe.Key)
+	}
+	require.ElementsMatch(t, []string{"database.driver", "logger.level", "session.store"}, keys)
+}
+
+func TestLoadIncludePaths(t *testing.T) {
+	t.Parallel()
+
+	// files named in an include resolve against the include, not the including file
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "conf.d"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte(`include = ["conf.d/secrets.toml"]`), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "conf.d", "secrets.toml"), []byte(`
+[server]
+adminToken = "file:admin.token"
+
+[database]
+path = "koch.db"
+`), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "conf.d", "admin.token"), []byte("s3cret\n"), 0600))
+
+	cfg, err := Load(filepath.Join(dir, "config.toml"))
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", cfg.Server.AdminToken.Value())
+	require.Equal(t, filepath.Join(dir, "conf.d", "koch.db"), cfg.Database.Path)
+}
+
+func TestLoadIncludeCycle(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.toml"), []byte(`include = ["b.toml"]`), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.toml"), []byte(`include = ["a.toml"]`), 0600))
+
+	_, err := Load(filepath.Join(dir, "a.toml"))
+	require.ErrorIs(t, err, ErrIncludeCycle)
+}
+
+func TestLoadModules(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+[modules.chat]
+prefix = "talk"
+`), 0600))
+	_, err := Load(file)
+	var verr *ValidationError
+	require.ErrorAs(t, err, &verr)
+	require.Equal(t, "modules.chat.prefix", verr.Errors[0].Key)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`
+[modules.chat]
+maxRooms = 3
+
+[modules.shop]
+enabled = true
+prefix = "/store"
+`), 0600))
+
+	// module sections keep their defaults, extra keys are left to the module
+	t.Setenv("KOCH_MODULES_CHAT_PREFIX", "/talk")
+	cfg, err := Load(file)
+	require.NoError(t, err)
+	require.True(t, cfg.Modules["chat"].Enabled)
+	require.Equal(t, "/talk", cfg.Modules["chat"].Prefix)
+	require.Equal(t, SourceEnv, cfg.Source("modules.chat.prefix"))
+	require.EqualValues(t, 3, cfg.Modules["chat"].Settings["maxrooms"])
+	require.Equal(t, ModuleConfig{Enabled: true, Prefix: "/store"}, cfg.Modules["shop"])
 }
-*/
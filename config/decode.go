@@ -0,0 +1,152 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// decode strictly decodes raw settings on top of the defaults, resolves
+// relative file paths against dir and validates the result. Unknown keys,
+// type mismatches and validation failures are reported together.
+func decode(settings map[string]interface{}, dir string) (*Config, error) {
+	cfg := Default()
+	verr := &ValidationError{}
+	settings = withModuleDefaults(settings, cfg.Modules)
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           cfg,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			secretHook(dir),
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Decode(settings); err != nil {
+		if merr, ok := err.(*mapstructure.Error); ok {
+			for _, msg := range merr.Errors {
+				verr.add(decodeErrKey(msg), msg)
+			}
+		} else {
+			verr.add("", err.Error())
+		}
+	}
+
+	for _, key := range unknownKeys(settings, reflect.TypeOf(*cfg), "") {
+		verr.add(key, "unknown key")
+	}
+
+	cfg.resolvePaths(dir)
+	cfg.validate(verr)
+
+	if err := verr.err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// withModuleDefaults fills the shared keys of module sections found in settings
+// from defaults, since mapstructure decodes each map entry from scratch
+func withModuleDefaults(settings map[string]interface{}, defaults ModulesConfig) map[string]interface{} {
+	modules, ok := settings["modules"].(map[string]interface{})
+	if !ok {
+		return settings
+	}
+
+	for name, raw := range modules {
+		section, ok := raw.(map[string]interface{})
+		def, hasDefault := defaults[name]
+		if !ok || !hasDefault {
+			continue
+		}
+		merged := map[string]interface{}{"enabled": def.Enabled, "prefix": def.Prefix}
+		for key, val := range section {
+			merged[key] = val
+		}
+		modules[name] = merged
+	}
+	return settings
+}
+
+// decodeErrKey extracts the quoted key name from a mapstructure error
+func decodeErrKey(msg string) string {
+	start := strings.Index(msg, "'")
+	if start < 0 {
+		return ""
+	}
+	end := strings.Index(msg[start+1:], "'")
+	if end < 0 {
+		return ""
+	}
+	return msg[start+1 : start+1+end]
+}
+
+// unknownKeys walks raw settings alongside the struct type t and returns the
+// full path of every key that has no matching field
+func unknownKeys(settings map[string]interface{}, t reflect.Type, prefix string) []string {
+	var unknown []string
+	for key, val := range settings {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		field, ok := fieldByKey(t, key)
+		if !ok {
+			unknown = append(unknown, path)
+			continue
+		}
+
+		sub, isMap := val.(map[string]interface{})
+		if isMap && field.Type.Kind() == reflect.Struct {
+			unknown = append(unknown, unknownKeys(sub, field.Type, path)...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// fieldByKey finds the field of t whose mapstructure tag matches key, ignoring case
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && strings.EqualFold(tagName(f), key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// tagName returns the config key name of a struct field
+func tagName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// fileKeys are the keys naming files, which are relative to the config file they are set in
+var fileKeys = []string{"server.certFile", "server.keyFile", "server.rootCA", "database.path"}
+
+// resolvePaths makes relative file references relative to the config file directory
+func (c *Config) resolvePaths(dir string) {
+	if dir == "" {
+		return
+	}
+	root := reflect.ValueOf(c).Elem()
+	for _, key := range fileKeys {
+		v, _ := lookup(root, key)
+		if p := v.String(); p != "" && !filepath.IsAbs(p) {
+			v.SetString(filepath.Join(dir, p))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// jsonSchemaDialect is the JSON Schema draft the generated schema conforms to
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// JSONSchema returns a JSON Schema describing the config file, generated from
+// the Config struct, for editor completion and validation
+func JSONSchema() ([]byte, error) {
+	defaults := reflect.ValueOf(Default()).Elem()
+	schema := structSchema(defaults)
+	schema["$schema"] = jsonSchemaDialect
+	schema["title"] = "koch configuration"
+
+	// include lists fragments to merge beneath the file
+	schema["properties"].(map[string]interface{})[includeKey] = map[string]interface{}{
+		"description": "config files to merge beneath this one (relative to this file)",
+		"type":        "array",
+		"items":       map[string]interface{}{"type": "string"},
+	}
+
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+func structSchema(v reflect.Value) map[string]interface{} {
+	props := make(map[string]interface{})
+	forEachField(v.Type(), func(f reflect.StructField) {
+		props[tagName(f)] = fieldSchema(f, v.FieldByIndex(f.Index))
+	})
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func fieldSchema(f reflect.StructField, v reflect.Value) map[string]interface{} {
+	var schema map[string]interface{}
+	switch kind := f.Type.Kind(); {
+	case f.Type == durationType:
+		schema = map[string]interface{}{"type": "string", "default": v.Interface().(time.Duration).String()}
+	case kind == reflect.Struct:
+		schema = structSchema(v)
+	case kind == reflect.Map:
+		// entries share the keys of the element type and may add their own
+		entry := structSchema(reflect.New(f.Type.Elem()).Elem())
+		entry["additionalProperties"] = true
+		schema = map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": entry,
+			"default":              mapDefaults(v),
+		}
+	case kind == reflect.Slice:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).Interface()
+		}
+		schema = map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "default": items}
+	case kind == reflect.Bool:
+		schema = map[string]interface{}{"type": "boolean", "default": v.Bool()}
+	case kind == reflect.Int || kind == reflect.Int64:
+		schema = map[string]interface{}{"type": "integer", "default": v.Int()}
+	default:
+		schema = map[string]interface{}{"type": "string", "default": v.String()}
+	}
+
+	if desc := fieldDesc(f); desc != "" {
+		schema["description"] = desc
+	}
+	if enum := fieldEnum(f); enum != nil {
+		schema["enum"] = enum
+	}
+	return schema
+}
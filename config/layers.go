@@ -0,0 +1,152 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/aljo242/koch/util/file_util"
+
+	"github.com/spf13/viper"
+)
+
+// includeKey is the top-level key listing config fragments to merge beneath a file
+const includeKey = "include"
+
+// ErrIncludeCycle indicates that config files include each other
+var ErrIncludeCycle = errors.New("config include cycle")
+
+// layers reads file and the profile file next to it, if any, and merges them into
+// a single settings map. Each file's includes are merged beneath the file itself, so
+// the precedence is base includes < base < profile includes < profile.
+// It returns the merged settings and every file that was read.
+func layers(file, profile string) (map[string]interface{}, []string, error) {
+	settings := make(map[string]interface{})
+	var files []string
+
+	if err := readLayer(file, settings, &files, nil); err != nil {
+		return nil, nil, err
+	}
+
+	if profile != "" {
+		profileFile := profilePath(file, profile)
+		if !file_util.Exists(profileFile) {
+			return nil, nil, fmt.Errorf("profile %q : config file %v : %w", profile, profileFile, os.ErrNotExist)
+		}
+		if err := readLayer(profileFile, settings, &files, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return settings, files, nil
+}
+
+// profilePath returns the profile file for file, e.g. config.prod.toml for config.toml
+func profilePath(file, profile string) string {
+	ext := filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "." + profile + ext
+}
+
+// readLayer merges the includes of file and then file itself into settings
+func readLayer(file string, settings map[string]interface{}, files *[]string, stack []string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if contains(stack, abs) {
+		return fmt.Errorf("%w : %v", ErrIncludeCycle, strings.Join(append(stack, abs), " -> "))
+	}
+	stack = append(stack, abs)
+
+	format := formatOf(file)
+	if !contains(Formats, format) {
+		return fmt.Errorf("%w %q : expected one of %v", ErrUnsupportedFormat, filepath.Ext(file), Formats)
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType(format)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("error reading config file %v : %w", file, err)
+	}
+	*files = append(*files, file)
+
+	own := v.AllSettings()
+	includes := v.GetStringSlice(includeKey)
+	delete(own, includeKey)
+
+	for _, inc := range includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(file), inc)
+		}
+		if err := readLayer(inc, settings, files, stack); err != nil {
+			return fmt.Errorf("included from %v : %w", file, err)
+		}
+	}
+
+	resolveLayer(own, reflect.TypeOf(Config{}), "", filepath.Dir(abs))
+	mergeSettings(settings, own)
+	return nil
+}
+
+// resolveLayer makes the relative file references in the settings of one file,
+// file: secrets and fileKeys, absolute against dir, the directory of that file.
+// What is left relative afterwards, such as overrides, resolves against the base
+// config file in decode.
+func resolveLayer(settings map[string]interface{}, t reflect.Type, prefix, dir string) {
+	for key, val := range settings {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		field, ok := fieldByKey(t, key)
+		if !ok {
+			continue
+		}
+
+		switch val := val.(type) {
+		case map[string]interface{}:
+			if field.Type.Kind() == reflect.Struct {
+				resolveLayer(val, field.Type, path, dir)
+			}
+		case string:
+			ref := strings.TrimPrefix(val, secretFilePrefix)
+			switch {
+			case field.Type == secretType && ref != val && !filepath.IsAbs(ref):
+				settings[key] = secretFilePrefix + filepath.Join(dir, ref)
+			case isFileKey(path) && val != "" && !filepath.IsAbs(val):
+				settings[key] = filepath.Join(dir, val)
+			}
+		}
+	}
+}
+
+func isFileKey(key string) bool {
+	for _, k := range fileKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeSettings deeply merges src into dst, with src winning on conflicts
+func mergeSettings(dst, src map[string]interface{}) {
+	for key, val := range src {
+		srcMap, srcIsMap := val.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeSettings(dstMap, srcMap)
+			continue
+		}
+		if srcIsMap {
+			copied := make(map[string]interface{}, len(srcMap))
+			mergeSettings(copied, srcMap)
+			val = copied
+		}
+		dst[key] = val
+	}
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// DefaultEnvPrefix is prepended to every environment variable override
+const DefaultEnvPrefix = "KOCH"
+
+// Source describes where the effective value of a key came from.
+// Precedence is Default < File < Env < Flag.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// CommonKeys are the keys exposed as command-line flags by RegisterFlags
+var CommonKeys = []string{
+	"logger.level",
+	"server.host",
+	"server.port",
+	"server.IP",
+	"server.chooseIP",
+	"server.secure",
+	"server.certFile",
+	"server.keyFile",
+	"server.rootCA",
+	"server.cacheMaxAge",
+}
+
+// Option customizes how Load resolves a config
+type Option func(*loadOptions)
+
+type loadOptions struct {
+	envPrefix    string
+	flags        *flag.FlagSet
+	writeDefault bool
+	profile      string
+}
+
+// WithWriteDefault makes Load write the commented default config when none exists
+func WithWriteDefault() Option {
+	return func(o *loadOptions) {
+		o.writeDefault = true
+	}
+}
+
+// WithProfile layers the named profile file, e.g. config.prod.toml, over the base config
+func WithProfile(profile string) Option {
+	return func(o *loadOptions) {
+		o.profile = profile
+	}
+}
+
+// WithEnvPrefix changes the prefix of the environment variables bound to every key
+func WithEnvPrefix(prefix string) Option {
+	return func(o *loadOptions) {
+		o.envPrefix = prefix
+	}
+}
+
+// WithFlags applies every flag of fs registered by RegisterFlags that was set on the command line
+func WithFlags(fs *flag.FlagSet) Option {
+	return func(o *loadOptions) {
+		o.flags = fs
+	}
+}
+
+// RegisterFlags adds a flag named after each of the CommonKeys to fs,
+// typed and defaulted from the config schema
+func RegisterFlags(fs *flag.FlagSet) {
+	defaults := reflect.ValueOf(Default()).Elem()
+	for _, key := range CommonKeys {
+		field, ok := lookup(defaults, key)
+		if !ok {
+			continue
+		}
+
+		usage := fmt.Sprintf("override %v (env %v)", key, envName(DefaultEnvPrefix, key))
+		switch field.Kind() {
+		case reflect.Bool:
+			fs.Bool(key, field.Bool(), usage)
+		case reflect.Int:
+			fs.Int(key, int(field.Int()), usage)
+		default:
+			fs.String(key, field.String(), usage)
+		}
+	}
+}
+
+// applyOverrides sets every key found in the environment or on the command line
+// on v and returns the source of each key's value
+func applyOverrides(v *viper.Viper, o *loadOptions) map[string]Source {
+	setFlags := make(map[string]string)
+	if o.flags != nil {
+		o.flags.Visit(func(f *flag.Flag) {
+			setFlags[f.Name] = f.Value.String()
+		})
+	}
+
+	// module sections present in the defaults or the file can be overridden too
+	modules := Default().Modules
+	for name := range v.GetStringMap("modules") {
+		if _, ok := modules[name]; !ok {
+			modules[name] = ModuleConfig{}
+		}
+	}
+
+	sources := make(map[string]Source)
+	for _, key := range append(Keys(), ModuleKeys(moduleNames(modules)...)...) {
+		if val, ok := setFlags[key]; ok {
+			v.Set(key, val)
+			sources[key] = SourceFlag
+			continue
+		}
+		if val, ok := os.LookupEnv(envName(o.envPrefix, key)); ok {
+			v.Set(key, val)
+			sources[key] = SourceEnv
+			continue
+		}
+		if v.InConfig(key) {
+			sources[key] = SourceFile
+			continue
+		}
+		sources[key] = SourceDefault
+	}
+	return sources
+}
+
+// Setting is the effective value of a single key
+type Setting struct {
+	Key    string
+	Value  interface{}
+	Source Source
+}
+
+// Source reports where the effective value of key came from
+func (c *Config) Source(key string) Source {
+	if src, ok := c.sources[key]; ok {
+		return src
+	}
+	return SourceDefault
+}
+
+// Effective lists the value and source of every key, sorted by key.
+// Secret values are redacted.
+func (c *Config) Effective() []Setting {
+	root := reflect.ValueOf(c).Elem()
+	keys := Keys()
+	sort.Strings(keys)
+
+	settings := make([]Setting, 0, len(keys))
+	for _, key := range keys {
+		field, ok := lookup(root, key)
+		if !ok {
+			continue
+		}
+		val := field.Interface()
+		if secret, ok := val.(Secret); ok {
+			val = secret.String()
+		}
+		settings = append(settings, Setting{Key: key, Value: val, Source: c.Source(key)})
+	}
+
+	for _, name := range moduleNames(c.Modules) {
+		m := c.Modules[name]
+		prefix := "modules." + name + "."
+		settings = append(settings,
+			Setting{Key: prefix + "enabled", Value: m.Enabled, Source: c.Source(prefix + "enabled")},
+			Setting{Key: prefix + "prefix", Value: m.Prefix, Source: c.Source(prefix + "prefix")},
+		)
+		settings = append(settings, flattenSettings(prefix, m.Settings)...)
+	}
+	return settings
+}
+
+// flattenSettings lists the module specific keys of a module section, which can only come from files
+func flattenSettings(prefix string, m map[string]interface{}) []Setting {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var settings []Setting
+	for _, key := range keys {
+		if sub, ok := m[key].(map[string]interface{}); ok {
+			settings = append(settings, flattenSettings(prefix+key+".", sub)...)
+			continue
+		}
+		settings = append(settings, Setting{Key: prefix + key, Value: m[key], Source: SourceFile})
+	}
+	return settings
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Keys returns the full dotted path of every fixed leaf key in the config schema.
+// Module sections are keyed by module name, see ModuleKeys.
+func Keys() []string {
+	return schemaKeys(reflect.TypeOf(Config{}), "")
+}
+
+func schemaKeys(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Type.Kind() == reflect.Map {
+			continue // unexported or keyed by name
+		}
+
+		key := tagName(f)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if f.Type.Kind() == reflect.Struct {
+			keys = append(keys, schemaKeys(f.Type, key)...)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ModuleKeys returns the keys shared by every module section for each of names
+func ModuleKeys(names ...string) []string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+
+	var keys []string
+	for _, name := range sorted {
+		forEachField(reflect.TypeOf(ModuleConfig{}), func(f reflect.StructField) {
+			keys = append(keys, "modules."+name+"."+tagName(f))
+		})
+	}
+	return keys
+}
+
+// lookup returns the field of v addressed by the dotted key, ignoring case
+func lookup(v reflect.Value, key string) (reflect.Value, bool) {
+	for _, part := range strings.Split(key, ".") {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		f, ok := fieldByKey(v.Type(), part)
+		if !ok {
+			return reflect.Value{}, false
+		}
+		v = v.FieldByIndex(f.Index)
+	}
+	return v, true
+}
+
+// envName returns the environment variable bound to key, e.g. KOCH_SERVER_PORT
+func envName(prefix, key string) string {
+	name := strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+	if prefix == "" {
+		return name
+	}
+	return strings.ToUpper(prefix) + "_" + name
+}
+
+// requiresRestart reports whether key, or the section containing it, is tagged reload:"restart"
+func requiresRestart(key string) bool {
+	t := reflect.TypeOf(Config{})
+	for _, part := range strings.Split(key, ".") {
+		if t.Kind() == reflect.Map {
+			t = t.Elem() // part names an entry, such as a module
+			continue
+		}
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		f, ok := fieldByKey(t, part)
+		if !ok {
+			return false
+		}
+		if f.Tag.Get("reload") == "restart" {
+			return true
+		}
+		t = f.Type
+	}
+	return false
+}
+
+// changedKeys returns every schema key whose value differs between a and b. Changes
+// to the settings of a module are reported as modules.<name>.
+func changedKeys(a, b *Config) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var changed []string
+	for _, key := range Keys() {
+		fa, _ := lookup(va, key)
+		fb, _ := lookup(vb, key)
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			changed = append(changed, key)
+		}
+	}
+
+	for _, name := range moduleNames(a.Modules, b.Modules) {
+		ma, mb := a.Modules[name], b.Modules[name]
+		if ma.Enabled != mb.Enabled {
+			changed = append(changed, "modules."+name+".enabled")
+		}
+		if ma.Prefix != mb.Prefix {
+			changed = append(changed, "modules."+name+".prefix")
+		}
+		if !reflect.DeepEqual(ma.Settings, mb.Settings) {
+			changed = append(changed, "modules."+name)
+		}
+	}
+	return changed
+}
+
+// moduleNames returns the sorted union of the module names in each of ms
+func moduleNames(ms ...ModulesConfig) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range ms {
+		for name := range m {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldEnum returns the values allowed by the enum tag of f, or nil
+func fieldEnum(f reflect.StructField) []string {
+	enum := f.Tag.Get("enum")
+	if enum == "" {
+		return nil
+	}
+	return strings.Split(enum, ",")
+}
+
+// fieldByPath returns the struct field addressed by the dotted key
+func fieldByPath(key string) (reflect.StructField, bool) {
+	t := reflect.TypeOf(Config{})
+	var f reflect.StructField
+	for _, part := range strings.Split(key, ".") {
+		if t.Kind() != reflect.Struct {
+			return reflect.StructField{}, false
+		}
+		var ok bool
+		if f, ok = fieldByKey(t, part); !ok {
+			return reflect.StructField{}, false
+		}
+		t = f.Type
+	}
+	return f, true
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+
+	// Redacted replaces secret values whenever a config is printed
+	Redacted = "[REDACTED]"
+)
+
+// Secret is a sensitive config value. In a config file it may be given as
+// "env:NAME" to read the environment variable NAME, or as "file:path" to read the
+// contents of path (relative to the config file it is set in), instead of as plaintext.
+// Secrets print as [REDACTED]; use Value to read them.
+type Secret string
+
+// Value returns the resolved secret
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// String redacts the secret so it never leaks into logs
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// GoString redacts the secret for %#v
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+var secretType = reflect.TypeOf(Secret(""))
+
+// secretHook returns a decode hook that resolves env: and file: secret references,
+// reading relative files from dir
+func secretHook(dir string) func(from, to reflect.Type, data interface{}) (interface{}, error) {
+	return func(from, to reflect.Type, data interface{}) (interface{}, error) {
+		if to != secretType || from.Kind() != reflect.String {
+			return data, nil
+		}
+		return resolveSecret(data.(string), dir)
+	}
+}
+
+func resolveSecret(ref, dir string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, secretEnvPrefix):
+		name := strings.TrimPrefix(ref, secretEnvPrefix)
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %v is not set", name)
+		}
+		return val, nil
+	case strings.HasPrefix(ref, secretFilePrefix):
+		path := strings.TrimPrefix(ref, secretFilePrefix)
+		if !filepath.IsAbs(path) && dir != "" {
+			path = filepath.Join(dir, path)
+		}
+		b, err := ioutil.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file : %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	default:
+		return ref, nil
+	}
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// secretDesc is appended to the description of every Secret key
+const secretDesc = "(secret: may be given as env:NAME or file:path)"
+
+// WriteTemplate writes the default config in format with every key documented.
+// TOML and YAML templates are commented; JSON has no comments, so it only holds the defaults.
+func WriteTemplate(w io.Writer, format string) error {
+	defaults := reflect.ValueOf(Default()).Elem()
+
+	switch format {
+	case "toml":
+		return writeTOMLTemplate(w, defaults)
+	case "yaml", "yml":
+		return writeYAMLTemplate(w, defaults)
+	case "json":
+		b, err := json.MarshalIndent(defaultsMap(defaults), "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	default:
+		return fmt.Errorf("%w %q : expected one of %v", ErrUnsupportedFormat, format, Formats)
+	}
+}
+
+func writeTOMLTemplate(w io.Writer, v reflect.Value) error {
+	var buf bytes.Buffer
+	buf.WriteString("# koch configuration\n")
+
+	// top-level keys must come before the first table
+	var sections []reflect.StructField
+	forEachField(v.Type(), func(f reflect.StructField) {
+		if f.Type.Kind() == reflect.Struct || f.Type.Kind() == reflect.Map {
+			sections = append(sections, f)
+			return
+		}
+		buf.WriteString("\n")
+		writeComment(&buf, "", f)
+		fmt.Fprintf(&buf, "%v = %v\n", tagName(f), tomlValue(v.FieldByIndex(f.Index)))
+	})
+
+	writeTable := func(name string, section reflect.Value) {
+		fmt.Fprintf(&buf, "[%v]\n", name)
+		forEachField(section.Type(), func(f reflect.StructField) {
+			writeComment(&buf, "", f)
+			fmt.Fprintf(&buf, "%v = %v\n", tagName(f), tomlValue(section.FieldByIndex(f.Index)))
+		})
+	}
+
+	for _, s := range sections {
+		buf.WriteString("\n")
+		writeComment(&buf, "", s)
+		section := v.FieldByIndex(s.Index)
+		if s.Type.Kind() != reflect.Map {
+			writeTable(tagName(s), section)
+			continue
+		}
+		for _, name := range sortedKeys(section) {
+			writeTable(tagName(s)+"."+name, section.MapIndex(reflect.ValueOf(name)))
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeYAMLTemplate(w io.Writer, v reflect.Value) error {
+	var buf bytes.Buffer
+	buf.WriteString("# koch configuration\n")
+
+	forEachField(v.Type(), func(f reflect.StructField) {
+		buf.WriteString("\n")
+		writeComment(&buf, "", f)
+		if f.Type.Kind() != reflect.Struct && f.Type.Kind() != reflect.Map {
+			fmt.Fprintf(&buf, "%v: %v\n", tagName(f), tomlValue(v.FieldByIndex(f.Index)))
+			return
+		}
+
+		section := v.FieldByIndex(f.Index)
+		if f.Type.Kind() == reflect.Map {
+			if section.Len() == 0 {
+				fmt.Fprintf(&buf, "%v: {}\n", tagName(f))
+				return
+			}
+			fmt.Fprintf(&buf, "%v:\n", tagName(f))
+			for _, name := range sortedKeys(section) {
+				fmt.Fprintf(&buf, "  %v:\n", name)
+				writeYAMLFields(&buf, "    ", section.MapIndex(reflect.ValueOf(name)))
+			}
+			return
+		}
+		if f.Type.NumField() == 0 {
+			fmt.Fprintf(&buf, "%v: {}\n", tagName(f))
+			return
+		}
+		fmt.Fprintf(&buf, "%v:\n", tagName(f))
+		writeYAMLFields(&buf, "  ", section)
+	})
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeYAMLFields(buf *bytes.Buffer, indent string, section reflect.Value) {
+	forEachField(section.Type(), func(f reflect.StructField) {
+		writeComment(buf, indent, f)
+		fmt.Fprintf(buf, "%v%v: %v\n", indent, tagName(f), tomlValue(section.FieldByIndex(f.Index)))
+	})
+}
+
+// sortedKeys returns the keys of a string keyed map in order
+func sortedKeys(m reflect.Value) []string {
+	keys := make([]string, 0, m.Len())
+	for _, k := range m.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// forEachField calls fn for every exported field of t that maps to a named key
+func forEachField(t reflect.Type, fn func(f reflect.StructField)) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && !strings.Contains(f.Tag.Get("mapstructure"), ",remain") {
+			fn(f)
+		}
+	}
+}
+
+func writeComment(buf *bytes.Buffer, indent string, f reflect.StructField) {
+	desc := fieldDesc(f)
+	if desc == "" {
+		return
+	}
+	fmt.Fprintf(buf, "%v# %v\n", indent, desc)
+}
+
+// fieldDesc returns the documentation of a config field
+func fieldDesc(f reflect.StructField) string {
+	var parts []string
+	if desc := f.Tag.Get("desc"); desc != "" {
+		parts = append(parts, desc)
+	}
+	if enum := fieldEnum(f); enum != nil {
+		parts = append(parts, "(one of "+strings.Join(enum, ", ")+")")
+	}
+	if f.Type == secretType {
+		parts = append(parts, secretDesc)
+	}
+	if f.Tag.Get("reload") == "restart" {
+		parts = append(parts, "(requires a restart to change)")
+	}
+	return strings.Join(parts, " ")
+}
+
+// durationType is written as a string such as "1h30m"
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// tomlValue formats a scalar as a TOML (and YAML compatible) literal
+func tomlValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return strconv.Quote(v.Interface().(time.Duration).String())
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = tomlValue(v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprintf("%v", v.Interface())
+	}
+}
+
+// defaultsMap converts v into nested maps keyed by config key names
+func defaultsMap(v reflect.Value) map[string]interface{} {
+	m := make(map[string]interface{})
+	forEachField(v.Type(), func(f reflect.StructField) {
+		field := v.FieldByIndex(f.Index)
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			m[tagName(f)] = defaultsMap(field)
+			return
+		case reflect.Map:
+			m[tagName(f)] = mapDefaults(field)
+			return
+		}
+		if f.Type == durationType {
+			m[tagName(f)] = field.Interface().(time.Duration).String()
+			return
+		}
+		m[tagName(f)] = field.Interface()
+	})
+	return m
+}
+
+// mapDefaults converts a map of sections into nested maps keyed by config key names
+func mapDefaults(v reflect.Value) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, name := range sortedKeys(v) {
+		m[name] = defaultsMap(v.MapIndex(reflect.ValueOf(name)))
+	}
+	return m
+}
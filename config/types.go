@@ -0,0 +1,128 @@
+package config
+
+import "time"
+
+// Config is the typed representation of a koch configuration file.
+// The desc tags document each key in the generated template and JSON Schema.
+type Config struct {
+	App      string         `mapstructure:"app" desc:"name of the application"`
+	Owner    OwnerConfig    `mapstructure:"owner" desc:"who runs this site"`
+	Database DatabaseConfig `mapstructure:"database" reload:"restart" desc:"storage backend settings"`
+	Logger   LoggerConfig   `mapstructure:"logger" desc:"logging settings"`
+	Server   ServerConfig   `mapstructure:"server" desc:"HTTP(S) server settings"`
+	Session  SessionConfig  `mapstructure:"session" reload:"restart" desc:"browser session settings"`
+	Modules  ModulesConfig  `mapstructure:"modules" desc:"settings of the x/ modules"`
+
+	// sources records where the value of each key came from
+	sources map[string]Source
+
+	// file is the config file the config was loaded from
+	file string
+
+	// files lists every file merged into the config
+	files []string
+
+	// profile is the profile layered over the base file
+	profile string
+}
+
+// OwnerConfig describes the owner of the application
+type OwnerConfig struct {
+	Name string `mapstructure:"name" desc:"name of the site owner"`
+}
+
+// DatabaseConfig selects the storage backend shared by the modules
+type DatabaseConfig struct {
+	Driver string `mapstructure:"driver" enum:"bolt,memory" desc:"storage driver: bolt (embedded file) or memory (lost on restart)"`
+	Path   string `mapstructure:"path" desc:"database file of the bolt driver (relative to this file)"`
+}
+
+// LoggerConfig holds the logging settings
+type LoggerConfig struct {
+	Level string `mapstructure:"level" enum:"trace,debug,info,warn,error,fatal,panic,disabled" desc:"minimum level of log messages that are written"`
+}
+
+// ServerConfig holds the HTTP(S) server settings.
+// Fields tagged reload:"restart" only take effect after kochd is restarted.
+type ServerConfig struct {
+	Host         string `mapstructure:"host" reload:"restart" desc:"public host name, used for HTTPS redirects and page templates"`
+	Port         string `mapstructure:"port" reload:"restart" desc:"port to listen on"`
+	IP           string `mapstructure:"IP" reload:"restart" desc:"IP address to listen on, or localhost"`
+	ChooseIP     bool   `mapstructure:"chooseIP" reload:"restart" desc:"prompt for the IP address to listen on at startup"`
+	Secure       bool   `mapstructure:"secure" reload:"restart" desc:"serve HTTPS and redirect HTTP traffic to it"`
+	DebugLog     bool   `mapstructure:"debugLog" desc:"log extra request details"`
+	CmdEnable    bool   `mapstructure:"cmdEnable" reload:"restart" desc:"accept the shutdown code on stdin"`
+	CertFile     string `mapstructure:"certFile" reload:"restart" desc:"TLS certificate, required when secure (relative to this file)"`
+	KeyFile      string `mapstructure:"keyFile" reload:"restart" desc:"TLS private key, required when secure (relative to this file)"`
+	RootCA       string `mapstructure:"rootCA" reload:"restart" desc:"root CA certificate, required when secure (relative to this file)"`
+	CacheMaxAge  int    `mapstructure:"cacheMaxAge" desc:"Cache-Control max-age of static resources, in seconds"`
+	ShutdownCode int    `mapstructure:"shutdownCode" reload:"restart" desc:"code to type on stdin to shut the server down"`
+
+	// KeyPassphrase decrypts an encrypted keyFile
+	KeyPassphrase Secret `mapstructure:"keyPassphrase" reload:"restart" desc:"passphrase of an encrypted keyFile"`
+
+	// AdminToken authenticates requests to administrative endpoints
+	AdminToken Secret `mapstructure:"adminToken" desc:"bearer token of the /admin endpoints, which are off when it is empty"`
+
+	// AllowedOrigins and CSRF protect cookie authenticated requests from other sites
+	AllowedOrigins []string `mapstructure:"allowedOrigins" reload:"restart" desc:"origins (scheme://host[:port]) that may open WebSockets and post forms, defaults to server.host"`
+	CSRF           bool     `mapstructure:"csrf" reload:"restart" desc:"require a CSRF token, from GET /csrf, on form posts and WebSocket upgrades"`
+}
+
+// MinSessionSecret is the shortest session.secret accepted, in bytes
+const MinSessionSecret = 32
+
+// SessionConfig holds the settings of browser sessions. Session cookies are marked
+// Secure when server.secure is enabled.
+type SessionConfig struct {
+	CookieName    string        `mapstructure:"cookieName" desc:"name of the session cookie"`
+	Store         string        `mapstructure:"store" enum:"memory,database" desc:"where sessions are kept: memory (lost on restart) or the database"`
+	IdleTimeout   time.Duration `mapstructure:"idleTimeout" desc:"how long a session lasts without requests"`
+	MaxLifetime   time.Duration `mapstructure:"maxLifetime" desc:"how long a session lasts at most, however active"`
+	Secret        Secret        `mapstructure:"secret" desc:"key of at least 32 bytes that signs session cookies, random on every start if empty"`
+	EncryptionKey Secret        `mapstructure:"encryptionKey" desc:"encrypts session cookies when set"`
+}
+
+// ModulesConfig maps the name of each x/ module to its [modules.<name>] section
+type ModulesConfig map[string]ModuleConfig
+
+// ModuleConfig holds the settings shared by every module plus the module's own
+// settings, which modules may apply without a restart
+type ModuleConfig struct {
+	Enabled bool   `mapstructure:"enabled" reload:"restart" desc:"mount the module and start it with the server"`
+	Prefix  string `mapstructure:"prefix" reload:"restart" desc:"path prefix of the module's routes, defaults to /<name>"`
+
+	// Settings holds the remaining keys, decoded by the module itself
+	Settings map[string]interface{} `mapstructure:",remain"`
+}
+
+// Default returns the configuration used for any key that is not set
+func Default() *Config {
+	return &Config{
+		App: "koch",
+		Database: DatabaseConfig{
+			Driver: "bolt",
+			Path:   "koch.db",
+		},
+		Logger: LoggerConfig{
+			Level: "error",
+		},
+		Server: ServerConfig{
+			Host:           "localhost",
+			Port:           "80",
+			IP:             "localhost",
+			CacheMaxAge:    180,
+			ShutdownCode:   -3,
+			AllowedOrigins: []string{},
+		},
+		Session: SessionConfig{
+			CookieName:  "koch_session",
+			Store:       "database",
+			IdleTimeout: 7 * 24 * time.Hour,
+			MaxLifetime: 30 * 24 * time.Hour,
+		},
+		Modules: ModulesConfig{
+			"chat": {Enabled: true},
+		},
+	}
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/aljo242/koch/util/file_util"
+)
+
+// FieldError describes a single problem with a config key
+type FieldError struct {
+	Key string
+	Msg string
+}
+
+func (e FieldError) Error() string {
+	if e.Key == "" {
+		return e.Msg
+	}
+	return e.Key + ": " + e.Msg
+}
+
+// ValidationError aggregates every problem found while decoding or validating a config
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Error())
+	}
+	return ErrInvalidConfig.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+// Unwrap allows errors.Is(err, ErrInvalidConfig)
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+func (e *ValidationError) add(key, msg string) {
+	e.Errors = append(e.Errors, FieldError{Key: key, Msg: msg})
+}
+
+// err returns nil if no problems were recorded
+func (e *ValidationError) err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate checks every section of the config and reports all problems at once
+func (c *Config) Validate() error {
+	verr := &ValidationError{}
+	c.validate(verr)
+	return verr.err()
+}
+
+func (c *Config) validate(verr *ValidationError) {
+	c.validateEnums(verr)
+
+	s := c.Server
+	if s.Host == "" {
+		verr.add("server.host", "must not be empty")
+	}
+
+	port, err := strconv.Atoi(s.Port)
+	if err != nil || port < 1 || port > 65535 {
+		verr.add("server.port", "must be a number between 1 and 65535, got \""+s.Port+"\"")
+	}
+
+	if !s.ChooseIP && s.IP != "localhost" && net.ParseIP(s.IP) == nil {
+		verr.add("server.IP", "must be \"localhost\" or a valid IP address, got \""+s.IP+"\"")
+	}
+
+	if s.CacheMaxAge < 0 {
+		verr.add("server.cacheMaxAge", "must not be negative")
+	}
+
+	for _, origin := range s.AllowedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			verr.add("server.allowedOrigins", "must list origins such as https://example.com, got \""+origin+"\"")
+		}
+	}
+
+	checkFile := func(key, path string) {
+		if path == "" {
+			if s.Secure {
+				verr.add(key, "is required when server.secure is enabled")
+			}
+			return
+		}
+		if !file_util.Exists(path) {
+			verr.add(key, "file \""+path+"\" does not exist")
+		}
+	}
+	checkFile("server.certFile", s.CertFile)
+	checkFile("server.keyFile", s.KeyFile)
+	checkFile("server.rootCA", s.RootCA)
+
+	if c.Database.Driver == "bolt" && c.Database.Path == "" {
+		verr.add("database.path", "is required by the bolt driver")
+	}
+
+	if c.Session.CookieName == "" || strings.ContainsAny(c.Session.CookieName, " \t;,=\"") {
+		verr.add("session.cookieName", "must be a valid cookie name, got \""+c.Session.CookieName+"\"")
+	}
+	if c.Session.IdleTimeout <= 0 {
+		verr.add("session.idleTimeout", "must be positive")
+	}
+	if c.Session.MaxLifetime < c.Session.IdleTimeout {
+		verr.add("session.maxLifetime", "must not be shorter than session.idleTimeout")
+	}
+	if n := len(c.Session.Secret); n > 0 && n < MinSessionSecret {
+		verr.add("session.secret", "must be at least "+strconv.Itoa(MinSessionSecret)+" bytes")
+	}
+
+	for _, name := range moduleNames(c.Modules) {
+		if p := c.Modules[name].Prefix; p != "" && !strings.HasPrefix(p, "/") {
+			verr.add("modules."+name+".prefix", "must start with \"/\", got \""+p+"\"")
+		}
+	}
+}
+
+// validateEnums checks every key whose field has an enum tag. Values are compared
+// exactly, as the packages reading them do.
+func (c *Config) validateEnums(verr *ValidationError) {
+	root := reflect.ValueOf(c).Elem()
+	for _, key := range Keys() {
+		f, _ := fieldByPath(key)
+		enum := fieldEnum(f)
+		if enum == nil {
+			continue
+		}
+		val, _ := lookup(root, key)
+		if !contains(enum, val.String()) {
+			verr.add(key, "must be one of "+strings.Join(enum, ", ")+", got \""+val.String()+"\"")
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadDelay debounces the burst of events editors produce when saving a file
+const reloadDelay = 100 * time.Millisecond
+
+// Change describes a successfully applied reload
+type Change struct {
+	Old *Config
+	New *Config
+
+	// Keys lists every key whose value changed
+	Keys []string
+
+	// RestartRequired lists the changed keys that only take effect after a restart
+	RestartRequired []string
+}
+
+// Watcher keeps a config in sync with its file and notifies subscribers of changes.
+// Edits that fail to load or validate are logged and leave the current config untouched.
+type Watcher struct {
+	opts []Option
+
+	mu      sync.RWMutex
+	current *Config
+	subs    []subscription
+
+	fsw  *fsnotify.Watcher
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type subscription struct {
+	section string
+	fn      func(c Change)
+}
+
+// Watch starts watching the file cfg was loaded from. opts should match the options
+// cfg was loaded with so that env and flag overrides survive a reload.
+func Watch(cfg *Config, opts ...Option) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating config watcher : %w", err)
+	}
+
+	// watch the directories since editors often replace files rather than write them
+	for _, dir := range watchDirs(cfg) {
+		if err := fsw.Add(dir); err != nil {
+			_ = fsw.Close()
+			return nil, fmt.Errorf("error watching config directory %v : %w", dir, err)
+		}
+	}
+
+	w := &Watcher{
+		opts:    opts,
+		current: cfg,
+		fsw:     fsw,
+		done:    make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+
+	return w, nil
+}
+
+// Current returns the most recent valid config
+func (w *Watcher) Current() *Config {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.current
+}
+
+// Close stops watching the config file
+func (w *Watcher) Close() error {
+	close(w.done)
+	err := w.fsw.Close()
+	w.wg.Wait()
+	return err
+}
+
+// Subscribe calls fn after every reload that changes a key of section.
+// An empty section subscribes to every change.
+func (w *Watcher) Subscribe(section string, fn func(c Change)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs = append(w.subs, subscription{section: section, fn: fn})
+}
+
+// OnLogger calls fn with the old and new [logger] section whenever it changes
+func (w *Watcher) OnLogger(fn func(old, new LoggerConfig)) {
+	w.Subscribe("logger", func(c Change) { fn(c.Old.Logger, c.New.Logger) })
+}
+
+// OnServer calls fn with the old and new [server] section whenever it changes
+func (w *Watcher) OnServer(fn func(old, new ServerConfig)) {
+	w.Subscribe("server", func(c Change) { fn(c.Old.Server, c.New.Server) })
+}
+
+// OnOwner calls fn with the old and new [owner] section whenever it changes
+func (w *Watcher) OnOwner(fn func(old, new OwnerConfig)) {
+	w.Subscribe("owner", func(c Change) { fn(c.Old.Owner, c.New.Owner) })
+}
+
+// OnDatabase calls fn with the old and new [database] section whenever it changes
+func (w *Watcher) OnDatabase(fn func(old, new DatabaseConfig)) {
+	w.Subscribe("database", func(c Change) { fn(c.Old.Database, c.New.Database) })
+}
+
+// OnModules calls fn with the old and new [modules] section whenever it changes
+func (w *Watcher) OnModules(fn func(old, new ModulesConfig)) {
+	w.Subscribe("modules", func(c Change) { fn(c.Old.Modules, c.New.Modules) })
+}
+
+// Reload loads and validates the config file again. On success the new config
+// replaces the current one and subscribers of the changed sections are notified.
+// On failure the current config is kept and the error is returned.
+func (w *Watcher) Reload() (*Change, error) {
+	old := w.Current()
+
+	// never write a default config over a file that is briefly missing mid-save
+	opts := append(append([]Option(nil), w.opts...), func(o *loadOptions) { o.writeDefault = false })
+	cfg, err := Load(old.File(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// pick up directories of files that were newly included
+	for _, dir := range watchDirs(cfg) {
+		if err := w.fsw.Add(dir); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("error watching config directory")
+		}
+	}
+
+	change := &Change{Old: old, New: cfg, Keys: changedKeys(old, cfg)}
+	for _, key := range change.Keys {
+		if requiresRestart(key) {
+			change.RestartRequired = append(change.RestartRequired, key)
+		}
+	}
+
+	w.mu.Lock()
+	w.current = cfg
+	subs := append([]subscription(nil), w.subs...)
+	w.mu.Unlock()
+
+	for _, sub := range subs {
+		if sub.section == "" || sectionChanged(sub.section, old, cfg) {
+			sub.fn(*change)
+		}
+	}
+
+	return change, nil
+}
+
+func (w *Watcher) run() {
+	defer w.wg.Done()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if !isConfigFile(w.Current(), ev.Name) {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				timer = time.After(reloadDelay)
+			}
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("error watching config file")
+		case <-timer:
+			timer = nil
+			w.reloadAndLog()
+		}
+	}
+}
+
+func (w *Watcher) reloadAndLog() {
+	change, err := w.Reload()
+	if err != nil {
+		log.Error().Err(err).Msg("rejected config change, keeping current config")
+		return
+	}
+	if len(change.Keys) == 0 {
+		return
+	}
+
+	log.Info().Strs("keys", change.Keys).Str("file", change.New.File()).Msg("reloaded config")
+	if len(change.RestartRequired) > 0 {
+		log.Warn().Strs("keys", change.RestartRequired).Msg("changed config keys require a restart to take effect")
+	}
+}
+
+func sectionChanged(section string, a, b *Config) bool {
+	fa, ok := lookup(reflect.ValueOf(a).Elem(), section)
+	if !ok {
+		return false
+	}
+	fb, _ := lookup(reflect.ValueOf(b).Elem(), section)
+	return !reflect.DeepEqual(fa.Interface(), fb.Interface())
+}
+
+// watchDirs returns the directory of every file merged into cfg
+func watchDirs(cfg *Config) []string {
+	var dirs []string
+	for _, file := range cfg.Files() {
+		dir := filepath.Dir(file)
+		if !contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// isConfigFile reports whether name is one of the files merged into cfg
+func isConfigFile(cfg *Config, name string) bool {
+	for _, file := range cfg.Files() {
+		if filepath.Clean(file) == filepath.Clean(name) {
+			return true
+		}
+	}
+	return false
+}
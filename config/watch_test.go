@@ -0,0 +1,98 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const watchTestConfig = `
+[logger]
+level = "%v"
+
+[server]
+port = "%v"
+`
+
+func writeWatchTestConfig(t *testing.T, file, level, port string) {
+	t.Helper()
+	data := []byte(fmt.Sprintf(watchTestConfig, level, port))
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+}
+
+func TestWatcherReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	writeWatchTestConfig(t, file, "debug", "8080")
+
+	cfg, err := Load(file)
+	require.NoError(t, err)
+
+	w, err := Watch(cfg)
+	require.NoError(t, err)
+	defer w.Close()
+
+	levels := make(chan [2]string, 1)
+	w.OnLogger(func(old, new LoggerConfig) {
+		levels <- [2]string{old.Level, new.Level}
+	})
+
+	// invalid edits are rejected and the current config is kept
+	writeWatchTestConfig(t, file, "loud", "8080")
+	_, err = w.Reload()
+	require.ErrorIs(t, err, ErrInvalidConfig)
+	require.Equal(t, "debug", w.Current().Logger.Level)
+
+	// valid edits are picked up from the file system
+	writeWatchTestConfig(t, file, "info", "9090")
+	select {
+	case got := <-levels:
+		require.Equal(t, [2]string{"debug", "info"}, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for config reload")
+	}
+	require.Equal(t, "9090", w.Current().Server.Port)
+
+	// nothing changed, so no restart is required
+	change, err := w.Reload()
+	require.NoError(t, err)
+	require.Empty(t, change.Keys)
+
+	restarts := make(chan []string, 1)
+	w.Subscribe("", func(c Change) {
+		restarts <- c.RestartRequired
+	})
+	writeWatchTestConfig(t, file, "info", "7070")
+	select {
+	case got := <-restarts:
+		require.Equal(t, []string{"server.port"}, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for config reload")
+	}
+}
+
+func TestChangedModuleKeys(t *testing.T) {
+	t.Parallel()
+
+	a, b := Default(), Default()
+	a.Modules = ModulesConfig{"chat": {Enabled: true, Settings: map[string]interface{}{"flood": map[string]interface{}{"rate": 5}}}}
+	b.Modules = ModulesConfig{
+		"chat": {Enabled: true, Prefix: "/talk", Settings: map[string]interface{}{"flood": map[string]interface{}{"rate": 1}}},
+		"shop": {Enabled: true},
+	}
+
+	keys := changedKeys(a, b)
+	require.Equal(t, []string{"modules.chat.prefix", "modules.chat", "modules.shop.enabled"}, keys)
+
+	// module settings reload, but mounting a module does not
+	var restart []string
+	for _, key := range keys {
+		if requiresRestart(key) {
+			restart = append(restart, key)
+		}
+	}
+	require.Equal(t, []string{"modules.chat.prefix", "modules.shop.enabled"}, restart)
+}
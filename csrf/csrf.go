@@ -0,0 +1,210 @@
+// Package csrf protects cookie authenticated requests from other sites. Form posts
+// and WebSocket upgrades must come from an allowed origin and, when tokens are
+// required, carry the CSRF token of the browser's session.
+package csrf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/session"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// HeaderName carries the token of scripted requests
+	HeaderName = "X-CSRF-Token"
+
+	// FormField carries the token of form posts
+	FormField = "csrf_token"
+
+	// QueryParam carries the token of WebSocket upgrades, which cannot set headers
+	QueryParam = "csrf"
+
+	// sessionKey is the session value holding the token
+	sessionKey = "csrf"
+
+	// tokenLength is the number of random bytes in a token
+	tokenLength = 32
+)
+
+var (
+	// ErrOrigin rejects a request from an origin that is not allowed
+	ErrOrigin = errors.New("origin is not allowed")
+
+	// ErrToken rejects a request without the CSRF token of its session
+	ErrToken = errors.New("missing or invalid CSRF token")
+
+	// errNoSession is returned by Token for a request without a session
+	errNoSession = errors.New("request has no session")
+)
+
+// Protector checks the origin and token of requests
+type Protector struct {
+	origins map[string]bool
+
+	// tokens requires the CSRF token on protected requests
+	tokens bool
+}
+
+// New returns a Protector allowing server.allowedOrigins, or the origin of
+// server.host when none are listed, and requiring tokens if server.csrf is set
+func New(cfg config.ServerConfig) *Protector {
+	p := &Protector{origins: make(map[string]bool), tokens: cfg.CSRF}
+	for _, origin := range cfg.AllowedOrigins {
+		p.origins[normalize(origin)] = true
+	}
+	if len(p.origins) == 0 {
+		scheme, port := "http", "80"
+		if cfg.Secure {
+			scheme, port = "https", "443"
+		}
+		p.origins[scheme+"://"+strings.ToLower(cfg.Host)] = true
+		if cfg.Port != "" && cfg.Port != port {
+			p.origins[scheme+"://"+strings.ToLower(cfg.Host)+":"+cfg.Port] = true
+		}
+	}
+	return p
+}
+
+// normalize returns origin as browsers send it in the Origin header
+func normalize(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(origin, "/"))
+}
+
+// Origins returns the allowed origins
+func (p *Protector) Origins() []string {
+	origins := make([]string, 0, len(p.origins))
+	for origin := range p.origins {
+		origins = append(origins, origin)
+	}
+	return origins
+}
+
+// CheckOrigin reports whether the Origin header of r is allowed. Requests without
+// one are not made by a browser on behalf of another site, so they are allowed.
+func (p *Protector) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || p.origins[normalize(origin)]
+}
+
+// Check returns ErrOrigin or ErrToken if r must be rejected. Requests with an
+// Authorization header do not rely on cookies, and pages of other sites cannot send
+// one without a CORS preflight, so they need no token.
+func (p *Protector) Check(r *http.Request) error {
+	if !p.CheckOrigin(r) {
+		return ErrOrigin
+	}
+	if !p.tokens || r.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	s := session.FromContext(r.Context())
+	want := ""
+	if s != nil {
+		want = s.Get(sessionKey)
+	}
+	if want == "" || subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(want)) != 1 {
+		return ErrToken
+	}
+	return nil
+}
+
+// requestToken returns the token sent with r
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get(HeaderName); token != "" {
+		return token
+	}
+	if isUpgrade(r) {
+		return r.URL.Query().Get(QueryParam)
+	}
+	return r.PostFormValue(FormField)
+}
+
+// isUpgrade reports whether r asks for a WebSocket connection
+func isUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// protected reports whether r can change state and so must be checked
+func protected(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return isUpgrade(r)
+	default:
+		return true
+	}
+}
+
+// Middleware rejects protected requests that fail Check with 403 Forbidden, and
+// puts p into the context of every request, see FromContext. It must be behind
+// session.Manager.Middleware when tokens are required.
+func (p *Protector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if protected(r) {
+			if err := p.Check(r); err != nil {
+				log.Warn().Err(err).
+					Str("method", r.Method).
+					Str("path", r.URL.Path).
+					Str("origin", r.Header.Get("Origin")).
+					Str("remote", r.RemoteAddr).
+					Msg("rejected cross-site request")
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, p)))
+	})
+}
+
+// Token returns the CSRF token of the session of r, starting one if needed
+func Token(r *http.Request) (string, error) {
+	s := session.FromContext(r.Context())
+	if s == nil {
+		return "", errNoSession
+	}
+	if token := s.Get(sessionKey); token != "" {
+		return token, nil
+	}
+
+	b := make([]byte, tokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	s.Set(sessionKey, token)
+	return token, nil
+}
+
+// TokenHandler writes the CSRF token of the browser's session as JSON
+func TokenHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := Token(r)
+		if err != nil {
+			log.Error().Err(err).Msg("error issuing CSRF token")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(map[string]string{"token": token}); err != nil {
+			log.Error().Err(err).Msg("error writing CSRF token")
+		}
+	}
+}
+
+type contextKey struct{}
+
+// FromContext returns the Protector of a request served by its Middleware, or nil
+func FromContext(ctx context.Context) *Protector {
+	p, _ := ctx.Value(contextKey{}).(*Protector)
+	return p
+}
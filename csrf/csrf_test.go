@@ -0,0 +1,110 @@
+package csrf
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/session"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrigins(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.Default().Server
+	cfg.Host = "Example.com"
+	cfg.Port = "8080"
+	origins := New(cfg).Origins()
+	sort.Strings(origins)
+	require.Equal(t, []string{"http://example.com", "http://example.com:8080"}, origins)
+
+	cfg.Secure, cfg.Port = true, "443"
+	require.Equal(t, []string{"https://example.com"}, New(cfg).Origins())
+
+	cfg.AllowedOrigins = []string{"https://chat.example.com/"}
+	p := New(cfg)
+	require.Equal(t, []string{"https://chat.example.com"}, p.Origins())
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	require.True(t, p.CheckOrigin(r), "requests without an origin are not cross-site")
+	r.Header.Set("Origin", "https://CHAT.example.com")
+	require.True(t, p.CheckOrigin(r))
+	r.Header.Set("Origin", "https://example.com")
+	require.False(t, p.CheckOrigin(r))
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.Default().Server
+	cfg.AllowedOrigins = []string{"https://example.com"}
+	cfg.CSRF = true
+	p := New(cfg)
+
+	sessionCfg := config.Default().Session
+	sessionCfg.Secret = "0123456789abcdef0123456789abcdef"
+	sessions, err := session.New(sessionCfg, false, session.NewMemoryStore())
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/csrf", TokenHandler())
+	mux.HandleFunc("/post", func(w http.ResponseWriter, r *http.Request) {
+		require.NotNil(t, FromContext(r.Context()))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(sessions.Middleware(p.Middleware(mux)))
+	t.Cleanup(srv.Close)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+	post := func(origin, header string, form url.Values, auth ...string) int {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/post", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if header != "" {
+			req.Header.Set(HeaderName, header)
+		}
+		for _, a := range auth {
+			req.Header.Set("Authorization", a)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusForbidden, post("", "", nil), "no token yet")
+	require.Equal(t, http.StatusNoContent, post("", "", nil, "Bearer api"), "not authenticated by cookies")
+	require.Equal(t, http.StatusForbidden, post("https://evil.example", "", nil, "Bearer api"))
+
+	resp, err := client.Get(srv.URL + "/csrf")
+	require.NoError(t, err)
+	var body struct{ Token string }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	resp.Body.Close()
+	require.NotEmpty(t, body.Token)
+
+	require.Equal(t, http.StatusNoContent, post("", body.Token, nil))
+	require.Equal(t, http.StatusNoContent, post("https://example.com", "", url.Values{FormField: {body.Token}}))
+	require.Equal(t, http.StatusForbidden, post("https://evil.example", body.Token, nil))
+	require.Equal(t, http.StatusForbidden, post("", "forged", nil))
+
+	// the token is kept by the session
+	resp, err = client.Get(srv.URL + "/csrf")
+	require.NoError(t, err)
+	var again struct{ Token string }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&again))
+	resp.Body.Close()
+	require.Equal(t, body.Token, again.Token)
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// CacheMaxAge is the Cache-Control max-age, in seconds, sent with static resources.
+// It can be changed while the server is running.
+type CacheMaxAge struct {
+	seconds int64
+}
+
+// NewCacheMaxAge returns a CacheMaxAge set to seconds
+func NewCacheMaxAge(seconds int) *CacheMaxAge {
+	return &CacheMaxAge{seconds: int64(seconds)}
+}
+
+// Set changes the max-age sent with every following response
+func (c *CacheMaxAge) Set(seconds int) {
+	atomic.StoreInt64(&c.seconds, int64(seconds))
+}
+
+// Header returns the value of the Cache-Control header
+func (c *CacheMaxAge) Header() string {
+	return "max-age=" + strconv.FormatInt(atomic.LoadInt64(&c.seconds), 10)
+}
@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 
 	"github.com/rs/zerolog/log"
 
@@ -12,7 +11,7 @@ import (
 )
 
 // ChatHomeHandler is the route for the chat home where users can get assigned unique identifiers
-func ChatHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ChatHomeHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		// this page currently only serves html resources
@@ -29,7 +28,7 @@ func ChatHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				}
 
 				w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 			}()
 
@@ -39,18 +38,3 @@ func ChatHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 		}
 	}
 }
-
-// ChatSignUpHandler connects to the database and creates a new id for a chat user
-func ChatSignUpHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
-
-	return func(w http.ResponseWriter, r *http.Request) {
-
-	}
-}
-
-// ChatSignInHandler connects to the database and signs a user in if they are in the database
-func ChatSignInHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-
-	}
-}
@@ -31,7 +31,7 @@ func initCryptoAddr() {
 }
 
 // DonateHandler handles an incoming donation request and serves back a page or the crypto address as JSON
-func DonateHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func DonateHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			currency := filepath.Base(r.URL.Path)
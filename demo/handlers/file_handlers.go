@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 
 	"github.com/rs/zerolog/log"
 
@@ -23,7 +22,7 @@ const (
 )
 
 // ScriptsHandler takes a script name and
-func ScriptsHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ScriptsHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -44,7 +43,7 @@ func ScriptsHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 					w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 				}
 
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -56,7 +55,7 @@ func ScriptsHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 }
 
 // CSSHandler takes a script name and
-func CSSHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func CSSHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 
@@ -73,7 +72,7 @@ func CSSHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				}
 
 				w.Header().Set("Content-Type", "text/css; charset=UTF-8")
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -85,7 +84,7 @@ func CSSHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 }
 
 // HTMLHandler takes a script name and
-func HTMLHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func HTMLHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -101,7 +100,7 @@ func HTMLHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				}
 
 				w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -113,7 +112,7 @@ func HTMLHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 }
 
 // TypeScriptHandler takes a script name and returns a HandleFunc
-func TypeScriptHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func TypeScriptHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -129,7 +128,7 @@ func TypeScriptHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request)
 				}
 
 				w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -141,7 +140,7 @@ func TypeScriptHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request)
 }
 
 // ManifestHandler serves manifest.json
-func ManifestHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ManifestHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -157,7 +156,7 @@ func ManifestHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				}
 
 				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -169,7 +168,7 @@ func ManifestHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 }
 
 // ServiceWorkerHandler serves serviceWorker.js
-func ServiceWorkerHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ServiceWorkerHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -189,7 +188,7 @@ func ServiceWorkerHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Reque
 				case ".js.map":
 					w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 				}
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -201,7 +200,7 @@ func ServiceWorkerHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Reque
 }
 
 // ImageHandler returns a HandleFunc to serve image files
-func ImageHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ImageHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -227,7 +226,7 @@ func ImageHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				case ".ico":
 					w.Header().Set("Content-Type", "image/x-icon")
 				}
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -239,7 +238,7 @@ func ImageHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 }
 
 // ModelHandler returns a HandleFunc to serve model files
-func ModelHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ModelHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -263,7 +262,7 @@ func ModelHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				case ".gltf":
 					w.Header().Set("Content-Type", "model/gltf")
 				}
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -275,7 +274,7 @@ func ModelHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 }
 
 // MiscFileHandler serves file requests
-func MiscFileHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func MiscFileHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
 			filename := filepath.Base(r.URL.Path)
@@ -294,7 +293,7 @@ func MiscFileHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				if filepath.Ext(wantFile) == ".pdf" {
 					w.Header().Set("Content-Type", "application/pdf")
 				}
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 
 			} else {
@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 
 	"github.com/rs/zerolog/log"
 
@@ -29,7 +28,7 @@ func RedirectConstructionHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func ConstructionHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ConstructionHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet && r != nil {
 			log.Debug().Str("Handler", "ConstructionHandler").Msg("incoming request")
@@ -43,7 +42,7 @@ func ConstructionHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Reques
 				}
 
 				w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 			}()
 		} else {
@@ -54,7 +53,7 @@ func ConstructionHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Reques
 }
 
 // HomeHandler serves the home.html file
-func HomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func HomeHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		if r.Method == http.MethodGet && r != nil {
@@ -69,7 +68,7 @@ func HomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 				}
 
 				w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-				w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+				w.Header().Set("Cache-Control", cacheMaxAge.Header())
 				http.ServeFile(w, r, wantFile)
 			}()
 
@@ -81,7 +80,7 @@ func HomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
 }
 
 // ResumeHomeHandler takes a script name and
-func ResumeHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func ResumeHomeHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
@@ -99,7 +98,7 @@ func ResumeHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request)
 					}
 
 					w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-					w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+					w.Header().Set("Cache-Control", cacheMaxAge.Header())
 					http.ServeFile(w, r, wantFile)
 				}()
 
@@ -112,7 +111,7 @@ func ResumeHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request)
 }
 
 // TunesHomeHandler takes a script name and
-func TunesHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func TunesHomeHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
@@ -130,7 +129,7 @@ func TunesHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request)
 					}
 
 					w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-					w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+					w.Header().Set("Cache-Control", cacheMaxAge.Header())
 					http.ServeFile(w, r, wantFile)
 				}()
 
@@ -143,7 +142,7 @@ func TunesHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request)
 }
 
 // HallofArtHomeHandler takes a script name and
-func HallofArtHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Request) {
+func HallofArtHomeHandler(cacheMaxAge *CacheMaxAge) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r != nil {
@@ -161,7 +160,7 @@ func HallofArtHomeHandler(cacheMaxAge int) func(http.ResponseWriter, *http.Reque
 					}
 
 					w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-					w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(int64(cacheMaxAge), 10))
+					w.Header().Set("Cache-Control", cacheMaxAge.Header())
 					http.ServeFile(w, r, wantFile)
 				}()
 
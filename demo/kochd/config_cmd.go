@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/util/file_util"
+)
+
+const configUsage = `usage: kochd config <command> [flags]
+
+commands:
+  init               write a commented default config (-c path, format from the extension)
+  validate [file]    fully validate a config, exiting non-zero on any error
+  print              print the effective config after env and flag overrides (secrets are redacted)
+  schema             print a JSON Schema of the config file for editor tooling
+`
+
+// runConfigCmd runs a "kochd config" subcommand and returns the process exit code
+func runConfigCmd(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(out, configUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "init":
+		return configInit(args[1:], out)
+	case "validate":
+		return configValidate(args[1:], out)
+	case "print":
+		return configPrint(args[1:], out)
+	case "schema":
+		return configSchema(out)
+	default:
+		fmt.Fprintf(out, "unknown config command %q\n\n%v", args[0], configUsage)
+		return 2
+	}
+}
+
+func configInit(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("config init", flag.ContinueOnError)
+	fs.SetOutput(out)
+	path := fs.String("c", file_util.ConfigFile, "Path to the config file or directory to create (TOML, JSON or YAML)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	file, err := config.Init(*path)
+	if err != nil {
+		fmt.Fprintf(out, "error writing config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "wrote %v\n", file)
+	return 0
+}
+
+func configValidate(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	profile := fs.String("profile", os.Getenv("KOCH_PROFILE"), "Config profile to layer over the base config")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	path := file_util.ConfigFile
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	cfg, err := config.Load(path, config.WithProfile(*profile))
+	if err == nil {
+		// module settings are decoded by the modules themselves
+		err = newRegistry().Configure(cfg.Modules)
+	}
+	if err != nil {
+		var verr *config.ValidationError
+		if errors.As(err, &verr) {
+			fmt.Fprintf(out, "%v is invalid:\n", path)
+			for _, fe := range verr.Errors {
+				fmt.Fprintf(out, "  %v\n", fe)
+			}
+		} else {
+			fmt.Fprintf(out, "error loading config: %v\n", err)
+		}
+		return 1
+	}
+
+	fmt.Fprintf(out, "%v is valid\n", strings.Join(cfg.Files(), ", "))
+	return 0
+}
+
+func configPrint(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	fs.SetOutput(out)
+	path := fs.String("c", file_util.ConfigFile, "Path to the config file or directory (TOML, JSON or YAML)")
+	profile := fs.String("profile", os.Getenv("KOCH_PROFILE"), "Config profile to layer over the base config")
+	effective := fs.Bool("effective", false, "show the source of each value")
+	config.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*path, config.WithProfile(*profile), config.WithFlags(fs))
+	if err != nil {
+		fmt.Fprintf(out, "error loading config: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(out, "# loaded from %v\n", strings.Join(cfg.Files(), ", "))
+	if cfg.Profile() != "" {
+		fmt.Fprintf(out, "# profile %v\n", cfg.Profile())
+	}
+	for _, s := range cfg.Effective() {
+		if *effective {
+			fmt.Fprintf(out, "%-22v = %-12v # %v\n", s.Key, printValue(s.Value), s.Source)
+		} else {
+			fmt.Fprintf(out, "%v = %v\n", s.Key, printValue(s.Value))
+		}
+	}
+	return 0
+}
+
+// printValue formats a setting the way the config file spells it, so durations
+// read as "168h0m0s" rather than nanoseconds
+func printValue(v interface{}) string {
+	if s, ok := v.(fmt.Stringer); ok {
+		return strconv.Quote(s.String())
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+func configSchema(out io.Writer) int {
+	b, err := config.JSONSchema()
+	if err != nil {
+		fmt.Fprintf(out, "error generating schema: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "%s\n", b)
+	return 0
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/aljo242/koch"
+	"github.com/aljo242/koch/admin"
 	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/csrf"
 	"github.com/aljo242/koch/demo/handlers"
 	"github.com/aljo242/koch/server"
+	"github.com/aljo242/koch/session"
+	"github.com/aljo242/koch/storage"
 	"github.com/aljo242/koch/template"
 	"github.com/aljo242/koch/util/file_util"
 	"github.com/aljo242/koch/util/ip_util"
@@ -19,22 +27,38 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-var configFile string
+var (
+	configFile    string
+	configProfile string
+)
 
 func init() {
-	flag.StringVar(&configFile, "c", file_util.ConfigFile, "Full path to JSON configuration file")
+	flag.StringVar(&configFile, "c", file_util.ConfigFile, "Path to the config file or directory (TOML, JSON or YAML)")
+	flag.StringVar(&configProfile, "profile", os.Getenv("KOCH_PROFILE"), "Config profile to layer over the base config, e.g. prod for config.prod.toml")
+	config.RegisterFlags(flag.CommandLine)
 
 }
 
-func setupLogger(level string) {
-	if level == "debug" {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-		log.Debug().Msg("log level is DEBUG")
-	} else {
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-		log.Error().Msg("log level is ERROR")
+// newRegistry registers every module kochd can mount
+func newRegistry() *koch.Registry {
+	reg := koch.NewRegistry()
+	for _, m := range []koch.Module{
+		chat.NewModule(),
+	} {
+		if err := reg.Register(m); err != nil {
+			log.Fatal().Err(err).Msg("error registering module")
+		}
+	}
+	return reg
+}
 
+func setupLogger(level string) {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil || lvl == zerolog.NoLevel {
+		lvl = zerolog.ErrorLevel
 	}
+	zerolog.SetGlobalLevel(lvl)
+	log.WithLevel(lvl).Msgf("log level is %v", strings.ToUpper(lvl.String()))
 }
 
 // SetupTemplates builds the template output directory, executes HTML templates,
@@ -165,50 +189,100 @@ func SetupTemplates(secure bool, hostName string) ([]string, error) {
 	return files, nil
 }
 
-func initServer() *server.Server {
-	err := config.New(configFile)
+// initServer builds the server from the config and returns it with a function that
+// stops the modules and closes the store once the server has shut down
+func initServer() (*server.Server, func()) {
+	cfgOpts := []config.Option{config.WithProfile(configProfile), config.WithFlags(flag.CommandLine)}
+	cfg, err := config.Load(configFile, cfgOpts...)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Fatal().Err(err).Msgf("no config found, create one with: kochd config init -c %v", configFile)
+		return nil, nil
+	}
 	if err != nil {
 		log.Fatal().Err(err).Msg("error loading config")
-		return nil
+		return nil, nil
 	}
 
-	setupLogger(config.LogLevel())
+	setupLogger(cfg.Logger.Level)
+	log.Info().Strs("files", cfg.Files()).Str("profile", cfg.Profile()).Msg("loaded config")
 
-	var hostIP string
-	if config.ServerChooseIP() {
+	// apply config edits that are safe to change at runtime
+	watcher, err := config.Watch(cfg, cfgOpts...)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error watching config")
+		return nil, nil
+	}
+	watcher.OnLogger(func(_, new config.LoggerConfig) {
+		setupLogger(new.Level)
+	})
+
+	hostIP := cfg.Server.IP
+	if cfg.Server.ChooseIP {
 
 		h, err := ip_util.HostInfo()
 		if err != nil {
 			log.Fatal().Err(err).Msg("error creating Host Struct")
-			return nil
+			return nil, nil
 		}
 
 		hostIP, err = ip_util.SelectHost(h.InternalIPs)
 		if err != nil {
 			log.Fatal().Err(err).Msg("error chosing host IP")
-			return nil
+			return nil, nil
 		}
-	} else {
-		hostIP = config.ServerIP()
+		cfg.Server.IP = hostIP
 	}
 
-	_, err = SetupTemplates(config.ServerSecure(), config.ServerHost())
+	_, err = SetupTemplates(cfg.Server.Secure, cfg.Server.Host)
 	if err != nil {
 		log.Fatal().Err(err).Msg("error setting up templates")
-		return nil
+		return nil, nil
+	}
+
+	modules := newRegistry()
+	if err := modules.Configure(cfg.Modules); err != nil {
+		log.Fatal().Err(err).Msg("error configuring modules")
+		return nil, nil
+	}
+
+	store, err := storage.Open(cfg.Database)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error opening database")
+		return nil, nil
+	}
+	log.Info().Str("driver", cfg.Database.Driver).Str("path", cfg.Database.Path).Msg("opened database")
+	modules.SetStore(store)
+
+	sessions, err := session.New(cfg.Session, cfg.Server.Secure, session.NewStore(cfg.Session, store))
+	if err != nil {
+		log.Fatal().Err(err).Msg("error setting up sessions")
+		return nil, nil
 	}
+	modules.SetSessions(sessions)
 
-	hub := chat.NewHub()
-	go hub.Run()
+	// admin routes of modules take the bearer token of server.adminToken, which can
+	// be rotated without a restart
+	adminGuard := admin.New(cfg.Server.AdminToken)
+	watcher.OnServer(func(_, new config.ServerConfig) {
+		adminGuard.Set(new.AdminToken)
+	})
+	modules.SetAdmin(adminGuard.Middleware)
 
-	addr := hostIP + ":" + config.ServerPort()
+	addr := hostIP + ":" + cfg.Server.Port
 
 	// generate/execute resource templates
 
 	// create new gorilla mux router
 	r := mux.NewRouter()
+	protector := csrf.New(cfg.Server)
+	log.Info().Strs("origins", protector.Origins()).Bool("tokens", cfg.Server.CSRF).Msg("rejecting cross-site requests")
+	r.Use(sessions.Middleware, protector.Middleware)
+	r.HandleFunc("/csrf", csrf.TokenHandler()).Methods("GET")
 	// attach pather with handler
-	cacheMaxAge := config.ServerCacheMaxAge()
+	cacheMaxAge := handlers.NewCacheMaxAge(cfg.Server.CacheMaxAge)
+	watcher.OnServer(func(_, new config.ServerConfig) {
+		cacheMaxAge.Set(new.CacheMaxAge)
+	})
 	r.HandleFunc("/home", handlers.HomeHandler(cacheMaxAge))
 	r.HandleFunc("/", handlers.RedirectHome())
 	r.HandleFunc("/static/js/{scriptname}", handlers.ScriptsHandler(cacheMaxAge))
@@ -224,10 +298,8 @@ func initServer() *server.Server {
 	r.HandleFunc("/shop/home", handlers.RedirectConstructionHandler())
 	// r.HandleFunc("/chat/{name}", handlers.ChatHomeHandler("", cfg.DebugLog))
 	// CHAT HANDLERs
+	// sign up, sign in and the WebSocket are served by the chat module
 	r.HandleFunc("/chat/home", handlers.ChatHomeHandler(cacheMaxAge))
-	r.HandleFunc("/chat/ws", chat.ServeWs(hub))
-	r.HandleFunc("/chat/signup", handlers.RedirectConstructionHandler())
-	r.HandleFunc("/chat/signin", handlers.RedirectConstructionHandler())
 	// file handler
 	r.HandleFunc("/files/{filename}", handlers.MiscFileHandler(cacheMaxAge))
 
@@ -243,29 +315,53 @@ func initServer() *server.Server {
 	// DONATE PAGES
 	r.HandleFunc("/donate/{cryptoname}", handlers.DonateHandler(cacheMaxAge))
 
+	// MODULES, mounted after the site routes so those take precedence
+	r.HandleFunc("/healthz", modules.HealthHandler())
+	if err := modules.Mount(r); err != nil {
+		log.Fatal().Err(err).Msg("error mounting modules")
+		return nil, nil
+	}
+	if err := modules.Start(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("error starting modules")
+		return nil, nil
+	}
+	// modules apply the settings they can change while running, such as chat flood limits
+	watcher.OnModules(func(old, new config.ModulesConfig) {
+		if err := modules.Reload(old, new); err != nil {
+			log.Error().Err(err).Msg("error reloading module settings")
+		}
+	})
+
 	fmt.Printf("\n")
 	log.Printf("starting Server at: %v...", addr)
-	srv, err := server.NewServer(config.ServerSecure(),
-		config.ServerIP(),
-		config.ServerPort(),
-		config.ServerCertFile(),
-		config.ServerKeyFile(),
-		config.ServerRootCA(),
-		config.ServerHost(),
-		config.ServerShutdownCode(),
-		config.ServerCmdEnable(), r)
+	srv, err := server.NewServer(cfg, r)
 
 	if err != nil {
 		panic(err)
 	}
 
-	return srv
+	// modules close the connections they hijacked, such as chat WebSockets, once
+	// the server stops taking requests
+	srv.OnShutdown(modules.Stop)
+
+	shutdown := func() {
+		if err := store.Close(); err != nil {
+			log.Error().Err(err).Msg("error closing database")
+		}
+	}
+
+	return srv, shutdown
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCmd(os.Args[2:], os.Stdout))
+	}
+
 	flag.Parse()
 	log.Printf("main: starting HTTP server...")
-	srv := initServer()
+	srv, shutdown := initServer()
 	running := make(chan struct{})
 	srv.Run(running)
+	shutdown()
 }
@@ -1,5 +1,7 @@
-const DEFAULT_NAME : string = "anon";
 const DEFAULT_DECODING : string = "utf-8";
+const CHAT_PROTOCOL : string = "koch.chat.v1";
+const PROTOCOL_VERSION : number = 1;
+const RECONNECT_DELAY : number = 1000;
 
 // TODO MAKE CheckHTTPS() func
 const currentURL = window.location.href;
@@ -40,6 +42,45 @@ if (!("WebSocket" in window)) {
     alert("Sorry, this browser does not support WebSockets!");
 }
 
+// ChatMessage is the JSON envelope of the chat protocol; the server assigns
+// the id, sender and timestamp of every message it accepts
+interface ChatMessage {
+    version: number;
+    type: "message" | "direct" | "join" | "leave" | "error" | "ack" | "presence" | "history" | "resume" | "announcement" | "report" | "reply";
+    id?: string;
+    sender?: string;
+    senderId?: string;
+    room?: string;
+    to?: string;
+    body?: string;
+    timestamp?: string;
+    metadata?: { [key: string]: string };
+    users?: UserInfo[];
+    cursor?: string;
+    limit?: number;
+    history?: ChatMessage[];
+    seq?: number;
+    token?: string;
+    html?: string;
+}
+
+// UserInfo describes a member of a room in a presence snapshot
+interface UserInfo {
+    id: string;
+    name: string;
+    status: "online" | "away" | "offline";
+    guest?: boolean;
+    moderator?: boolean;
+}
+
+let nextMessageID = 0;
+
+// newMessage builds an envelope with a client id that acks and errors refer to
+function newMessage(type: ChatMessage["type"], fields: Partial<ChatMessage> = {}): ChatMessage {
+    nextMessageID++;
+    return { version: PROTOCOL_VERSION, type: type, id: `c${nextMessageID}`, ...fields };
+}
+
 class User {
     userName: string;
     conn: WebSocket;
@@ -53,19 +94,19 @@ class User {
         this.signIn();
     }
 
+    // signIn asks for a nickname; without one the server keeps the generated guest name
     signIn() {
-        const signInMessage = encode(`<b>${this.userName} signed in.</b>`);
-        this.broadcast(signInMessage);
+        if (this.userName != "") {
+            this.send(newMessage("join", { sender: this.userName }));
+        }
     }
 
-    broadcast(buf: ArrayBuffer) {
-        this.conn.send(buf);
+    broadcast(body: string) {
+        this.send(newMessage("message", { body: body }));
     }
 
-    p2pSend(msg: string, target: string) {
-        console.log(`Sending message to ${target}`);
-        console.log(msg);
-        this.conn.send(msg);
+    send(msg: ChatMessage) {
+        this.conn.send(JSON.stringify(msg));
     }
 }
 
@@ -111,6 +152,122 @@ function closePopUpForm() {
 //    }
 //}
 
+// ALLOWED_TAGS are the elements the server renders message bodies with
+const ALLOWED_TAGS = new Set(["A", "BR", "CODE", "DEL", "EM", "STRONG"]);
+
+// renderBody returns the HTML the server rendered for the body of msg, or the body
+// as text. The HTML is sanitized again so a faulty server cannot inject markup.
+function renderBody(msg: ChatMessage): Node {
+    if (!msg.html) {
+        return document.createTextNode(msg.body ?? "");
+    }
+    // template content is inert: nothing in it loads or runs
+    const template = document.createElement("template");
+    template.innerHTML = msg.html;
+    sanitize(template.content);
+    return template.content;
+}
+
+// sanitize keeps the allowed elements under node, turning others into their text,
+// and only the attributes of safe links
+function sanitize(node: Node) {
+    for (const child of Array.from(node.childNodes)) {
+        if (child.nodeType == Node.TEXT_NODE) {
+            continue;
+        }
+        if (!(child instanceof Element)) {
+            node.removeChild(child);
+            continue;
+        }
+        if (!ALLOWED_TAGS.has(child.tagName)) {
+            node.replaceChild(document.createTextNode(child.textContent ?? ""), child);
+            continue;
+        }
+        for (const attr of Array.from(child.attributes)) {
+            const safe = child.tagName == "A" &&
+                ((attr.name == "href" && /^(https?:|mailto:)/i.test(attr.value)) || attr.name == "rel" || attr.name == "target");
+            if (!safe) {
+                child.removeAttribute(attr.name);
+            }
+        }
+        sanitize(child);
+    }
+}
+
+// renderMessage turns an envelope into a log entry, or null for messages that are not shown.
+// Names are set as text and bodies as sanitized HTML so they can never inject markup.
+function renderMessage(msg: ChatMessage): HTMLDivElement | null {
+    let item = document.createElement("div");
+    switch (msg.type) {
+        case "message":
+            // actions sent with /me read as "* alice waves"
+            const action = msg.metadata?.action == "true";
+            let sender = document.createElement("b");
+            sender.textContent = action ? `* ${msg.sender} ` : `${msg.sender}: `;
+            item.appendChild(sender);
+            item.appendChild(renderBody(msg));
+            item.style.whiteSpace = "pre-wrap";
+            return item;
+        case "direct":
+            let from = document.createElement("i");
+            from.textContent = `${msg.sender} (private): `;
+            item.appendChild(from);
+            item.appendChild(renderBody(msg));
+            item.style.whiteSpace = "pre-wrap";
+            return item;
+        case "join":
+            item.textContent = `${msg.sender} signed in.`;
+            item.style.fontWeight = "bold";
+            return item;
+        case "leave":
+            item.textContent = `${msg.sender} left.`;
+            item.style.fontWeight = "bold";
+            return item;
+        case "presence":
+            if (msg.users !== undefined) {
+                item.textContent = "online: " + msg.users.map((u) => u.status == "away" ? `${u.name} (away)` : u.name).join(", ");
+            } else {
+                item.textContent = `${msg.sender} is ${msg.body}.`;
+            }
+            item.style.fontStyle = "italic";
+            return item;
+        case "announcement":
+            item.textContent = "announcement: ";
+            item.appendChild(renderBody(msg));
+            item.style.fontWeight = "bold";
+            item.style.color = "darkorange";
+            return item;
+        case "report":
+            // only moderators get reports, with the reported message in history
+            const reported = msg.history?.[0];
+            item.textContent = `report from ${msg.sender ?? "filter"}: ${reported?.sender}: ${reported?.body}` + (msg.body ? ` (${msg.body})` : "");
+            item.style.color = "purple";
+            return item;
+        case "reply":
+            // the answer to one of our commands, which nobody else sees
+            item.textContent = msg.body ?? "";
+            item.style.whiteSpace = "pre-wrap";
+            item.style.color = "gray";
+            return item;
+        case "error":
+            item.textContent = `error: ${msg.body}`;
+            item.style.color = "red";
+            return item;
+        default:
+            return null;
+    }
+}
+
+// csrfToken fetches the token the server wants with form posts and WebSocket upgrades
+function csrfToken(): Promise<string> {
+    return fetch("/csrf").then((resp) => {
+        if (!resp.ok) {
+            throw new Error(`error fetching CSRF token: ${resp.status}`);
+        }
+        return resp.json();
+    }).then((body) => body.token as string);
+}
+
 function appendLog(item : HTMLDivElement) {
     let log = document.getElementById("log")!;
     const doScroll = log.scrollTop > log.scrollHeight - log.clientHeight - 1;
@@ -126,27 +283,66 @@ window.onload = () => {
     let user: User;
     let msg = document.getElementById("msg")! as HTMLInputElement;
 
-    if (window["WebSocket"]) {
-        conn = new WebSocket(websocketPrefix + document.location.host + "/chat/ws");
+    // a dropped connection is resumed with the token of the last one and the last
+    // message seen in each room, so no messages are lost in between
+    let resumeToken = "";
+    let lastSeq = new Map<string, number>();
+
+    let connect = () => {
+        csrfToken().then((token) => {
+            let params = new URLSearchParams({ csrf: token });
+            if (resumeToken != "") {
+                params.set("resume", resumeToken);
+                params.set("since", Array.from(lastSeq, ([room, seq]) => `${room}:${seq}`).join(","));
+            }
+            openSocket(websocketPrefix + document.location.host + "/chat/ws?" + params.toString());
+        }).catch((err: Error) => {
+            console.log(err);
+            setTimeout(connect, RECONNECT_DELAY);
+        });
+    };
+
+    let openSocket = (url: string) => {
+        conn = new WebSocket(url, CHAT_PROTOCOL);
         conn.binaryType = "arraybuffer";
-        conn.onclose = () => {
-            let item = document.createElement("div");
-            item.innerHTML = "<b>Connection to server closed.</b>";
-            appendLog(item);
-            console.log("closing WS...")
-        };
+        if (user) {
+            user.conn = conn;
+        }
         conn.onmessage = (evt) => {
-            //console.log(evt);
-            let buf = evt.data as ArrayBuffer;
-            //let message : string[] = decode(evt.data).split("\n");
-            let item = document.createElement("div");
-            item.innerHTML = `${buf}`;
-            appendLog(item);
+            // every frame holds exactly one envelope
+            let data = typeof evt.data === "string" ? evt.data : decode(evt.data as ArrayBuffer);
+            let msg = JSON.parse(data) as ChatMessage;
+            if (msg.type == "resume") {
+                resumeToken = msg.token ?? "";
+                return;
+            }
+            // a history page holds the messages sent before we joined, oldest first
+            for (const m of msg.type == "history" ? msg.history ?? [] : [msg]) {
+                const seen = lastSeq.get(m.room ?? "");
+                if (m.room && m.seq !== undefined && (seen === undefined || m.seq > seen)) {
+                    lastSeq.set(m.room, m.seq);
+                }
+                let item = renderMessage(m);
+                if (item != null) {
+                    appendLog(item);
+                }
+            }
         };
         conn.onclose = (evt) => {
             console.log(evt);
+            let item = document.createElement("div");
+            item.innerHTML = "<b>Connection to server closed, reconnecting...</b>";
+            // the server gives a reason when it closes a slow or flooding connection
+            if (evt.reason) {
+                item.querySelector("b")!.textContent = `Connection to server closed (${evt.reason}), reconnecting...`;
+            }
+            appendLog(item);
+            setTimeout(connect, RECONNECT_DELAY);
         };
+    };
 
+    if (window["WebSocket"]) {
+        connect();
     } else {
         let item = document.createElement("div");
         item.innerHTML = "<b>Your browser does not support WebSockets.</b>";
@@ -155,19 +351,44 @@ window.onload = () => {
     }
 
     let signInButton = document.getElementById("signInButton")!;
-    
-    let signIn = () => {
-        let userName = document.getElementById("chatname") as HTMLInputElement;
-        if (userName.value == "") {
-            console.error("USER INPUT ERROR");
-            userName.value = DEFAULT_NAME
+    let signUpButton = document.getElementById("signUpButton")!;
+    let guestButton = document.getElementById("guestButton")!;
 
-        }
+    // guests pick a nickname for this connection only
+    let chatAsGuest = () => {
+        let userName = document.getElementById("chatname") as HTMLInputElement;
         console.log(`user submitted to login form as: ${userName.value}`);
         user = new User(userName.value, conn);
         closePopUpForm(); 
     };
-    signInButton.onclick = signIn;
+    guestButton.onclick = chatAsGuest;
+
+    // signing in or up sets the session cookie, which the chat uses after reconnecting
+    let authenticate = (path: string) => {
+        let userName = document.getElementById("chatname") as HTMLInputElement;
+        let password = document.getElementById("chatpassword") as HTMLInputElement;
+        csrfToken().then((token) => fetch(`/chat/${path}`, {
+            method: "POST",
+            headers: { "X-CSRF-Token": token },
+            body: new URLSearchParams({ name: userName.value, password: password.value }),
+        })).then((resp) => {
+            if (!resp.ok) {
+                return resp.text().then((text) => { throw new Error(text); });
+            }
+            password.value = "";
+            user = new User("", conn);
+            closePopUpForm();
+            resumeToken = "";
+            conn.close();
+        }).catch((err: Error) => {
+            let item = document.createElement("div");
+            item.textContent = `error: ${err.message}`;
+            item.style.color = "red";
+            appendLog(item);
+        });
+    };
+    signInButton.onclick = () => authenticate("signin");
+    signUpButton.onclick = () => authenticate("signup");
 
     //let formKeyCallback = (ev: KeyboardEvent) => {
     //    if (loginPopUpOpen) {
@@ -192,8 +413,8 @@ window.onload = () => {
             return false;
         }
 
-        const messageWithName = encode(`${user.userName}: ${msg.value}`);
-        user.broadcast(messageWithName);
+        // the server runs commands such as "/msg name text", see "/help"
+        user.broadcast(msg.value);
 
         msg.value = "";
         return false;
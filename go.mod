@@ -10,15 +10,19 @@ require (
 	github.com/stretchr/testify v1.7.0
 )
 
-require github.com/spf13/viper v1.10.1
+require (
+	github.com/fsnotify/fsnotify v1.5.1
+	github.com/mitchellh/mapstructure v1.4.3
+	github.com/spf13/viper v1.10.1
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/kr/pretty v0.2.0 // indirect
 	github.com/magiconair/properties v1.8.5 // indirect
-	github.com/mitchellh/mapstructure v1.4.3 // indirect
 	github.com/pelletier/go-toml v1.9.4 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/afero v1.6.0 // indirect
@@ -0,0 +1,74 @@
+// Package koch holds the pieces shared by every koch site, such as the
+// Module interface implemented by the x/ packages.
+package koch
+
+import (
+	"context"
+
+	"github.com/aljo242/koch/session"
+	"github.com/aljo242/koch/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// Module is a self-contained feature, such as x/chat, that kochd mounts when its
+// [modules.<name>] config section is enabled
+type Module interface {
+	// Name is the key of the module's config section
+	Name() string
+
+	// Config returns a pointer to the module's settings, which are decoded from the
+	// remaining keys of its config section before Routes is called, or nil if the
+	// module has no settings. If the settings have a Validate() error method it is
+	// called after decoding.
+	Config() interface{}
+
+	// Routes registers the module's handlers on r, which serves the module's prefix
+	Routes(r *mux.Router)
+
+	// Start starts the module's background work. It is called once before the server starts.
+	Start(ctx context.Context) error
+
+	// Stop releases everything Start acquired, giving up when ctx is done
+	Stop(ctx context.Context) error
+
+	// Health returns nil while the module is able to serve requests
+	Health(ctx context.Context) error
+}
+
+// StatefulModule is a Module that keeps its state in the shared store configured
+// by the [database] section. The registry hands it the store before Start.
+type StatefulModule interface {
+	Module
+
+	UseStore(s storage.Store)
+}
+
+// SessionModule is a Module that uses the browser sessions configured by the
+// [session] section. The registry hands it the session manager before Start, if
+// one was set; its routes then see the session of each request in the context.
+type SessionModule interface {
+	Module
+
+	UseSessions(m *session.Manager)
+}
+
+// ReloadableModule is a Module that applies changes to its settings while it runs.
+// When its config section changes, the registry decodes the section into the
+// value returned by NewConfig, validates it like Config, and hands it to Reload.
+// Settings that cannot change at runtime are the module's to ignore and log.
+type ReloadableModule interface {
+	Module
+
+	NewConfig() interface{}
+	Reload(cfg interface{}) error
+}
+
+// AdminModule is a Module with administrative endpoints. The registry mounts them
+// under /admin/<prefix> behind the middleware given to SetAdmin, and not at all
+// without one.
+type AdminModule interface {
+	Module
+
+	AdminRoutes(r *mux.Router)
+}
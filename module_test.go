@@ -0,0 +1,267 @@
+package koch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/session"
+	"github.com/aljo242/koch/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type testSettings struct {
+	Greeting string        `mapstructure:"greeting"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+}
+
+func (s *testSettings) Validate() error {
+	if s.Greeting == "bad" {
+		return &config.ValidationError{Errors: []config.FieldError{{Key: "greeting", Msg: "must not be bad"}}}
+	}
+	return nil
+}
+
+type testModule struct {
+	name     string
+	settings testSettings
+	startErr error
+	health   error
+	events   *[]string
+}
+
+func (m *testModule) Name() string        { return m.name }
+func (m *testModule) Config() interface{} { return &m.settings }
+
+func (m *testModule) Routes(r *mux.Router) {
+	r.HandleFunc("/hello", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(m.settings.Greeting))
+	})
+}
+
+func (m *testModule) Start(context.Context) error {
+	*m.events = append(*m.events, "start "+m.name)
+	return m.startErr
+}
+
+func (m *testModule) Stop(context.Context) error {
+	*m.events = append(*m.events, "stop "+m.name)
+	return nil
+}
+
+func (m *testModule) Health(context.Context) error { return m.health }
+
+func TestRegistryConfigure(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	reg := NewRegistry()
+	a := &testModule{name: "a", events: &events}
+	require.NoError(t, reg.Register(a))
+	require.NoError(t, reg.Register(&testModule{name: "b", events: &events}))
+	require.ErrorIs(t, reg.Register(&testModule{name: "a"}), ErrDuplicateModule)
+
+	// unknown modules and keys, bad values and failed validation are reported together
+	err := reg.Configure(config.ModulesConfig{
+		"a":       {Enabled: true, Settings: map[string]interface{}{"greeting": "bad", "nope": 1}},
+		"b":       {Settings: map[string]interface{}{"timeout": "soon"}},
+		"missing": {Enabled: true},
+	})
+	var verr *config.ValidationError
+	require.ErrorAs(t, err, &verr)
+	var keys []string
+	for _, fe := range verr.Errors {
+		keys = append(keys, fe.Key)
+	}
+	require.Equal(t, []string{"modules.missing", "modules.a.nope", "modules.b"}, keys)
+
+	err = reg.Configure(config.ModulesConfig{
+		"a": {Enabled: true, Prefix: "/greet", Settings: map[string]interface{}{"greeting": "hi", "timeout": "2s"}},
+		"b": {Enabled: false},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, a.settings.Timeout)
+	require.Len(t, reg.Enabled(), 1)
+
+	r := mux.NewRouter()
+	require.NoError(t, reg.Mount(r))
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/greet/hello", nil))
+	require.Equal(t, "hi", rec.Body.String())
+}
+
+func TestRegistryStartStop(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	reg := NewRegistry()
+	require.ErrorIs(t, reg.Start(context.Background()), ErrNotConfigured)
+
+	require.NoError(t, reg.Register(&testModule{name: "a", events: &events}))
+	require.NoError(t, reg.Register(&testModule{name: "b", events: &events}))
+	require.NoError(t, reg.Register(&testModule{name: "c", events: &events, startErr: errors.New("boom")}))
+	all := config.ModulesConfig{"a": {Enabled: true}, "b": {Enabled: true}, "c": {Enabled: true}}
+	require.NoError(t, reg.Configure(all))
+
+	// a failed start stops the modules started before it
+	require.Error(t, reg.Start(context.Background()))
+	require.Equal(t, []string{"start a", "start b", "start c", "stop b", "stop a"}, events)
+
+	events = events[:0]
+	require.NoError(t, reg.Configure(config.ModulesConfig{"a": {Enabled: true}, "b": {Enabled: true}}))
+	require.NoError(t, reg.Start(context.Background()))
+	require.NoError(t, reg.Stop(context.Background()))
+	require.Equal(t, []string{"start a", "start b", "stop b", "stop a"}, events)
+}
+
+type statefulModule struct {
+	testModule
+	store    storage.Store
+	sessions *session.Manager
+}
+
+func (m *statefulModule) UseStore(s storage.Store) { m.store = s }
+
+func (m *statefulModule) UseSessions(s *session.Manager) { m.sessions = s }
+
+type reloadableModule struct {
+	testModule
+	reloaded []testSettings
+}
+
+func (m *reloadableModule) NewConfig() interface{} { return &testSettings{Greeting: "hi"} }
+
+func (m *reloadableModule) Reload(cfg interface{}) error {
+	m.reloaded = append(m.reloaded, *cfg.(*testSettings))
+	return nil
+}
+
+func TestRegistryReload(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	reg := NewRegistry()
+	a := &reloadableModule{testModule: testModule{name: "a", events: &events}}
+	require.NoError(t, reg.Register(a))
+	require.NoError(t, reg.Register(&testModule{name: "b", events: &events}))
+	old := config.ModulesConfig{"a": {Enabled: true, Settings: map[string]interface{}{"greeting": "hello"}}, "b": {Enabled: true}}
+	require.NoError(t, reg.Configure(old))
+	require.NoError(t, reg.Start(context.Background()))
+
+	// unchanged sections are left alone
+	require.NoError(t, reg.Reload(old, old))
+	require.Empty(t, a.reloaded)
+
+	// invalid settings are reported and not applied
+	bad := config.ModulesConfig{"a": {Enabled: true, Settings: map[string]interface{}{"greeting": "bad"}}, "b": {Enabled: true}}
+	var verr *config.ValidationError
+	require.ErrorAs(t, reg.Reload(old, bad), &verr)
+	require.Equal(t, "modules.a.greeting", verr.Errors[0].Key)
+	require.Empty(t, a.reloaded)
+
+	// removed keys fall back to their defaults
+	changed := config.ModulesConfig{"a": {Enabled: true, Settings: map[string]interface{}{"timeout": "1s"}}, "b": {Enabled: true}}
+	require.NoError(t, reg.Reload(old, changed))
+	require.Equal(t, []testSettings{{Greeting: "hi", Timeout: time.Second}}, a.reloaded)
+}
+
+func TestRegistryStore(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	reg := NewRegistry()
+	m := &statefulModule{testModule: testModule{name: "notes", events: &events}}
+	require.NoError(t, reg.Register(m))
+	require.NoError(t, reg.Configure(config.ModulesConfig{"notes": {Enabled: true}}))
+	require.ErrorIs(t, reg.Start(context.Background()), ErrNoStore)
+
+	store := storage.NewMemory()
+	reg.SetStore(store)
+	sessions, err := session.New(config.Default().Session, false, session.NewMemoryStore())
+	require.NoError(t, err)
+	reg.SetSessions(sessions)
+	require.NoError(t, reg.Start(context.Background()))
+	require.Same(t, store, m.store)
+	require.Same(t, sessions, m.sessions)
+}
+
+type adminModule struct {
+	testModule
+}
+
+func (m *adminModule) AdminRoutes(r *mux.Router) {
+	r.HandleFunc("/secret", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("admin " + m.name))
+	})
+}
+
+func TestRegistryAdminRoutes(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	serve := func(reg *Registry, auth string) *httptest.ResponseRecorder {
+		r := mux.NewRouter()
+		require.NoError(t, reg.Mount(r))
+		req := httptest.NewRequest(http.MethodGet, "/admin/ops/secret", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	reg := NewRegistry()
+	require.NoError(t, reg.Register(&adminModule{testModule{name: "ops", events: &events}}))
+	require.NoError(t, reg.Configure(config.ModulesConfig{"ops": {Enabled: true}}))
+	require.Equal(t, http.StatusNotFound, serve(reg, "Bearer x").Code, "not mounted without a guard")
+
+	reg.SetAdmin(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	require.Equal(t, http.StatusUnauthorized, serve(reg, "").Code)
+	require.Equal(t, "admin ops", serve(reg, "Bearer x").Body.String())
+}
+
+func TestRegistryHealthHandler(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	reg := NewRegistry()
+	sick := &testModule{name: "sick", events: &events}
+	require.NoError(t, reg.Register(&testModule{name: "ok", events: &events}))
+	require.NoError(t, reg.Register(sick))
+	require.NoError(t, reg.Configure(config.ModulesConfig{"ok": {Enabled: true}, "sick": {Enabled: true}}))
+
+	check := func() (int, map[string]string) {
+		rec := httptest.NewRecorder()
+		reg.HealthHandler()(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var body struct {
+			Modules map[string]string `json:"modules"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return rec.Code, body.Modules
+	}
+
+	code, modules := check()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, map[string]string{"ok": "ok", "sick": "ok"}, modules)
+
+	sick.health = errors.New("database unreachable")
+	code, modules = check()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "database unreachable", modules["sick"])
+}
@@ -0,0 +1,384 @@
+package koch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/session"
+	"github.com/aljo242/koch/storage"
+
+	"github.com/gorilla/mux"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
+)
+
+// healthTimeout bounds the health checks of a single HealthHandler request
+const healthTimeout = 5 * time.Second
+
+var (
+	// ErrDuplicateModule is returned when two modules with the same name are registered
+	ErrDuplicateModule = errors.New("module already registered")
+
+	// ErrNotConfigured is returned when a Registry is used before Configure
+	ErrNotConfigured = errors.New("modules not configured")
+
+	// ErrNoStore is returned by Start when a StatefulModule is enabled but no store was set
+	ErrNoStore = errors.New("module requires storage but no store was set")
+)
+
+// Registry holds every module known to kochd and runs the ones enabled in the config
+type Registry struct {
+	mu      sync.Mutex
+	modules map[string]Module
+	order   []string
+
+	// enabled lists the modules enabled by Configure, in registration order
+	enabled    []Module
+	prefixes   map[string]string
+	configured bool
+
+	// started lists the modules started by Start, in start order
+	started []Module
+
+	// store is handed to every StatefulModule
+	store storage.Store
+
+	// sessions is handed to every SessionModule
+	sessions *session.Manager
+
+	// admin guards the routes of every AdminModule
+	admin mux.MiddlewareFunc
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		modules:  make(map[string]Module),
+		prefixes: make(map[string]string),
+	}
+}
+
+// Register adds m to the registry. Modules are mounted and started in registration order.
+func (reg *Registry) Register(m Module) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	name := m.Name()
+	if _, ok := reg.modules[name]; ok {
+		return fmt.Errorf("%w : %v", ErrDuplicateModule, name)
+	}
+	reg.modules[name] = m
+	reg.order = append(reg.order, name)
+	return nil
+}
+
+// Get returns the registered module called name
+func (reg *Registry) Get(name string) (Module, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	m, ok := reg.modules[name]
+	return m, ok
+}
+
+// Enabled returns the modules enabled by Configure, in registration order
+func (reg *Registry) Enabled() []Module {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	return append([]Module(nil), reg.enabled...)
+}
+
+// Configure decodes the settings of every module section in cfg and selects the
+// enabled modules. Sections of unknown modules and invalid settings are reported
+// together as a *config.ValidationError.
+func (reg *Registry) Configure(cfg config.ModulesConfig) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	verr := &config.ValidationError{}
+	var unknown []string
+	for name := range cfg {
+		if _, ok := reg.modules[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		verr.Errors = append(verr.Errors, config.FieldError{Key: "modules." + name, Msg: "unknown module"})
+	}
+
+	var enabled []Module
+	prefixes := make(map[string]string)
+	for _, name := range reg.order {
+		mc, ok := cfg[name]
+		if !ok {
+			continue
+		}
+		m := reg.modules[name]
+		verr.Errors = append(verr.Errors, decodeSettings(name, mc.Settings, m.Config())...)
+
+		if !mc.Enabled {
+			continue
+		}
+		prefix := mc.Prefix
+		if prefix == "" {
+			prefix = "/" + name
+		}
+		enabled = append(enabled, m)
+		prefixes[name] = prefix
+	}
+
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	reg.enabled, reg.prefixes, reg.configured = enabled, prefixes, true
+	return nil
+}
+
+// decodeSettings strictly decodes the module specific keys of a module section into dst
+func decodeSettings(name string, settings map[string]interface{}, dst interface{}) []config.FieldError {
+	section := "modules." + name
+	if dst == nil {
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var errs []config.FieldError
+		for _, key := range keys {
+			errs = append(errs, config.FieldError{Key: section + "." + key, Msg: "unknown key"})
+		}
+		return errs
+	}
+
+	var md mapstructure.Metadata
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           dst,
+		Metadata:         &md,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return []config.FieldError{{Key: section, Msg: err.Error()}}
+	}
+
+	var errs []config.FieldError
+	if err := decoder.Decode(settings); err != nil {
+		var merr *mapstructure.Error
+		if errors.As(err, &merr) {
+			for _, msg := range merr.Errors {
+				errs = append(errs, config.FieldError{Key: section, Msg: msg})
+			}
+		} else {
+			errs = append(errs, config.FieldError{Key: section, Msg: err.Error()})
+		}
+	}
+	sort.Strings(md.Unused)
+	for _, key := range md.Unused {
+		errs = append(errs, config.FieldError{Key: section + "." + key, Msg: "unknown key"})
+	}
+
+	if v, ok := dst.(interface{ Validate() error }); ok && len(errs) == 0 {
+		if err := v.Validate(); err != nil {
+			var verr *config.ValidationError
+			if errors.As(err, &verr) {
+				for _, fe := range verr.Errors {
+					errs = append(errs, config.FieldError{Key: section + "." + fe.Key, Msg: fe.Msg})
+				}
+			} else {
+				errs = append(errs, config.FieldError{Key: section, Msg: err.Error()})
+			}
+		}
+	}
+	return errs
+}
+
+// SetStore sets the store handed to stateful modules when they start
+func (reg *Registry) SetStore(s storage.Store) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.store = s
+}
+
+// SetSessions sets the session manager handed to session modules when they start
+func (reg *Registry) SetSessions(m *session.Manager) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.sessions = m
+}
+
+// SetAdmin sets the middleware that authenticates the admin routes of modules
+func (reg *Registry) SetAdmin(mw mux.MiddlewareFunc) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	reg.admin = mw
+}
+
+// Mount registers the routes of every enabled module under its prefix on r, and the
+// admin routes of admin modules under /admin/<prefix> if SetAdmin was called
+func (reg *Registry) Mount(r *mux.Router) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if !reg.configured {
+		return ErrNotConfigured
+	}
+	for _, m := range reg.enabled {
+		prefix := reg.prefixes[m.Name()]
+		log.Debug().Str("module", m.Name()).Str("prefix", prefix).Msg("mounting module")
+		m.Routes(r.PathPrefix(prefix).Subrouter())
+
+		if am, ok := m.(AdminModule); ok && reg.admin != nil {
+			ar := r.PathPrefix("/admin" + prefix).Subrouter()
+			ar.Use(reg.admin)
+			am.AdminRoutes(ar)
+		}
+	}
+	return nil
+}
+
+// Start starts every enabled module in registration order. If a module fails to
+// start, the modules already started are stopped again.
+func (reg *Registry) Start(ctx context.Context) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if !reg.configured {
+		return ErrNotConfigured
+	}
+	for _, m := range reg.enabled {
+		if sm, ok := m.(StatefulModule); ok {
+			if reg.store == nil {
+				reg.stopStarted(ctx)
+				return fmt.Errorf("error starting module %v : %w", m.Name(), ErrNoStore)
+			}
+			sm.UseStore(reg.store)
+		}
+		if sm, ok := m.(SessionModule); ok && reg.sessions != nil {
+			sm.UseSessions(reg.sessions)
+		}
+		if err := m.Start(ctx); err != nil {
+			reg.stopStarted(ctx)
+			return fmt.Errorf("error starting module %v : %w", m.Name(), err)
+		}
+		log.Info().Str("module", m.Name()).Msg("started module")
+		reg.started = append(reg.started, m)
+	}
+	return nil
+}
+
+// Reload hands the settings of every started ReloadableModule whose section differs
+// between old and cfg to the module. Invalid settings are reported together as a
+// *config.ValidationError and leave the module running with its current settings.
+func (reg *Registry) Reload(old, cfg config.ModulesConfig) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	verr := &config.ValidationError{}
+	var first error
+	for _, m := range reg.started {
+		rm, ok := m.(ReloadableModule)
+		name := m.Name()
+		if !ok || reflect.DeepEqual(old[name].Settings, cfg[name].Settings) {
+			continue
+		}
+
+		settings := rm.NewConfig()
+		if errs := decodeSettings(name, cfg[name].Settings, settings); len(errs) > 0 {
+			verr.Errors = append(verr.Errors, errs...)
+			continue
+		}
+		if err := rm.Reload(settings); err != nil {
+			if first == nil {
+				first = fmt.Errorf("error reloading module %v : %w", name, err)
+			}
+			continue
+		}
+		log.Info().Str("module", name).Msg("reloaded module settings")
+	}
+
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return first
+}
+
+// Stop stops every started module in reverse start order and returns the first error
+func (reg *Registry) Stop(ctx context.Context) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	return reg.stopStarted(ctx)
+}
+
+func (reg *Registry) stopStarted(ctx context.Context) error {
+	var first error
+	for i := len(reg.started) - 1; i >= 0; i-- {
+		m := reg.started[i]
+		if err := m.Stop(ctx); err != nil {
+			log.Error().Err(err).Str("module", m.Name()).Msg("error stopping module")
+			if first == nil {
+				first = fmt.Errorf("error stopping module %v : %w", m.Name(), err)
+			}
+			continue
+		}
+		log.Info().Str("module", m.Name()).Msg("stopped module")
+	}
+	reg.started = nil
+	return first
+}
+
+// Health runs the health check of every enabled module, keyed by module name
+func (reg *Registry) Health(ctx context.Context) map[string]error {
+	health := make(map[string]error)
+	for _, m := range reg.Enabled() {
+		health[m.Name()] = m.Health(ctx)
+	}
+	return health
+}
+
+// HealthHandler reports the health of every enabled module as JSON, responding
+// 503 Service Unavailable if any module is unhealthy
+func (reg *Registry) HealthHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+
+		status := http.StatusOK
+		modules := make(map[string]string)
+		for name, err := range reg.Health(ctx) {
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				modules[name] = err.Error()
+				continue
+			}
+			modules[name] = "ok"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  http.StatusText(status),
+			"modules": modules,
+		}); err != nil {
+			log.Error().Err(err).Msg("error writing health response")
+		}
+	}
+}
@@ -4,15 +4,19 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
+	"github.com/aljo242/koch/config"
+
 	"github.com/gorilla/mux"
 
 	"github.com/rs/zerolog/log"
@@ -30,18 +34,25 @@ type Server struct {
 	wg           *sync.WaitGroup
 	quit         chan struct{}
 	isRunning    bool
+
+	// onShutdown runs after the server stops accepting requests, see OnShutdown
+	onShutdown []func(ctx context.Context) error
 }
 
+// shutdownTimeout bounds how long active requests, and then the shutdown hooks,
+// may take once the server is asked to shut down
+const shutdownTimeout = 15 * time.Second
+
 func serverShutdownCallback() {
 	fmt.Printf("\n")
 	log.Printf("shutting down server...")
 }
 
-func newTLSConfig(certFile, keyFile, rootCA string) (*tls.Config, error) {
+func newTLSConfig(certFile, keyFile, rootCA, keyPassphrase string) (*tls.Config, error) {
 
-	cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+	cer, err := loadX509KeyPair(certFile, keyFile, keyPassphrase)
 	if err != nil {
-		return &tls.Config{MinVersion: tls.VersionTLS12}, os.ErrNotExist
+		return &tls.Config{MinVersion: tls.VersionTLS12}, err
 	}
 
 	rootCAPool := x509.NewCertPool()
@@ -69,19 +80,53 @@ func newTLSConfig(certFile, keyFile, rootCA string) (*tls.Config, error) {
 	}, nil
 }
 
-// NewServer ...
-func NewServer(secure bool, ip string, port string, certFile string, keyFile string, rootCA string,
-	hostname string, shutdownCode int, cmdEnable bool, r *mux.Router) (*Server, error) {
+// loadX509KeyPair loads a certificate and its PEM key, decrypting the key with
+// passphrase if one is given
+func loadX509KeyPair(certFile, keyFile, passphrase string) (tls.Certificate, error) {
+	if passphrase == "" {
+		cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return tls.Certificate{}, os.ErrNotExist
+		}
+		return cer, nil
+	}
+
+	certPEM, err := ioutil.ReadFile(filepath.Clean(certFile))
+	if err != nil {
+		return tls.Certificate{}, os.ErrNotExist
+	}
+	keyPEM, err := ioutil.ReadFile(filepath.Clean(keyFile))
+	if err != nil {
+		return tls.Certificate{}, os.ErrNotExist
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return tls.Certificate{}, fmt.Errorf("no PEM data found in key file %v", keyFile)
+	}
+	//nolint:staticcheck // legacy PEM encryption is what openssl -des3/-aes256 produce
+	der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error decrypting key file %v : %w", keyFile, err)
+	}
+
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// NewServer creates a Server from the [server] section of cfg that serves r
+func NewServer(cfg *config.Config, r *mux.Router) (*Server, error) {
 	var err error
+	sc := cfg.Server
 	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
 	// check if IP is valid
-	if net.ParseIP(ip) == nil && ip != "localhost" {
+	if net.ParseIP(sc.IP) == nil && sc.IP != "localhost" {
 		return nil, ErrInvalidIP
 	}
-	addr := ip + ":" + port
+	addr := sc.IP + ":" + sc.Port
 
-	if secure {
-		tlsCfg, err = newTLSConfig(certFile, keyFile, rootCA)
+	if sc.Secure {
+		tlsCfg, err = newTLSConfig(sc.CertFile, sc.KeyFile, sc.RootCA, sc.KeyPassphrase.Value())
 		if err != nil {
 			// log.Fatal().Err(err).Msg("error getting TLS config")
 			return nil, err
@@ -100,15 +145,16 @@ func NewServer(secure bool, ip string, port string, certFile string, keyFile str
 			MaxHeaderBytes:    1 << 20,
 			TLSConfig:         tlsCfg,
 		},
-		secure,
-		ip,
-		port,
-		hostname,
-		shutdownCode,
-		cmdEnable,
+		sc.Secure,
+		sc.IP,
+		sc.Port,
+		sc.Host,
+		sc.ShutdownCode,
+		sc.CmdEnable,
 		&sync.WaitGroup{},
 		quit,
 		false,
+		nil,
 	}
 
 	srv.RegisterOnShutdown(serverShutdownCallback)
@@ -116,6 +162,14 @@ func NewServer(secure bool, ip string, port string, certFile string, keyFile str
 	return srv, nil
 }
 
+// OnShutdown registers fn to be called when the server shuts down, after it stops
+// accepting requests and the active ones finish. Hooks run in the order they were
+// registered, before Run returns. Connections hijacked from the server, such as
+// WebSockets, are not closed by it and should be closed by a hook.
+func (srv *Server) OnShutdown(fn func(ctx context.Context) error) {
+	srv.onShutdown = append(srv.onShutdown, fn)
+}
+
 // Quit sends closes the server quit channel if the server is running
 // signaling the server to begin shutting down
 // if the server is not running, Quit will return an error
@@ -129,6 +183,17 @@ func (srv *Server) Quit() error {
 	return errors.New("server not running; cannot shutdown")
 }
 
+// runShutdownHooks calls the OnShutdown hooks, each within shutdownTimeout
+func (srv *Server) runShutdownHooks() {
+	for _, fn := range srv.onShutdown {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := fn(ctx); err != nil {
+			log.Error().Err(err).Msg("error in server shutdown hook")
+		}
+		cancel()
+	}
+}
+
 // Run starts the running loop of the server and will fire a message to
 // running once running has "fully begun"
 func (srv *Server) Run(running chan struct{}) {
@@ -190,9 +255,12 @@ func (srv *Server) Run(running chan struct{}) {
 
 	// wait on a quit
 	<-srv.quit
-	if err := srv.Shutdown(context.Background()); err != nil {
-		panic(err)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("error shutting down server")
 	}
+	srv.runShutdownHooks()
 
 	// wait for goroutine to stop
 	srv.wg.Wait()
@@ -1,10 +1,17 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -63,7 +70,7 @@ func TestMain(m *testing.M) {
 
 	fmt.Println(os.Getwd())
 
-	err := config.New(sampleConfigFile)
+	cfg, err := config.Load(sampleConfigFile)
 	if err != nil {
 		panic(err)
 	}
@@ -74,15 +81,7 @@ func TestMain(m *testing.M) {
 	r.HandleFunc("/invalid", invalidHandler)
 	r.HandleFunc("/pushAttempt", pushAttemptHandler)
 
-	srv, err := NewServer(config.ServerSecure(),
-		config.ServerIP(),
-		config.ServerPort(),
-		config.ServerCertFile(),
-		config.ServerKeyFile(),
-		config.ServerRootCA(),
-		config.ServerHost(),
-		config.ServerShutdownCode(),
-		config.ServerCmdEnable(), r)
+	srv, err := NewServer(cfg, r)
 
 	if err != nil {
 		panic(err)
@@ -118,11 +117,11 @@ func TestMain(m *testing.M) {
 
 func TestTLSConfig(t *testing.T) {
 	// test loading default config with no TLS
-	err := config.New(sampleConfigFile)
+	cfg, err := config.Load(sampleConfigFile)
 	require.NoError(t, err)
 
 	// will throw error since no key pair is not present in config
-	_, err = newTLSConfig(config.ServerCertFile(), config.ServerKeyFile(), config.ServerRootCA())
+	_, err = newTLSConfig(cfg.Server.CertFile, cfg.Server.KeyFile, cfg.Server.RootCA, "")
 	if err != os.ErrNotExist { // should be returned if no PEM files found in getTLSConfig
 		t.Error(err)
 	}
@@ -141,7 +140,7 @@ func TestTLSConfig(t *testing.T) {
 	_, err = tls.LoadX509KeyPair(sampleCert, sampleKey)
 	require.NoError(t, err)
 
-	_, err = newTLSConfig(sampleCert, sampleKey, sampleRoot)
+	_, err = newTLSConfig(sampleCert, sampleKey, sampleRoot, "")
 	require.NoError(t, err)
 
 	// test loading default config with TLS but no root CA specified
@@ -183,3 +182,53 @@ func TestPushAttemptRequest(t *testing.T) {
 
 	assert.Equal(t, wantStatus, r.Status)
 }
+
+func TestTLSConfigKeyPassphrase(t *testing.T) {
+	keyPEM, err := ioutil.ReadFile(sampleKey)
+	require.NoError(t, err)
+	block, _ := pem.Decode(keyPEM)
+	require.NotNil(t, block)
+
+	//nolint:staticcheck // mirrors keys encrypted with openssl
+	encrypted, err := x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte("hunter2"), x509.PEMCipherAES256)
+	require.NoError(t, err)
+
+	encryptedKey := filepath.Join(t.TempDir(), "localhost.key")
+	require.NoError(t, ioutil.WriteFile(encryptedKey, pem.EncodeToMemory(encrypted), 0600))
+
+	_, err = newTLSConfig(sampleCert, encryptedKey, sampleRoot, "hunter2")
+	require.NoError(t, err)
+
+	_, err = newTLSConfig(sampleCert, encryptedKey, sampleRoot, "wrong")
+	require.Error(t, err)
+}
+
+func TestOnShutdown(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.IP, cfg.Server.Port, cfg.Server.CmdEnable = "127.0.0.1", "0", false
+	srv, err := NewServer(cfg, mux.NewRouter())
+	require.NoError(t, err)
+
+	var calls []string
+	srv.OnShutdown(func(ctx context.Context) error {
+		_, ok := ctx.Deadline()
+		require.True(t, ok, "hooks are bounded")
+		calls = append(calls, "first")
+		return errors.New("logged, not fatal")
+	})
+	srv.OnShutdown(func(context.Context) error {
+		calls = append(calls, "second")
+		return nil
+	})
+
+	running := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		srv.Run(running)
+		close(stopped)
+	}()
+	<-running
+	require.NoError(t, srv.Quit())
+	<-stopped
+	require.Equal(t, []string{"first", "second"}, calls)
+}
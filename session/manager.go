@@ -0,0 +1,350 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// pruneInterval is how often expired sessions are removed from the store
+	pruneInterval = time.Minute
+
+	// touchDivisor sets how often the last request of a session is saved, as a
+	// fraction of the idle timeout, so most requests do not write to the store
+	touchDivisor = 20
+)
+
+// errNoHijack is returned when the ResponseWriter of a request cannot be hijacked
+var errNoHijack = errors.New("response writer does not support hijacking")
+
+// Manager loads the session of every request that passes its Middleware and saves
+// the session when the response is written
+type Manager struct {
+	store  Store
+	cfg    config.SessionConfig
+	secure bool
+
+	// key signs cookies
+	key []byte
+
+	// aead encrypts cookies, nil when cookies are only signed
+	aead cipher.AEAD
+
+	now func() time.Time
+
+	mu     sync.Mutex
+	ended  []func(id string)
+	pruned time.Time
+}
+
+// New returns a Manager keeping sessions in store. Cookies are marked Secure when
+// secure is set, as in server.secure mode.
+func New(cfg config.SessionConfig, secure bool, store Store) (*Manager, error) {
+	m := &Manager{store: store, cfg: cfg, secure: secure, now: func() time.Time { return time.Now().UTC() }}
+
+	m.key = []byte(cfg.Secret.Value())
+	switch {
+	case len(m.key) == 0:
+		log.Warn().Msg("session.secret is not set, sessions end when the server restarts")
+		m.key = make([]byte, config.MinSessionSecret)
+		if _, err := rand.Read(m.key); err != nil {
+			return nil, fmt.Errorf("error generating session key : %w", err)
+		}
+	case len(m.key) < config.MinSessionSecret:
+		return nil, fmt.Errorf("session.secret must be at least %v bytes", config.MinSessionSecret)
+	}
+
+	if key := cfg.EncryptionKey.Value(); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			return nil, fmt.Errorf("error creating session cipher : %w", err)
+		}
+		if m.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("error creating session cipher : %w", err)
+		}
+	}
+	return m, nil
+}
+
+// NewStore returns the store selected by session.store, keeping sessions in db for "database"
+func NewStore(cfg config.SessionConfig, db storage.Store) Store {
+	if cfg.Store == "database" && db != nil {
+		return NewStorageStore(db)
+	}
+	return NewMemoryStore()
+}
+
+// OnEnd registers fn to be called with the id of every session that is destroyed,
+// renewed or expires
+func (m *Manager) OnEnd(fn func(id string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ended = append(m.ended, fn)
+}
+
+func (m *Manager) notifyEnded(ids ...string) {
+	m.mu.Lock()
+	fns := m.ended
+	m.mu.Unlock()
+
+	for _, id := range ids {
+		for _, fn := range fns {
+			fn(id)
+		}
+	}
+}
+
+// Middleware puts the session of each request into its context, see FromContext
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := m.load(r)
+		sw := &writer{ResponseWriter: w}
+		sw.commit = func() { m.commit(sw, r, s) }
+
+		ctx := context.WithValue(NewContext(r.Context(), s), writerKey{}, sw)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		sw.once.Do(sw.commit)
+	})
+}
+
+// UpgradeHeader commits the session of r and adds the cookies set on its response
+// to header. A WebSocket upgrade writes its own response with header rather than
+// the header of the ResponseWriter, so call it with the header passed to Upgrade.
+func UpgradeHeader(r *http.Request, header http.Header) {
+	sw, ok := r.Context().Value(writerKey{}).(*writer)
+	if !ok {
+		return
+	}
+	sw.once.Do(sw.commit)
+	for _, c := range sw.Header().Values("Set-Cookie") {
+		header.Add("Set-Cookie", c)
+	}
+}
+
+// load returns the session of the cookie of r, or a new session
+func (m *Manager) load(r *http.Request) *Session {
+	s := newSession(m.now)
+
+	c, err := r.Cookie(m.cfg.CookieName)
+	if err != nil {
+		return s
+	}
+	id, err := m.decode(c.Value)
+	if err != nil {
+		log.Debug().Err(err).Str("remote", r.RemoteAddr).Msg("ignoring session cookie")
+		s.cookie = true
+		return s
+	}
+
+	d, err := m.store.Load(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		s.cookie = true
+		return s
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("error loading session")
+		return s
+	}
+
+	now := m.now()
+	if !now.Before(m.expires(d)) {
+		if err := m.store.Delete(r.Context(), id); err != nil {
+			log.Error().Err(err).Msg("error deleting expired session")
+		}
+		m.notifyEnded(id)
+		s.cookie = true
+		return s
+	}
+
+	s.id, s.data = id, d
+	if now.Sub(d.LastSeen) >= m.cfg.IdleTimeout/touchDivisor {
+		s.data.LastSeen = now
+		s.dirty = true
+	}
+	return s
+}
+
+// expires returns when a session with data d expires
+func (m *Manager) expires(d Data) time.Time {
+	idle := d.LastSeen.Add(m.cfg.IdleTimeout)
+	if abs := d.Created.Add(m.cfg.MaxLifetime); abs.Before(idle) {
+		return abs
+	}
+	return idle
+}
+
+// commit saves s and sets its cookie on w, before the response header is written
+func (m *Manager) commit(w http.ResponseWriter, r *http.Request, s *Session) {
+	s.mu.Lock()
+	id, d, dirty, cookie, stale := s.id, s.data.copy(), s.dirty, s.cookie, s.stale
+	s.dirty, s.cookie, s.stale = false, false, nil
+	s.mu.Unlock()
+
+	ctx := r.Context()
+	for _, old := range stale {
+		if err := m.store.Delete(ctx, old); err != nil {
+			log.Error().Err(err).Msg("error deleting session")
+		}
+	}
+	m.notifyEnded(stale...)
+
+	if id != "" && dirty {
+		if err := m.store.Save(ctx, id, d, m.expires(d)); err != nil {
+			log.Error().Err(err).Msg("error saving session")
+		}
+	}
+	if cookie {
+		http.SetCookie(w, m.cookie(r, id, d))
+	}
+	m.prune(ctx)
+}
+
+// prune removes expired sessions from the store every pruneInterval
+func (m *Manager) prune(ctx context.Context) {
+	now := m.now()
+	m.mu.Lock()
+	due := now.Sub(m.pruned) >= pruneInterval
+	if due {
+		m.pruned = now
+	}
+	m.mu.Unlock()
+	if !due {
+		return
+	}
+
+	ids, err := m.store.Prune(ctx, now)
+	if err != nil {
+		log.Error().Err(err).Msg("error pruning sessions")
+		return
+	}
+	m.notifyEnded(ids...)
+}
+
+// cookie returns the cookie of session id with data d, deleting the cookie if id is empty
+func (m *Manager) cookie(r *http.Request, id string, d Data) *http.Cookie {
+	c := &http.Cookie{
+		Name:     m.cfg.CookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if id != "" {
+		c.Value = m.encode(id)
+		c.MaxAge = int(d.Created.Add(m.cfg.MaxLifetime).Sub(m.now()) / time.Second)
+	}
+	return c
+}
+
+// encode signs id, encrypting it first if an encryption key is set
+func (m *Manager) encode(id string) string {
+	payload := []byte(id)
+	if m.aead != nil {
+		nonce := make([]byte, m.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			panic(err) // crypto/rand never fails on supported platforms
+		}
+		payload = m.aead.Seal(nonce, nonce, payload, []byte(m.cfg.CookieName))
+	}
+	value := base64.RawURLEncoding.EncodeToString(payload)
+	return value + "." + base64.RawURLEncoding.EncodeToString(m.mac(value))
+}
+
+// decode returns the id of a cookie value made by encode, or ErrInvalidCookie
+func (m *Manager) decode(value string) (string, error) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", ErrInvalidCookie
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil || !hmac.Equal(sig, m.mac(value[:i])) {
+		return "", ErrInvalidCookie
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(value[:i])
+	if err != nil {
+		return "", ErrInvalidCookie
+	}
+	if m.aead != nil {
+		n := m.aead.NonceSize()
+		if len(payload) < n {
+			return "", ErrInvalidCookie
+		}
+		if payload, err = m.aead.Open(nil, payload[:n], payload[n:], []byte(m.cfg.CookieName)); err != nil {
+			return "", ErrInvalidCookie
+		}
+	}
+	return string(payload), nil
+}
+
+// mac returns the signature of a cookie value, bound to the cookie name
+func (m *Manager) mac(value string) []byte {
+	h := hmac.New(sha256.New, m.key)
+	h.Write([]byte(m.cfg.CookieName + "=" + value))
+	return h.Sum(nil)
+}
+
+// writerKey is the context key of the writer of a request, see UpgradeHeader
+type writerKey struct{}
+
+// writer commits the session before the response header is written, or before
+// the connection is hijacked. Cookies set when hijacking are lost if the hijacker
+// writes its own response, as a WebSocket upgrade does; see UpgradeHeader.
+type writer struct {
+	http.ResponseWriter
+	once   sync.Once
+	commit func()
+}
+
+func (w *writer) WriteHeader(code int) {
+	w.once.Do(w.commit)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	w.once.Do(w.commit)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *writer) Flush() {
+	w.once.Do(w.commit)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNoHijack
+	}
+	w.once.Do(w.commit)
+	return h.Hijack()
+}
+
+func (w *writer) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
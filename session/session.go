@@ -0,0 +1,171 @@
+// Package session keeps server side state for browsers. A browser only holds the
+// session id, in a cookie signed (and optionally encrypted) by the Manager; the
+// values live in a Store, so an id read from the store cannot be used as a cookie.
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// idLength is the number of random bytes in a session id
+const idLength = 32
+
+var (
+	// ErrNotFound is returned by a Store for a session it does not hold
+	ErrNotFound = errors.New("no such session")
+
+	// ErrInvalidCookie is returned for a session cookie the Manager did not issue
+	ErrInvalidCookie = errors.New("invalid session cookie")
+)
+
+// Data is what a Store keeps of a session
+type Data struct {
+	Values   map[string]string `json:"values,omitempty"`
+	Created  time.Time         `json:"created"`
+	LastSeen time.Time         `json:"lastSeen"`
+}
+
+// copy returns d with its own Values
+func (d Data) copy() Data {
+	values := make(map[string]string, len(d.Values))
+	for k, v := range d.Values {
+		values[k] = v
+	}
+	d.Values = values
+	return d
+}
+
+// Session is the session of a request, from FromContext. Changes are saved, and
+// the cookie is set, when the response is written.
+type Session struct {
+	mu   sync.Mutex
+	id   string
+	data Data
+
+	// dirty is set when data must be saved
+	dirty bool
+
+	// cookie is set when the id changed and the browser must be told
+	cookie bool
+
+	// stale lists the ids the session had before Renew or Destroy
+	stale []string
+
+	now func() time.Time
+}
+
+// newSession returns an empty session that is not saved until a value is set
+func newSession(now func() time.Time) *Session {
+	s := &Session{now: now}
+	s.reset()
+	return s
+}
+
+// reset empties the data of s
+func (s *Session) reset() {
+	t := s.now()
+	s.data = Data{Values: make(map[string]string), Created: t, LastSeen: t}
+}
+
+// newID returns a random session id
+func newID() string {
+	b := make([]byte, idLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ID returns the id of the session, empty until a value is first set
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.id
+}
+
+// Created returns when the session started, or was last renewed
+func (s *Session) Created() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.Created
+}
+
+// Get returns the value of key, or "" if it is not set
+func (s *Session) Get(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.Values[key]
+}
+
+// Set sets the value of key, starting the session if it has no id yet
+func (s *Session) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.id == "" {
+		s.id = newID()
+		s.cookie = true
+	}
+	s.data.Values[key] = value
+	s.dirty = true
+}
+
+// Delete removes the value of key
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.data.Values[key]; ok {
+		delete(s.data.Values, key)
+		s.dirty = true
+	}
+}
+
+// Renew moves the values to a new session id and restarts the absolute lifetime.
+// Call it when the privileges of a session change, such as on sign in, so an id
+// planted in the browser before cannot be used afterwards.
+func (s *Session) Renew() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.id != "" {
+		s.stale = append(s.stale, s.id)
+	}
+	s.id = newID()
+	s.data.Created, s.data.LastSeen = s.now(), s.now()
+	s.dirty, s.cookie = true, true
+}
+
+// Destroy deletes the session and its cookie. Values set afterwards start a new session.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.id != "" {
+		s.stale = append(s.stale, s.id)
+	}
+	s.id = ""
+	s.reset()
+	s.dirty, s.cookie = false, true
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying s
+func NewContext(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the session of a request served by Manager.Middleware, or nil
+func FromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(contextKey{}).(*Session)
+	return s
+}
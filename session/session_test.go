@@ -0,0 +1,256 @@
+package session
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/storage"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func testConfig() config.SessionConfig {
+	cfg := config.Default().Session
+	cfg.Secret = testSecret
+	return cfg
+}
+
+// clock is a settable time source
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestCookie(t *testing.T) {
+	t.Parallel()
+
+	cfg := testConfig()
+	m, err := New(cfg, false, NewMemoryStore())
+	require.NoError(t, err)
+	id := newID()
+
+	value := m.encode(id)
+	got, err := m.decode(value)
+	require.NoError(t, err)
+	require.Equal(t, id, got)
+
+	_, err = m.decode("x" + value)
+	require.ErrorIs(t, err, ErrInvalidCookie)
+	_, err = m.decode(id)
+	require.ErrorIs(t, err, ErrInvalidCookie)
+
+	other := cfg
+	other.Secret = config.Secret(strings.ToUpper(testSecret))
+	om, err := New(other, false, NewMemoryStore())
+	require.NoError(t, err)
+	_, err = om.decode(value)
+	require.ErrorIs(t, err, ErrInvalidCookie, "signed with another key")
+
+	// encrypted cookies do not show the id
+	cfg.EncryptionKey = "hush"
+	em, err := New(cfg, false, NewMemoryStore())
+	require.NoError(t, err)
+	value = em.encode(id)
+	require.NotContains(t, value, id)
+	got, err = em.decode(value)
+	require.NoError(t, err)
+	require.Equal(t, id, got)
+	_, err = m.decode(value[:len(value)-2])
+	require.ErrorIs(t, err, ErrInvalidCookie)
+
+	cfg.Secret = "short"
+	_, err = New(cfg, false, NewMemoryStore())
+	require.Error(t, err)
+}
+
+func TestManager(t *testing.T) {
+	t.Parallel()
+
+	cfg := testConfig()
+	cfg.IdleTimeout = time.Hour
+	cfg.MaxLifetime = 3 * time.Hour
+	m, err := New(cfg, false, NewMemoryStore())
+	require.NoError(t, err)
+	clk := &clock{t: time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)}
+	m.now = clk.now
+
+	var mu sync.Mutex
+	var ended []string
+	m.OnEnd(func(id string) {
+		mu.Lock()
+		defer mu.Unlock()
+		ended = append(ended, id)
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(FromContext(r.Context()).Get("user")))
+	})
+	mux.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Set("user", r.URL.Query().Get("user"))
+	})
+	mux.HandleFunc("/renew", func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Renew()
+	})
+	mux.HandleFunc("/destroy", func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Destroy()
+	})
+	srv := httptest.NewServer(m.Middleware(mux))
+	t.Cleanup(srv.Close)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+	get := func(path string) (string, *http.Response) {
+		resp, err := client.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b), resp
+	}
+	cookie := func(resp *http.Response) *http.Cookie {
+		for _, c := range resp.Cookies() {
+			if c.Name == cfg.CookieName {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// reading does not start a session
+	_, resp := get("/get")
+	require.Nil(t, cookie(resp))
+
+	_, resp = get("/set?user=alice")
+	c := cookie(resp)
+	require.NotNil(t, c)
+	require.True(t, c.HttpOnly)
+	require.False(t, c.Secure)
+	require.Equal(t, http.SameSiteLaxMode, c.SameSite)
+	require.Equal(t, int(cfg.MaxLifetime/time.Second), c.MaxAge)
+	id, err := m.decode(c.Value)
+	require.NoError(t, err)
+
+	body, _ := get("/get")
+	require.Equal(t, "alice", body)
+
+	// renewing moves the values to a new id and ends the old one
+	_, resp = get("/renew")
+	c = cookie(resp)
+	require.NotNil(t, c)
+	renewed, err := m.decode(c.Value)
+	require.NoError(t, err)
+	require.NotEqual(t, id, renewed)
+	_, err = m.store.Load(context.Background(), id)
+	require.ErrorIs(t, err, ErrNotFound)
+	body, _ = get("/get")
+	require.Equal(t, "alice", body)
+	require.Equal(t, []string{id}, ended)
+
+	// requests keep an active session alive until its absolute lifetime
+	for i := 0; i < 5; i++ {
+		clk.advance(50 * time.Minute)
+		body, _ = get("/get")
+		if i < 3 {
+			require.Equal(t, "alice", body, "request %v", i)
+		}
+	}
+	require.Equal(t, "", body)
+	require.Equal(t, []string{id, renewed}, ended)
+
+	// idle sessions expire
+	get("/set?user=bob")
+	clk.advance(2 * time.Hour)
+	body, resp = get("/get")
+	require.Equal(t, "", body)
+	require.Equal(t, -1, cookie(resp).MaxAge, "the expired cookie is deleted")
+
+	get("/set?user=carol")
+	_, resp = get("/destroy")
+	require.Equal(t, -1, cookie(resp).MaxAge)
+	require.Len(t, ended, 4)
+
+	// secure mode marks cookies Secure
+	sm, err := New(cfg, true, NewMemoryStore())
+	require.NoError(t, err)
+	require.True(t, sm.cookie(httptest.NewRequest("GET", "/", nil), id, Data{Created: clk.now()}).Secure)
+}
+
+func TestUpgradeHeader(t *testing.T) {
+	t.Parallel()
+
+	m, err := New(testConfig(), false, NewMemoryStore())
+	require.NoError(t, err)
+	srv := httptest.NewServer(m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Set("user", "alice")
+		header := make(http.Header)
+		UpgradeHeader(r, header)
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, header)
+		if err == nil {
+			conn.Close()
+		}
+	})))
+	t.Cleanup(srv.Close)
+
+	// the session started by the upgrade request keeps its cookie
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	cookies := resp.Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, testConfig().CookieName, cookies[0].Name)
+}
+
+func TestStores(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	for name, store := range map[string]Store{
+		"memory":  NewMemoryStore(),
+		"storage": NewStorageStore(storage.NewMemory()),
+	} {
+		d := Data{Values: map[string]string{"user": "alice"}, Created: now, LastSeen: now}
+		require.NoError(t, store.Save(ctx, "a", d, now.Add(time.Hour)), name)
+		require.NoError(t, store.Save(ctx, "b", d, now.Add(-time.Second)), name)
+
+		got, err := store.Load(ctx, "a")
+		require.NoError(t, err, name)
+		require.Equal(t, "alice", got.Values["user"], name)
+		require.True(t, now.Equal(got.Created), name)
+
+		pruned, err := store.Prune(ctx, now)
+		require.NoError(t, err, name)
+		require.Equal(t, []string{"b"}, pruned, name)
+		_, err = store.Load(ctx, "b")
+		require.ErrorIs(t, err, ErrNotFound, name)
+
+		require.NoError(t, store.Delete(ctx, "a"), name)
+		require.NoError(t, store.Delete(ctx, "a"), name)
+		_, err = store.Load(ctx, "a")
+		require.ErrorIs(t, err, ErrNotFound, name)
+	}
+}
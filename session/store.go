@@ -0,0 +1,199 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aljo242/koch/storage"
+)
+
+// sessionsBucket holds the sessions of a StorageStore keyed by id
+const sessionsBucket = "session.sessions"
+
+// Store keeps the data of sessions. The Manager decides when sessions expire; a
+// Store only has to forget them once Prune is called after their expiry.
+type Store interface {
+	// Load returns the data of session id, or ErrNotFound
+	Load(ctx context.Context, id string) (Data, error)
+
+	// Save stores the data of session id, to be kept until expires
+	Save(ctx context.Context, id string, d Data, expires time.Time) error
+
+	// Delete forgets session id. Deleting an unknown session is not an error.
+	Delete(ctx context.Context, id string) error
+
+	// Prune deletes the sessions that expire before now and returns their ids
+	Prune(ctx context.Context, now time.Time) ([]string, error)
+}
+
+type memEntry struct {
+	data    Data
+	expires time.Time
+}
+
+// MemoryStore keeps sessions in memory, so they are lost on restart
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]memEntry
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]memEntry)}
+}
+
+// Load returns the data of session id, or ErrNotFound
+func (s *MemoryStore) Load(_ context.Context, id string) (Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sessions[id]
+	if !ok {
+		return Data{}, ErrNotFound
+	}
+	return e.data.copy(), nil
+}
+
+// Save stores the data of session id
+func (s *MemoryStore) Save(_ context.Context, id string, d Data, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[id] = memEntry{data: d.copy(), expires: expires}
+	return nil
+}
+
+// Delete forgets session id
+func (s *MemoryStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+// Prune deletes the sessions that expire before now
+func (s *MemoryStore) Prune(_ context.Context, now time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pruned []string
+	for id, e := range s.sessions {
+		if e.expires.Before(now) {
+			delete(s.sessions, id)
+			pruned = append(pruned, id)
+		}
+	}
+	return pruned, nil
+}
+
+// storedSession is a session in a StorageStore
+type storedSession struct {
+	Data
+	Expires time.Time `json:"expires"`
+}
+
+// StorageStore keeps sessions in a storage.Store, so they survive restarts
+type StorageStore struct {
+	store storage.Store
+}
+
+// NewStorageStore returns a StorageStore keeping sessions in store
+func NewStorageStore(store storage.Store) *StorageStore {
+	return &StorageStore{store: store}
+}
+
+// Load returns the data of session id, or ErrNotFound
+func (s *StorageStore) Load(ctx context.Context, id string) (Data, error) {
+	var stored storedSession
+	err := s.store.View(ctx, func(tx storage.Tx) error {
+		docs, err := storage.Docs(tx, sessionsBucket)
+		if err != nil {
+			return err
+		}
+		return docs.Get(id, &stored)
+	})
+	if errors.Is(err, storage.ErrNotFound) {
+		return Data{}, ErrNotFound
+	}
+	if err != nil {
+		return Data{}, fmt.Errorf("error reading session : %w", err)
+	}
+	if stored.Values == nil {
+		stored.Values = make(map[string]string)
+	}
+	return stored.Data, nil
+}
+
+// Save stores the data of session id
+func (s *StorageStore) Save(ctx context.Context, id string, d Data, expires time.Time) error {
+	err := s.store.Update(ctx, func(tx storage.Tx) error {
+		docs, err := storage.Docs(tx, sessionsBucket)
+		if err != nil {
+			return err
+		}
+		return docs.Put(id, storedSession{Data: d, Expires: expires})
+	})
+	if err != nil {
+		return fmt.Errorf("error saving session : %w", err)
+	}
+	return nil
+}
+
+// Delete forgets session id
+func (s *StorageStore) Delete(ctx context.Context, id string) error {
+	err := s.store.Update(ctx, func(tx storage.Tx) error {
+		docs, err := storage.Docs(tx, sessionsBucket)
+		if err != nil {
+			return err
+		}
+		return docs.Delete(id)
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting session : %w", err)
+	}
+	return nil
+}
+
+// Prune deletes the sessions that expire before now
+func (s *StorageStore) Prune(ctx context.Context, now time.Time) ([]string, error) {
+	var pruned []string
+	err := s.store.Update(ctx, func(tx storage.Tx) error {
+		docs, err := storage.Docs(tx, sessionsBucket)
+		if err != nil {
+			return err
+		}
+		err = docs.ForEach(func(id string, raw json.RawMessage) error {
+			var stored storedSession
+			if err := json.Unmarshal(raw, &stored); err != nil {
+				return fmt.Errorf("error decoding session : %w", err)
+			}
+			if stored.Expires.Before(now) {
+				pruned = append(pruned, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range pruned {
+			if err := docs.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error pruning sessions : %w", err)
+	}
+	return pruned, nil
+}
+
+var (
+	_ Store = (*MemoryStore)(nil)
+	_ Store = (*StorageStore)(nil)
+)
@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aljo242/koch/config"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DriverBolt stores everything in a single embedded bbolt file
+const DriverBolt = "bolt"
+
+// boltOpenTimeout bounds how long Open waits for another process to release the file lock
+const boltOpenTimeout = 5 * time.Second
+
+func init() {
+	Register(DriverBolt, func(cfg config.DatabaseConfig) (Store, error) {
+		return OpenBolt(cfg.Path)
+	})
+}
+
+// Bolt is a Store backed by a bbolt file
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens or creates the bbolt file at path, creating its directory if needed
+func OpenBolt(path string) (*Bolt, error) {
+	if path == "" {
+		return nil, errors.New("the bolt storage driver requires database.path")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("error creating database directory : %w", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("error opening database %v : %w", path, err)
+	}
+	return &Bolt{db: db}, nil
+}
+
+// View runs fn in a read-only transaction
+func (s *Bolt) View(ctx context.Context, fn func(tx Tx) error) error {
+	if err := begin(ctx); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// Update runs fn in a read-write transaction
+func (s *Bolt) Update(ctx context.Context, fn func(tx Tx) error) error {
+	if err := begin(ctx); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// Close closes the database file
+func (s *Bolt) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTx) Bucket(name string) (Bucket, error) {
+	if !t.tx.Writable() {
+		// a missing bucket reads as empty
+		return &boltBucket{b: t.tx.Bucket([]byte(name))}, nil
+	}
+	b, err := t.tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("error creating bucket %v : %w", name, err)
+	}
+	return &boltBucket{b: b}, nil
+}
+
+func (t *boltTx) DeleteBucket(name string) error {
+	if !t.tx.Writable() {
+		return ErrReadOnly
+	}
+	err := t.tx.DeleteBucket([]byte(name))
+	if errors.Is(err, bolt.ErrBucketNotFound) {
+		return nil
+	}
+	return err
+}
+
+// boltBucket wraps a bbolt bucket, which is nil for a missing bucket in a read-only transaction
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (b *boltBucket) Get(key []byte) ([]byte, error) {
+	if b.b == nil {
+		return nil, ErrNotFound
+	}
+	v := b.b.Get(key)
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (b *boltBucket) Put(key, value []byte) error {
+	if b.b == nil {
+		return ErrReadOnly
+	}
+	if err := b.b.Put(key, value); err != nil {
+		return mapBoltErr(err)
+	}
+	return nil
+}
+
+func (b *boltBucket) Delete(key []byte) error {
+	if b.b == nil {
+		return ErrReadOnly
+	}
+	return mapBoltErr(b.b.Delete(key))
+}
+
+func (b *boltBucket) Range(from []byte, reverse bool, fn func(key, value []byte) error) error {
+	if b.b == nil {
+		return nil
+	}
+
+	c := b.b.Cursor()
+	var k, v []byte
+	switch {
+	case from == nil && !reverse:
+		k, v = c.First()
+	case from == nil:
+		k, v = c.Last()
+	default:
+		k, v = c.Seek(from)
+		if reverse && (k == nil || bytes.Compare(from, k) < 0) {
+			// Seek lands on the first key after from
+			k, v = c.Prev()
+		}
+	}
+
+	for ; k != nil; k, v = next(c, reverse) {
+		if v == nil {
+			continue // nested bucket
+		}
+		if err := fn(k, v); err != nil {
+			if errors.Is(err, ErrStop) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func next(c *bolt.Cursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+func (b *boltBucket) NextSequence() (uint64, error) {
+	if b.b == nil {
+		return 0, ErrReadOnly
+	}
+	seq, err := b.b.NextSequence()
+	return seq, mapBoltErr(err)
+}
+
+// mapBoltErr converts bbolt errors to the storage errors
+func mapBoltErr(err error) error {
+	if errors.Is(err, bolt.ErrTxNotWritable) {
+		return ErrReadOnly
+	}
+	return err
+}
+
+// compile time check
+var _ Store = (*Bolt)(nil)
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Documents stores JSON encoded values by id in a bucket
+type Documents struct {
+	bucket Bucket
+}
+
+// Docs returns the documents of the bucket called name within tx
+func Docs(tx Tx, name string) (*Documents, error) {
+	b, err := tx.Bucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Documents{bucket: b}, nil
+}
+
+// Get decodes the document id into v or returns ErrNotFound
+func (d *Documents) Get(id string, v interface{}) error {
+	b, err := d.bucket.Get([]byte(id))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("error decoding document %v : %w", id, err)
+	}
+	return nil
+}
+
+// Put stores v as the document id, replacing any previous version
+func (d *Documents) Put(id string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding document %v : %w", id, err)
+	}
+	return d.bucket.Put([]byte(id), b)
+}
+
+// Insert stores v under a new id taken from the bucket sequence and returns the id.
+// Ids are zero padded so they sort in insertion order.
+func (d *Documents) Insert(v interface{}) (string, error) {
+	seq, err := d.bucket.NextSequence()
+	if err != nil {
+		return "", err
+	}
+	id := SeqKey(seq)
+	return id, d.Put(id, v)
+}
+
+// Delete removes the document id
+func (d *Documents) Delete(id string) error {
+	return d.bucket.Delete([]byte(id))
+}
+
+// ForEach calls fn with the id and raw JSON of every document in id order
+// until fn returns an error. Returning ErrStop ends the scan without an error.
+func (d *Documents) ForEach(fn func(id string, raw json.RawMessage) error) error {
+	return d.bucket.Range(nil, false, func(k, v []byte) error {
+		return fn(string(k), json.RawMessage(v))
+	})
+}
+
+// SeqKey formats a sequence number as a key that sorts numerically
+func SeqKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
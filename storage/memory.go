@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/aljo242/koch/config"
+)
+
+// DriverMemory keeps everything in memory; its contents are lost on Close
+const DriverMemory = "memory"
+
+// errClosed is returned by a closed memory store
+var errClosed = errors.New("store is closed")
+
+func init() {
+	Register(DriverMemory, func(config.DatabaseConfig) (Store, error) {
+		return NewMemory(), nil
+	})
+}
+
+// memBucket is the committed state of a memory bucket
+type memBucket struct {
+	data map[string][]byte
+	seq  uint64
+}
+
+func (b *memBucket) clone() *memBucket {
+	data := make(map[string][]byte, len(b.data))
+	for k, v := range b.data {
+		data[k] = v
+	}
+	return &memBucket{data: data, seq: b.seq}
+}
+
+// Memory is a Store held in memory, meant for tests and throwaway servers.
+// Writers are serialised; an update works on copies of the buckets it touches
+// which replace the committed buckets when it succeeds.
+type Memory struct {
+	mu      sync.RWMutex
+	buckets map[string]*memBucket
+	closed  bool
+}
+
+// NewMemory returns an empty memory store
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*memBucket)}
+}
+
+// View runs fn in a read-only transaction
+func (m *Memory) View(ctx context.Context, fn func(tx Tx) error) error {
+	if err := begin(ctx); err != nil {
+		return err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return errClosed
+	}
+	return fn(&memTx{store: m})
+}
+
+// Update runs fn in a read-write transaction
+func (m *Memory) Update(ctx context.Context, fn func(tx Tx) error) error {
+	if err := begin(ctx); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errClosed
+	}
+	tx := &memTx{store: m, writable: true, dirty: make(map[string]*memBucket)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for name, b := range tx.dirty {
+		if b == nil {
+			delete(m.buckets, name)
+			continue
+		}
+		m.buckets[name] = b
+	}
+	return nil
+}
+
+// Close drops the contents of the store
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.buckets = nil
+	return nil
+}
+
+type memTx struct {
+	store    *Memory
+	writable bool
+
+	// dirty holds the buckets written by the transaction, nil for deleted buckets
+	dirty map[string]*memBucket
+}
+
+func (tx *memTx) Bucket(name string) (Bucket, error) {
+	return &memTxBucket{tx: tx, name: name}, nil
+}
+
+func (tx *memTx) DeleteBucket(name string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	tx.dirty[name] = nil
+	return nil
+}
+
+// read returns the state of bucket name as seen by the transaction
+func (tx *memTx) read(name string) *memBucket {
+	if b, ok := tx.dirty[name]; ok {
+		return b
+	}
+	return tx.store.buckets[name]
+}
+
+// write returns a private copy of bucket name that the transaction may modify
+func (tx *memTx) write(name string) (*memBucket, error) {
+	if !tx.writable {
+		return nil, ErrReadOnly
+	}
+	if b, ok := tx.dirty[name]; ok && b != nil {
+		return b, nil
+	}
+
+	b := &memBucket{data: make(map[string][]byte)}
+	if _, deleted := tx.dirty[name]; !deleted {
+		if committed, ok := tx.store.buckets[name]; ok {
+			b = committed.clone()
+		}
+	}
+	tx.dirty[name] = b
+	return b, nil
+}
+
+type memTxBucket struct {
+	tx   *memTx
+	name string
+}
+
+func (b *memTxBucket) Get(key []byte) ([]byte, error) {
+	mb := b.tx.read(b.name)
+	if mb == nil {
+		return nil, ErrNotFound
+	}
+	v, ok := mb.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (b *memTxBucket) Put(key, value []byte) error {
+	mb, err := b.tx.write(b.name)
+	if err != nil {
+		return err
+	}
+	mb.data[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (b *memTxBucket) Delete(key []byte) error {
+	mb, err := b.tx.write(b.name)
+	if err != nil {
+		return err
+	}
+	delete(mb.data, string(key))
+	return nil
+}
+
+func (b *memTxBucket) Range(from []byte, reverse bool, fn func(key, value []byte) error) error {
+	mb := b.tx.read(b.name)
+	if mb == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(mb.data))
+	for k := range mb.data {
+		if from != nil && (!reverse && k < string(from) || reverse && k > string(from)) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+
+	for _, k := range keys {
+		if err := fn([]byte(k), mb.data[k]); err != nil {
+			if errors.Is(err, ErrStop) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memTxBucket) NextSequence() (uint64, error) {
+	mb, err := b.tx.write(b.name)
+	if err != nil {
+		return 0, err
+	}
+	mb.seq++
+	return mb.seq, nil
+}
+
+// compile time check
+var _ Store = (*Memory)(nil)
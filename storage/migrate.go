@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// migrationsBucket records the schema version of each migration scope
+const migrationsBucket = "_migrations"
+
+// ErrMigrationOrder is returned when migrations are not listed in increasing version order
+var ErrMigrationOrder = errors.New("migrations must have increasing versions starting above 0")
+
+// Migration changes the stored schema of a scope from the previous version to Version
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      func(tx Tx) error
+}
+
+// Migrate applies the migrations of scope, usually a module name, that are newer
+// than the stored version. Each migration runs in its own transaction together
+// with the version bump, so a failed migration leaves the previous version in place.
+func Migrate(ctx context.Context, s Store, scope string, migrations []Migration) error {
+	var last uint64
+	for _, m := range migrations {
+		if m.Version <= last {
+			return fmt.Errorf("%w : %v version %v", ErrMigrationOrder, scope, m.Version)
+		}
+		last = m.Version
+	}
+
+	current, err := Version(ctx, s, scope)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		m := m
+		err := s.Update(ctx, func(tx Tx) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			b, err := tx.Bucket(migrationsBucket)
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(scope), []byte(strconv.FormatUint(m.Version, 10)))
+		})
+		if err != nil {
+			return fmt.Errorf("error applying migration %v %v (%v) : %w", scope, m.Version, m.Name, err)
+		}
+		log.Info().Str("scope", scope).Uint64("version", m.Version).Str("migration", m.Name).Msg("applied migration")
+	}
+	return nil
+}
+
+// CreateBuckets returns a migration step creating the buckets called names, so a
+// scope's first migration records the buckets it owns
+func CreateBuckets(names ...string) func(tx Tx) error {
+	return func(tx Tx) error {
+		for _, name := range names {
+			if _, err := tx.Bucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Version returns the schema version of scope, 0 if it was never migrated
+func Version(ctx context.Context, s Store, scope string) (uint64, error) {
+	var version uint64
+	err := s.View(ctx, func(tx Tx) error {
+		b, err := tx.Bucket(migrationsBucket)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(scope))
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		version, err = strconv.ParseUint(string(v), 10, 64)
+		return err
+	})
+	return version, err
+}
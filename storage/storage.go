@@ -0,0 +1,123 @@
+// Package storage is the persistence layer shared by the koch modules. A Store
+// holds named buckets of ordered key/value pairs that are read and written in
+// transactions. Documents stores JSON values on top of a bucket and Migrate
+// evolves the stored schema of a module.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aljo242/koch/config"
+)
+
+var (
+	// ErrNotFound is returned when a key does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrReadOnly is returned when a read-only transaction is written to
+	ErrReadOnly = errors.New("transaction is read-only")
+
+	// ErrUnknownDriver is returned by Open for a driver that is not registered
+	ErrUnknownDriver = errors.New("unknown storage driver")
+
+	// ErrStop may be returned from a Range callback to end the scan early without an error
+	ErrStop = errors.New("stop range")
+)
+
+// Store is a transactional key/value store organised in buckets
+type Store interface {
+	// View runs fn in a read-only transaction
+	View(ctx context.Context, fn func(tx Tx) error) error
+
+	// Update runs fn in a read-write transaction that is committed if fn returns nil
+	// and rolled back otherwise
+	Update(ctx context.Context, fn func(tx Tx) error) error
+
+	// Close releases the store. Pending transactions finish first.
+	Close() error
+}
+
+// Tx is a transaction. It must not be used after the function it was passed to returns.
+type Tx interface {
+	// Bucket returns the bucket called name. Read-write transactions create it if
+	// needed; in read-only transactions a missing bucket is empty.
+	Bucket(name string) (Bucket, error)
+
+	// DeleteBucket removes the bucket called name and all of its keys
+	DeleteBucket(name string) error
+}
+
+// Bucket is an ordered set of keys within a transaction. Values returned by Range
+// are only valid until the callback returns; copy them to keep them.
+type Bucket interface {
+	// Get returns a copy of the value of key or ErrNotFound
+	Get(key []byte) ([]byte, error)
+
+	// Put sets the value of key
+	Put(key, value []byte) error
+
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key []byte) error
+
+	// Range calls fn for every key starting at from (the first or last key if nil),
+	// in ascending order or descending if reverse is set, until fn returns an error.
+	// Returning ErrStop ends the scan without an error.
+	Range(from []byte, reverse bool, fn func(key, value []byte) error) error
+
+	// NextSequence returns the next value of the bucket's monotonic counter, starting at 1
+	NextSequence() (uint64, error)
+}
+
+// OpenFunc opens a store from the [database] section
+type OpenFunc func(cfg config.DatabaseConfig) (Store, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]OpenFunc)
+)
+
+// Register makes a storage driver available to Open under name.
+// It panics if a driver is registered twice, like database/sql.
+func Register(name string, open OpenFunc) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if _, dup := drivers[name]; dup {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = open
+}
+
+// Drivers returns the names of the registered drivers, sorted
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the store configured by the [database] section
+func Open(cfg config.DatabaseConfig) (Store, error) {
+	driversMu.RLock()
+	open, ok := drivers[cfg.Driver]
+	driversMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w %q : expected one of %v", ErrUnknownDriver, cfg.Driver, Drivers())
+	}
+	return open(cfg)
+}
+
+// begin reports ctx's error if it is already done, so no transaction is started for a cancelled request
+func begin(ctx context.Context) error {
+	return ctx.Err()
+}
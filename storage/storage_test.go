@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/aljo242/koch/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stores returns a fresh store of every built-in driver
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	bolt, err := Open(config.DatabaseConfig{Driver: DriverBolt, Path: filepath.Join(t.TempDir(), "db", "koch.db")})
+	require.NoError(t, err)
+	mem, err := Open(config.DatabaseConfig{Driver: DriverMemory})
+	require.NoError(t, err)
+
+	all := map[string]Store{DriverBolt: bolt, DriverMemory: mem}
+	t.Cleanup(func() {
+		for _, s := range all {
+			require.NoError(t, s.Close())
+		}
+	})
+	return all
+}
+
+func TestOpenUnknownDriver(t *testing.T) {
+	t.Parallel()
+
+	_, err := Open(config.DatabaseConfig{Driver: "postgres"})
+	require.ErrorIs(t, err, ErrUnknownDriver)
+}
+
+func TestTransactions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for name, s := range stores(t) {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, s.Update(ctx, func(tx Tx) error {
+				b, err := tx.Bucket("kv")
+				require.NoError(t, err)
+				return b.Put([]byte("a"), []byte("1"))
+			}))
+
+			// a failed update is rolled back
+			errBoom := errors.New("boom")
+			err := s.Update(ctx, func(tx Tx) error {
+				b, err := tx.Bucket("kv")
+				require.NoError(t, err)
+				require.NoError(t, b.Put([]byte("a"), []byte("2")))
+				require.NoError(t, b.Put([]byte("b"), []byte("2")))
+				return errBoom
+			})
+			require.ErrorIs(t, err, errBoom)
+
+			require.NoError(t, s.View(ctx, func(tx Tx) error {
+				b, err := tx.Bucket("kv")
+				require.NoError(t, err)
+				v, err := b.Get([]byte("a"))
+				require.NoError(t, err)
+				require.Equal(t, "1", string(v))
+				_, err = b.Get([]byte("b"))
+				require.ErrorIs(t, err, ErrNotFound)
+				require.ErrorIs(t, b.Put([]byte("c"), nil), ErrReadOnly)
+
+				missing, err := tx.Bucket("missing")
+				require.NoError(t, err)
+				_, err = missing.Get([]byte("a"))
+				require.ErrorIs(t, err, ErrNotFound)
+				return nil
+			}))
+
+			require.NoError(t, s.Update(ctx, func(tx Tx) error {
+				return tx.DeleteBucket("kv")
+			}))
+			require.NoError(t, s.View(ctx, func(tx Tx) error {
+				b, err := tx.Bucket("kv")
+				require.NoError(t, err)
+				_, err = b.Get([]byte("a"))
+				require.ErrorIs(t, err, ErrNotFound)
+				return nil
+			}))
+
+			cancelled, cancel := context.WithCancel(ctx)
+			cancel()
+			require.ErrorIs(t, s.View(cancelled, func(Tx) error { return nil }), context.Canceled)
+		})
+	}
+}
+
+func TestRange(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for name, s := range stores(t) {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, s.Update(ctx, func(tx Tx) error {
+				b, err := tx.Bucket("kv")
+				require.NoError(t, err)
+				for _, k := range []string{"b", "d", "a", "c"} {
+					require.NoError(t, b.Put([]byte(k), []byte(k)))
+				}
+				return nil
+			}))
+
+			scan := func(from []byte, reverse bool, limit int) []string {
+				var keys []string
+				require.NoError(t, s.View(ctx, func(tx Tx) error {
+					b, err := tx.Bucket("kv")
+					require.NoError(t, err)
+					return b.Range(from, reverse, func(k, _ []byte) error {
+						keys = append(keys, string(k))
+						if len(keys) == limit {
+							return ErrStop
+						}
+						return nil
+					})
+				}))
+				return keys
+			}
+
+			require.Equal(t, []string{"a", "b", "c", "d"}, scan(nil, false, 0))
+			require.Equal(t, []string{"d", "c"}, scan(nil, true, 2))
+			require.Equal(t, []string{"b", "c", "d"}, scan([]byte("b"), false, 0))
+			require.Equal(t, []string{"b", "a"}, scan([]byte("bb"), true, 0))
+			require.Equal(t, []string{"d", "c"}, scan([]byte("z"), true, 2))
+		})
+	}
+}
+
+func TestDocuments(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	type note struct {
+		Text string `json:"text"`
+	}
+
+	for name, s := range stores(t) {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			var first string
+			require.NoError(t, s.Update(ctx, func(tx Tx) error {
+				docs, err := Docs(tx, "notes")
+				require.NoError(t, err)
+				first, err = docs.Insert(note{Text: "one"})
+				require.NoError(t, err)
+				_, err = docs.Insert(note{Text: "two"})
+				require.NoError(t, err)
+				return docs.Put("pinned", note{Text: "pinned"})
+			}))
+			require.Equal(t, SeqKey(1), first)
+
+			require.NoError(t, s.View(ctx, func(tx Tx) error {
+				docs, err := Docs(tx, "notes")
+				require.NoError(t, err)
+
+				var n note
+				require.NoError(t, docs.Get(first, &n))
+				require.Equal(t, "one", n.Text)
+				require.ErrorIs(t, docs.Get("nope", &n), ErrNotFound)
+
+				var texts []string
+				require.NoError(t, docs.ForEach(func(_ string, raw json.RawMessage) error {
+					require.NoError(t, json.Unmarshal(raw, &n))
+					texts = append(texts, n.Text)
+					return nil
+				}))
+				require.Equal(t, []string{"one", "two", "pinned"}, texts)
+				return nil
+			}))
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for name, s := range stores(t) {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			var applied []uint64
+			migration := func(v uint64, err error) Migration {
+				return Migration{Version: v, Name: "test", Up: func(tx Tx) error {
+					b, _ := tx.Bucket("data")
+					if err := b.Put([]byte{byte(v)}, nil); err != nil {
+						return err
+					}
+					applied = append(applied, v)
+					return err
+				}}
+			}
+
+			require.ErrorIs(t, Migrate(ctx, s, "test", []Migration{migration(2, nil), migration(1, nil)}), ErrMigrationOrder)
+
+			errBoom := errors.New("boom")
+			err := Migrate(ctx, s, "test", []Migration{migration(1, nil), migration(2, errBoom)})
+			require.ErrorIs(t, err, errBoom)
+			version, err := Version(ctx, s, "test")
+			require.NoError(t, err)
+			require.EqualValues(t, 1, version)
+
+			// only the migrations above the stored version run again
+			applied = nil
+			require.NoError(t, Migrate(ctx, s, "test", []Migration{migration(1, nil), migration(2, nil), migration(3, nil)}))
+			require.Equal(t, []uint64{2, 3}, applied)
+			version, err = Version(ctx, s, "test")
+			require.NoError(t, err)
+			require.EqualValues(t, 3, version)
+		})
+	}
+}
@@ -8,7 +8,7 @@ import (
 func TestExternalIP(t *testing.T) {
 	_, err := ExternalIP()
 	if err != nil {
-		t.Errorf("ExternalIP failed : %w", err)
+		t.Errorf("ExternalIP failed : %v", err)
 	}
 }
 
@@ -16,7 +16,7 @@ func TestExternalIP(t *testing.T) {
 func TestHost(t *testing.T) {
 	_, err := HostInfo()
 	if err != nil {
-		t.Errorf("HostInfo failed : %w", err)
+		t.Errorf("HostInfo failed : %v", err)
 
 	}
 }
@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxAnnounceBody bounds the JSON body of an announcement request
+const maxAnnounceBody = 16 << 10
+
+// ClientInfo describes a connection of a hub
+type ClientInfo struct {
+	ID     string   `json:"id"`
+	User   UserInfo `json:"user"`
+	IP     string   `json:"ip,omitempty"`
+	Rooms  []string `json:"rooms"`
+	Legacy bool     `json:"legacy,omitempty"`
+}
+
+// outgoing checks a message sent by Go code and assigns its server owned fields.
+// Messages are announcements unless they are typed as plain messages, which may
+// name any Sender, as a bot would.
+func (h *Hub) outgoing(m Message) (*Message, error) {
+	if m.Type == "" {
+		m.Type = TypeAnnouncement
+	}
+	if m.Type != TypeAnnouncement && m.Type != TypeMessage {
+		return nil, &ProtocolError{Code: CodeUnsupportedType, Msg: fmt.Sprintf("cannot send %q messages", m.Type)}
+	}
+	if err := validateBody(m.Body, ""); err != nil {
+		return nil, err
+	}
+	m.SenderID, m.To, m.Room = "", "", ""
+	m.Users, m.History, m.Seq, m.Token = nil, nil, 0, ""
+	m.stamp()
+	h.render(&m)
+	return &m, nil
+}
+
+// Broadcast sends m to every client of the hub, outside of any room. It returns a
+// copy of the message as sent, with its id and timestamp.
+func (h *Hub) Broadcast(ctx context.Context, m Message) (*Message, error) {
+	out, err := h.outgoing(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.do(ctx, func() {
+		for c := range h.clients {
+			h.deliver(c, out)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return sent(out), nil
+}
+
+// sent returns a copy of m for the caller, as clients are still reading m
+func sent(m *Message) *Message {
+	c := *m
+	return &c
+}
+
+// SendToRoom sends m to the members of the room called room and adds it to the
+// room's history. It returns the message as sent, numbered in the room.
+func (h *Hub) SendToRoom(ctx context.Context, room string, m Message) (*Message, error) {
+	name, ok := roomName(room)
+	if !ok {
+		return nil, &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid room name"}
+	}
+	out, err := h.outgoing(m)
+	if err != nil {
+		return nil, err
+	}
+	out.Room = name
+
+	if doErr := h.do(ctx, func() {
+		r, ok := h.rooms[name]
+		if !ok {
+			err = &ProtocolError{Code: CodeNoSuchRoom, Msg: "no room called " + name}
+			return
+		}
+		h.record(r, out)
+		h.broadcast(name, out)
+	}); doErr != nil {
+		return nil, doErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sent(out), nil
+}
+
+// SendToUser sends m to every connection of the user id, or queues it while they
+// are offline like a direct message
+func (h *Hub) SendToUser(ctx context.Context, userID string, m Message) (*Message, error) {
+	out, err := h.outgoing(m)
+	if err != nil {
+		return nil, err
+	}
+	if doErr := h.do(ctx, func() { _, err = h.toUser(userID, out) }); doErr != nil {
+		return nil, doErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sent(out), nil
+}
+
+// Clients lists the connections of the hub, sorted by user name
+func (h *Hub) Clients(ctx context.Context) ([]ClientInfo, error) {
+	clients := []ClientInfo{}
+	err := h.do(ctx, func() {
+		for c := range h.clients {
+			info := ClientInfo{ID: c.id, User: c.user.info(), IP: c.ip, Rooms: make([]string, 0, len(c.rooms)), Legacy: c.legacy}
+			for name := range c.rooms {
+				info.Rooms = append(info.Rooms, name)
+			}
+			sort.Strings(info.Rooms)
+			clients = append(clients, info)
+		}
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].User.Name != clients[j].User.Name {
+			return clients[i].User.Name < clients[j].User.Name
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	return clients, err
+}
+
+// Kick closes every connection of the user id with a policy violation and reason,
+// which cannot be resumed, and returns how many there were. It is logged as a
+// kick taken through the admin API, see Moderate.
+func (h *Hub) Kick(ctx context.Context, userID, reason string) (int, error) {
+	return h.Moderate(ctx, Action{Action: ActionKick, Target: Target{UserID: userID}, Reason: reason})
+}
+
+// ClientsHandler lists the connections of hub as JSON. It is an admin route.
+func ClientsHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clients, err := hub.Clients(r.Context())
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(clients); err != nil {
+			log.Error().Err(err).Msg("error writing chat clients")
+		}
+	}
+}
+
+// Announcement is the body of an announcement request, see AnnounceHandler
+type Announcement struct {
+	// Room receives the announcement, or every client if empty
+	Room string `json:"room"`
+
+	Body string `json:"body"`
+}
+
+// AnnounceHandler posts the Announcement in the request body as a system
+// announcement, answering with the message as sent. It is an admin route.
+func AnnounceHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var a Announcement
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnnounceBody)).Decode(&a); err != nil {
+			http.Error(w, "invalid announcement", http.StatusBadRequest)
+			return
+		}
+
+		var m *Message
+		var err error
+		if a.Room == "" {
+			m, err = hub.Broadcast(r.Context(), Message{Body: a.Body})
+		} else {
+			m, err = hub.SendToRoom(r.Context(), a.Room, Message{Body: a.Body})
+		}
+		var perr *ProtocolError
+		switch {
+		case errors.As(err, &perr) && perr.Code == CodeNoSuchRoom:
+			http.Error(w, perr.Msg, http.StatusNotFound)
+			return
+		case errors.As(err, &perr):
+			http.Error(w, perr.Msg, http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		log.Info().Str("room", a.Room).Str("id", m.ID).Msg("posted chat announcement")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(m); err != nil {
+			log.Error().Err(err).Msg("error writing chat announcement")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHubAPI(t *testing.T) {
+	t.Parallel()
+	hub, url := newTestServer(t)
+	ctx := context.Background()
+
+	alice := dial(t, url, false)
+	aliceID := joinAs(t, alice, "alice")
+	bob := dial(t, url, true)
+	waitMembers(t, hub, "lobby", 2)
+
+	m, err := hub.SendToRoom(ctx, "Lobby", Message{Body: "server restarting in 5 minutes"})
+	require.NoError(t, err)
+	require.Equal(t, TypeAnnouncement, m.Type)
+	got := readType(t, alice, TypeAnnouncement)
+	require.Equal(t, m.ID, got.ID)
+	require.Equal(t, "lobby", got.Room)
+	require.NotZero(t, got.Seq, "room messages are numbered")
+	for {
+		require.NoError(t, bob.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, frame, err := bob.ReadMessage()
+		require.NoError(t, err)
+		if string(frame) == "announcement: server restarting in 5 minutes" {
+			break
+		}
+	}
+
+	_, err = hub.SendToRoom(ctx, "nowhere", Message{Body: "hello?"})
+	var perr *ProtocolError
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, CodeNoSuchRoom, perr.Code)
+	_, err = hub.Broadcast(ctx, Message{Type: TypeJoin, Body: "x"})
+	require.ErrorAs(t, err, &perr)
+	_, err = hub.Broadcast(ctx, Message{Body: " "})
+	require.ErrorAs(t, err, &perr)
+
+	_, err = hub.SendToUser(ctx, aliceID, Message{Type: TypeMessage, Sender: "bot", Body: "just you"})
+	require.NoError(t, err)
+	got = readType(t, alice, TypeMessage)
+	require.Equal(t, "bot", got.Sender)
+	require.Empty(t, got.SenderID)
+	_, err = hub.SendToUser(ctx, "g-nobody", Message{Body: "hi"})
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, CodeUserOffline, perr.Code)
+
+	clients, err := hub.Clients(ctx)
+	require.NoError(t, err)
+	require.Len(t, clients, 2)
+	require.Equal(t, "alice", clients[0].User.Name)
+	require.Equal(t, []string{"lobby"}, clients[0].Rooms)
+	require.True(t, clients[1].Legacy)
+
+	n, err := hub.Kick(ctx, aliceID, "be nice")
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	for {
+		require.NoError(t, alice.SetReadDeadline(time.Now().Add(2*time.Second)))
+		if _, _, err = alice.ReadMessage(); err != nil {
+			break
+		}
+	}
+	var cerr *websocket.CloseError
+	require.ErrorAs(t, err, &cerr)
+	require.Equal(t, websocket.ClosePolicyViolation, cerr.Code)
+	require.Equal(t, "be nice", cerr.Text)
+}
+
+func TestAnnounceHandler(t *testing.T) {
+	t.Parallel()
+	hub, url := newTestServer(t)
+
+	conn := dial(t, url, false)
+	waitMembers(t, hub, "lobby", 1)
+
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		AnnounceHandler(hub)(rec, httptest.NewRequest(http.MethodPost, "/announce", strings.NewReader(body)))
+		return rec.Code
+	}
+	require.Equal(t, http.StatusCreated, post(`{"body":"maintenance tonight"}`))
+	require.Equal(t, "maintenance tonight", readType(t, conn, TypeAnnouncement).Body)
+	require.Equal(t, http.StatusCreated, post(`{"room":"lobby","body":"lobby only"}`))
+	require.Equal(t, "lobby only", readType(t, conn, TypeAnnouncement).Body)
+
+	require.Equal(t, http.StatusNotFound, post(`{"room":"nowhere","body":"hi"}`))
+	require.Equal(t, http.StatusBadRequest, post(`{"body":""}`))
+	require.Equal(t, http.StatusBadRequest, post(`not json`))
+}
@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Stats counts the connections of a hub and the work of its slow client policy
+type Stats struct {
+	Clients int `json:"clients"`
+	Users   int `json:"users"`
+	Rooms   int `json:"rooms"`
+
+	// Dropped is the number of messages dropped for slow clients
+	Dropped uint64 `json:"dropped"`
+
+	// Coalesced is the number of presence updates superseded by later ones
+	Coalesced uint64 `json:"coalesced"`
+
+	// Disconnected is the number of slow clients disconnected
+	Disconnected uint64 `json:"disconnected"`
+}
+
+// Stats returns the current counts of the hub
+func (h *Hub) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := h.do(ctx, func() {
+		stats = h.stats
+		stats.Clients, stats.Users, stats.Rooms = len(h.clients), len(h.users), len(h.rooms)
+	})
+	return stats, err
+}
+
+// overflow applies the slow client policy to m, for c whose send buffer is full
+func (h *Hub) overflow(c *Client, m *Message) {
+	if _, ok := h.clients[c]; !ok {
+		return // being removed, its last messages do not matter
+	}
+	policy := h.cfg.SlowClients.Policy
+	if max := h.cfg.SlowClients.MaxDropped; max > 0 && c.dropped >= max {
+		policy = PolicyDisconnect
+	}
+
+	dropped, coalesced := 0, 0
+	switch policy {
+	case PolicyDropNewest:
+		dropped = 1
+	case PolicyDropOldest:
+		select {
+		case <-c.send:
+			dropped = 1
+		default:
+			// the write pump made room
+		}
+		c.send <- m
+	case PolicyCoalesce:
+		dropped, coalesced = h.coalesce(c, m)
+	default:
+		h.stats.Disconnected++
+		log.Warn().
+			Str("user", c.user.id).
+			Int("queued", len(c.send)).
+			Int("dropped", c.dropped).
+			Msg("disconnecting slow chat client")
+		h.disconnect(c, websocket.CloseTryAgainLater, "too slow to keep up")
+		return
+	}
+
+	c.dropped += dropped
+	h.stats.Dropped += uint64(dropped)
+	h.stats.Coalesced += uint64(coalesced)
+	log.Warn().
+		Str("user", c.user.id).
+		Str("policy", policy).
+		Int("dropped", dropped).
+		Int("coalesced", coalesced).
+		Int("droppedInRow", c.dropped).
+		Msg("chat client is too slow, dropping messages")
+}
+
+// coalesce requeues the messages of c with m, keeping only the latest presence
+// update of each user and room and then the newest messages that fit. It returns
+// the number of messages dropped and coalesced.
+func (h *Hub) coalesce(c *Client, m *Message) (int, int) {
+	queued := make([]*Message, 0, cap(c.send)+1)
+drain:
+	for {
+		select {
+		case q := <-c.send:
+			queued = append(queued, q)
+		default:
+			break drain
+		}
+	}
+	queued = append(queued, m)
+
+	kept := latestPresence(queued)
+	coalesced := len(queued) - len(kept)
+	dropped := 0
+	if over := len(kept) - cap(c.send); over > 0 {
+		kept, dropped = kept[over:], over
+	}
+	// only the hub sends, so the drained buffer has room for every kept message
+	for _, q := range kept {
+		c.send <- q
+	}
+	return dropped, coalesced
+}
+
+// latestPresence returns msgs without the presence messages superseded by a later
+// one about the same user and room, keeping the order of the rest
+func latestPresence(msgs []*Message) []*Message {
+	seen := make(map[string]bool)
+	keep := make([]bool, len(msgs))
+	n := 0
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		if m.Type == TypePresence {
+			key := m.Room + "\x00" + m.SenderID
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		keep[i] = true
+		n++
+	}
+
+	kept := make([]*Message, 0, n)
+	for i, m := range msgs {
+		if keep[i] {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// droppedMessage tells a client that n messages for it were dropped
+func droppedMessage(n int) *Message {
+	return errorMessage(&ProtocolError{
+		Code: CodeDropped,
+		Msg:  strconv.Itoa(n) + " messages were dropped while the connection was too slow, load the history of your rooms to catch up",
+	})
+}
+
+// StatsHandler writes the Stats of hub as JSON
+func StatsHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := hub.Stats(r.Context())
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Error().Err(err).Msg("error writing chat stats")
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newSlowClient adds a client to a hub that is not running, with a send buffer of size
+// that nothing reads from
+func newSlowClient(h *Hub, size int) *Client {
+	c := &Client{hub: h, send: make(chan *Message, size), rooms: make(map[string]bool)}
+	c.user = &user{id: "g-slow", name: "slow", conns: map[*Client]bool{c: true}}
+	h.clients[c] = true
+	h.users[c.user.id] = c.user
+	return c
+}
+
+func queued(c *Client) []string {
+	var bodies []string
+	for len(c.send) > 0 {
+		m := <-c.send
+		bodies = append(bodies, m.Body)
+	}
+	return bodies
+}
+
+func textMessage(i int) *Message {
+	return &Message{Type: TypeMessage, Body: strconv.Itoa(i)}
+}
+
+func TestSlowClientPolicies(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		policy string
+		want   []string
+	}{
+		{PolicyDropNewest, []string{"0", "1", "2"}},
+		{PolicyDropOldest, []string{"2", "3", "4"}},
+	} {
+		h := NewHub()
+		h.cfg.SlowClients.Policy = tc.policy
+		c := newSlowClient(h, 3)
+		for i := 0; i < 5; i++ {
+			h.deliver(c, textMessage(i))
+		}
+		require.Equal(t, tc.want, queued(c), tc.policy)
+		require.Equal(t, uint64(2), h.stats.Dropped, tc.policy)
+
+		// once there is room the client learns what it missed
+		h.deliver(c, textMessage(5))
+		m := <-c.send
+		require.Equal(t, TypeError, m.Type, tc.policy)
+		require.Equal(t, CodeDropped, m.Metadata[MetaCode], tc.policy)
+		require.Equal(t, "5", (<-c.send).Body, tc.policy)
+	}
+}
+
+func TestSlowClientCoalesce(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub()
+	h.cfg.SlowClients.Policy = PolicyCoalesce
+	c := newSlowClient(h, 3)
+	presence := func(status string) *Message {
+		return &Message{Type: TypePresence, SenderID: "g-bob", Body: status}
+	}
+	h.deliver(c, presence(StatusOnline))
+	h.deliver(c, textMessage(1))
+	h.deliver(c, presence("away"))
+	h.deliver(c, presence("busy"))
+	require.Equal(t, []string{"1", "busy"}, queued(c))
+	require.Equal(t, uint64(2), h.stats.Coalesced)
+	require.Zero(t, h.stats.Dropped)
+
+	// without presence to coalesce the oldest messages go
+	for i := 0; i < 4; i++ {
+		h.deliver(c, textMessage(i))
+	}
+	require.Equal(t, []string{"1", "2", "3"}, queued(c))
+	require.Equal(t, uint64(1), h.stats.Dropped)
+}
+
+func TestSlowClientDisconnect(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub()
+	c := newSlowClient(h, 1)
+	h.deliver(c, textMessage(0))
+	h.deliver(c, textMessage(1))
+	require.Equal(t, uint64(1), h.stats.Disconnected)
+	require.NotContains(t, h.clients, c)
+	require.NotEmpty(t, c.closeMsg, "slow clients are told why they are closed")
+
+	// clients that keep dropping messages are disconnected too
+	h.cfg.SlowClients.Policy, h.cfg.SlowClients.MaxDropped = PolicyDropNewest, 2
+	c = newSlowClient(h, 1)
+	for i := 0; i < 4; i++ {
+		h.deliver(c, textMessage(i))
+	}
+	require.Equal(t, uint64(2), h.stats.Disconnected)
+	require.Equal(t, uint64(2), h.stats.Dropped)
+}
+
+func TestStatsHandler(t *testing.T) {
+	t.Parallel()
+	hub, srv := newTestServerConfig(t, DefaultConfig())
+
+	dial(t, wsURL(srv, "/ws"), false)
+	waitMembers(t, hub, "lobby", 1)
+
+	res, err := http.Get(srv.URL + "/stats")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var stats Stats
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+	require.Equal(t, 1, stats.Clients)
+
+	got, err := hub.Stats(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, stats, got)
+}
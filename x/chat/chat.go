@@ -1,47 +1,100 @@
 package chat
 
 import (
-	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/aljo242/koch/csrf"
+	"github.com/aljo242/koch/session"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	// Time allowed to write a message to peer
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from peer
-	pongWait = 60 * time.Second
-
-	// Send pints to peer with this period. Must be less thatn pong Wait
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
-)
-
-var (
-	newline = []byte("\n")
-	space   = []byte(" ")
-)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{Protocol},
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin allows the origins of the csrf.Protector serving the request, or
+// without one only pages served by the host the request was sent to
+func checkOrigin(r *http.Request) bool {
+	if p := csrf.FromContext(r.Context()); p != nil {
+		return p.CheckOrigin(r)
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
 }
 
 // Client is a middleman between the websocket connection and the hub
 type Client struct {
+	// pause is how long ReadPump waits before its next read, set when the
+	// connection is throttled. It comes first to be aligned for atomic access.
+	pause int64
+
 	hub *Hub
 
+	// id identifies the connection in ClientInfo
+	id string
+
+	// ip is the remote address of the connection, which bans and mutes may target
+	ip string
+
+	// cfg holds the connection settings of the hub
+	cfg ConnectionConfig
+
 	// websocket connection
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages
-	send chan []byte
+	send chan *Message
+
+	// legacy clients did not negotiate Protocol and exchange plain text
+	legacy bool
+
+	// identity is who the client was identified as when it connected
+	identity Identity
+
+	// user is the user of the connection, owned by the hub goroutine
+	user *user
+
+	// rooms the client is a member of, owned by the hub goroutine
+	rooms map[string]bool
+
+	// room receives messages that do not name a room: the room given in the URL,
+	// then the last room joined
+	room string
+
+	// token resumes the connection after it closes, see Config.Resume
+	token string
+
+	// resume asks to pick up the rooms of a closed connection instead of joining room
+	resume *resumeRequest
+
+	// rate and bytes limit what the client sends, owned by the hub goroutine
+	rate, bytes bucket
+
+	// dropped counts the messages for the client lost since it was last told, owned
+	// by the hub goroutine
+	dropped int
+
+	// closeMsg is the close frame written when the hub closes send, set by the hub
+	// before it does. An empty close frame is written without one.
+	closeMsg []byte
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -51,21 +104,31 @@ type Client struct {
 // by executing all reads from this goroutine
 func (c *Client) ReadPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		if err := c.conn.Close(); err != nil {
 			log.Error().Err(err).Msg("error closing WebSocket connection")
 		}
+		c.hub.exit()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+	c.conn.SetReadLimit(c.cfg.MaxMessageSize)
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait)); err != nil {
 		log.Error().Err(err).Msg("error setting WebSocket ReadDeadline")
 	}
 	c.conn.SetPongHandler(func(string) error {
-		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
 	})
 
 	for {
+		// a throttled connection is not read from for a while, holding back the
+		// client through TCP flow control
+		if pause := atomic.SwapInt64(&c.pause, 0); pause > 0 {
+			time.Sleep(time.Duration(pause))
+		}
+
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
@@ -74,8 +137,13 @@ func (c *Client) ReadPump() {
 			break
 		}
 
-		message = bytes.TrimSpace(bytes.ReplaceAll(message, newline, space))
-		c.hub.broadcast <- message
+		// each frame is one message; newlines are part of the body
+		msg, err := decodeMessage(message)
+		select {
+		case c.hub.inbound <- inbound{client: c, msg: msg, err: err, size: len(message)}:
+		case <-c.hub.done:
+			return
+		}
 	}
 }
 
@@ -85,59 +153,50 @@ func (c *Client) ReadPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	// pings are sent well within the time the client has to answer them
+	ticker := time.NewTicker(c.cfg.PongWait * 9 / 10)
 	defer func() {
 		ticker.Stop()
 		if err := c.conn.Close(); err != nil {
 			log.Error().Err(err).Msg("error closing WebSocket connection")
 		}
+		c.hub.exit()
 	}()
 
 	for {
 		select {
 		case message, ok := <-c.send:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			if err := c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait)); err != nil {
 				log.Error().Err(err).Msg("error setting write deadline to WebSocket")
 				return
 			}
 
 			if !ok {
 				// the hub closed the channel
-				if err := c.conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
+				if c.closeMsg == nil {
+					c.closeMsg = []byte{}
+				}
+				if err := c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg); err != nil {
 					log.Error().Err(err).Msg("error setting writing CloseMessage on WebSocket")
 				}
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			// every message is written as its own frame so its body stays intact
+			frame, err := message.encode(c.legacy)
 			if err != nil {
-				log.Error().Err(err).Msg("error getting c.conn.NextWriter")
-				return
+				log.Error().Err(err).Msg("error encoding chat message")
+				continue
 			}
-			if _, err = w.Write(message); err != nil {
-				log.Error().Err(err).Msg("error writing WebSocket message")
-				return
+			if frame == nil {
+				continue
 			}
-
-			// Add queued chat messages to the current websocket message
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				if _, err = w.Write(newline); err != nil {
-					log.Error().Err(err).Msg("error writing WebSocket message")
-					return
-				}
-				if _, err := w.Write(<-c.send); err != nil {
-					log.Error().Err(err).Msg("error writing WebSocket message")
-					return
-				}
-			}
-
-			if err := w.Close(); err != nil {
-				log.Error().Err(err).Msg("error closing io.Writer")
+			if err := c.conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				log.Error().Err(err).Msg("error writing WebSocket message")
 				return
 			}
 		case <-ticker.C:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+			if err := c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait)); err != nil {
 				log.Error().Err(err).Msg("error setting write deadline to WebSocket")
 				return
 			}
@@ -149,17 +208,81 @@ func (c *Client) WritePump() {
 	}
 }
 
-// ServeWs handles websocket requests from the peer.
+// ServeWs handles websocket requests from the peer. The client first joins the room
+// named by the {room} route variable or the room query parameter, or the default room.
+//
+// A client that lost its connection resumes it with the resume query parameter set to
+// the token it was given and since listing the last sequence number it saw in each
+// room, as room:seq pairs separated by commas. It rejoins the rooms of the old
+// connection and receives the messages it missed, or a resync error for each room it
+// cannot catch up with.
+//
+// Connections from pages of other sites are rejected, see checkOrigin. Behind
+// csrf.Protector.Middleware the upgrade may also need the csrf query parameter.
 func ServeWs(hub *Hub) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		var resume *resumeRequest
+		if token := r.URL.Query().Get("resume"); token != "" {
+			since, err := parseSince(r.URL.Query().Get("since"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resume = &resumeRequest{token: token, since: since}
+		}
+
+		initial := mux.Vars(r)["room"]
+		if initial == "" {
+			initial = r.URL.Query().Get("room")
+		}
+		if initial != "" {
+			var ok bool
+			if initial, ok = roomName(initial); !ok {
+				http.Error(w, "invalid room name", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if !checkOrigin(r) {
+			log.Warn().Str("origin", r.Header.Get("Origin")).Str("remote", r.RemoteAddr).Msg("rejected cross-site chat connection")
+			http.Error(w, csrf.ErrOrigin.Error(), http.StatusForbidden)
+			return
+		}
+
+		header := make(http.Header)
+		identity, err := hub.identify(r, header)
+		if err != nil {
+			log.Warn().Err(err).Msg("rejected chat connection")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		session.UpgradeHeader(r, header)
+		conn, err := upgrader.Upgrade(w, r, header)
 		if err != nil {
 			log.Error().Err(err).Msg("Error upgrading to websocket")
 			return
 		}
 
-		client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-		client.hub.register <- client
+		client := &Client{
+			hub:      hub,
+			id:       newID(),
+			ip:       remoteIP(r),
+			cfg:      hub.cfg.Connection,
+			conn:     conn,
+			send:     make(chan *Message, hub.cfg.Connection.SendBuffer),
+			legacy:   conn.Subprotocol() != Protocol,
+			rooms:    make(map[string]bool),
+			room:     initial,
+			identity: identity,
+			resume:   resume,
+		}
+		select {
+		case client.hub.register <- client:
+		case <-hub.done:
+			closeGoingAway(conn, hub.cfg.Connection.WriteWait)
+			return
+		}
 
 		// Allow collection of memory referenced by the caller by doing all work in
 		// new goroutines
@@ -167,3 +290,90 @@ func ServeWs(hub *Hub) func(http.ResponseWriter, *http.Request) {
 		go client.ReadPump()
 	}
 }
+
+// remoteIP returns the IP address a request came from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// closeGoingAway closes a connection the stopped hub cannot serve
+func closeGoingAway(conn *websocket.Conn, wait time.Duration) {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+	if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wait)); err != nil {
+		log.Error().Err(err).Msg("error writing CloseMessage on WebSocket")
+	}
+	if err := conn.Close(); err != nil {
+		log.Error().Err(err).Msg("error closing WebSocket connection")
+	}
+}
+
+// RoomsHandler lists the rooms of hub and their member counts as JSON
+func RoomsHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rooms, err := hub.Rooms(r.Context())
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(rooms); err != nil {
+			log.Error().Err(err).Msg("error writing room list")
+		}
+	}
+}
+
+// HistoryHandler returns a page of the history of the {room} route variable as a
+// HistoryPage. The before query parameter is the cursor of the page and limit the
+// number of messages. Rooms for signed in users only answer 401 Unauthorized to guests.
+func HistoryHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reader, err := hub.identify(r, make(http.Header))
+		if err != nil {
+			if !errors.Is(err, ErrSignInRequired) {
+				log.Warn().Err(err).Msg("error identifying chat history reader")
+			}
+			reader = Identity{Guest: true}
+		}
+
+		q := r.URL.Query()
+		limit := 0
+		if l := q.Get("limit"); l != "" {
+			if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		page, err := hub.historyFor(r.Context(), &reader, mux.Vars(r)["room"], q.Get("before"), limit)
+		var perr *ProtocolError
+		switch {
+		case errors.As(err, &perr) && perr.Code == CodeNoSuchRoom:
+			http.Error(w, perr.Msg, http.StatusNotFound)
+			return
+		case errors.As(err, &perr) && perr.Code == CodeSignInRequired:
+			http.Error(w, perr.Msg, http.StatusUnauthorized)
+			return
+		case errors.As(err, &perr):
+			http.Error(w, perr.Msg, http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(page); err != nil {
+			log.Error().Err(err).Msg("error writing chat history")
+		}
+	}
+}
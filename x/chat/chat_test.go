@@ -1,3 +1,247 @@
 package chat
 
-// TODO add test
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aljo242/koch/config"
+	"github.com/aljo242/koch/csrf"
+	"github.com/aljo242/koch/session"
+	"github.com/aljo242/koch/storage"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer runs a hub with the default config behind a test server and
+// returns the WebSocket URL of its default room
+func newTestServer(t *testing.T) (*Hub, string) {
+	t.Helper()
+
+	hub, srv := newTestServerConfig(t, DefaultConfig())
+	return hub, wsURL(srv, "/ws")
+}
+
+// newTestServerConfig serves the chat module routes of a hub running with cfg
+func newTestServerConfig(t *testing.T, cfg Config) (*Hub, *httptest.Server) {
+	t.Helper()
+
+	m, srv := newTestModule(t, cfg, nil)
+	return m.Hub(), srv
+}
+
+// newTestModule starts a chat module with cfg and store, which may be nil, and serves its routes
+func newTestModule(t *testing.T, cfg Config, store storage.Store) (*Module, *httptest.Server) {
+	t.Helper()
+
+	m := NewModule()
+	m.cfg = cfg
+	if store != nil {
+		m.UseStore(store)
+	}
+	sessions := newTestSessions(t)
+	m.UseSessions(sessions)
+
+	r := mux.NewRouter()
+	r.Use(sessions.Middleware)
+	m.Routes(r)
+	require.NoError(t, m.Start(context.Background()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, m.Stop(ctx))
+	})
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return m, srv
+}
+
+// newTestSessions returns a session manager keeping sessions in memory
+func newTestSessions(t *testing.T) *session.Manager {
+	t.Helper()
+
+	cfg := config.Default().Session
+	cfg.Secret = "0123456789abcdef0123456789abcdef"
+	sessions, err := session.New(cfg, false, session.NewMemoryStore())
+	require.NoError(t, err)
+	return sessions
+}
+
+func wsURL(srv *httptest.Server, path string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + path
+}
+
+// waitMembers waits until the room called name has n members
+func waitMembers(t *testing.T, hub *Hub, name string, n int) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		rooms, err := hub.Rooms(context.Background())
+		require.NoError(t, err)
+		for _, r := range rooms {
+			if r.Name == name {
+				return r.Members == n
+			}
+		}
+		return n == 0
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+// dial connects a client, speaking the JSON protocol unless legacy is set
+func dial(t *testing.T, url string, legacy bool) *websocket.Conn {
+	t.Helper()
+
+	dialer := websocket.Dialer{}
+	if !legacy {
+		dialer.Subprotocols = []string{Protocol}
+	}
+	conn, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readType reads envelopes until one of a type in types arrives
+func readType(t *testing.T, conn *websocket.Conn, types ...MessageType) Message {
+	t.Helper()
+
+	for {
+		m := readAny(t, conn)
+		if containsType(types, m.Type) {
+			return m
+		}
+	}
+}
+
+func readAny(t *testing.T, conn *websocket.Conn) Message {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var m Message
+	require.NoError(t, conn.ReadJSON(&m))
+	return m
+}
+
+func containsType(types []MessageType, t MessageType) bool {
+	for _, typ := range types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMultilineMessage(t *testing.T) {
+	t.Parallel()
+	_, url := newTestServer(t)
+
+	alice := dial(t, url, false)
+	joinAs(t, alice, "alice")
+
+	// several queued messages with newlines each arrive intact in their own frame,
+	// and the server renders them to HTML instead of relaying what clients send
+	for _, body := range []string{"line one\nline two", "second\n\nmessage"} {
+		require.NoError(t, alice.WriteJSON(Message{Type: TypeMessage, ID: "c1", Body: body, HTML: "<script>alert(1)</script>"}))
+	}
+	for i, body := range []string{"line one\nline two", "second\n\nmessage"} {
+		ack := readType(t, alice, TypeAck)
+		require.Equal(t, "c1", ack.Metadata[MetaRef])
+
+		m := readType(t, alice, TypeMessage)
+		require.Equal(t, body, m.Body)
+		require.Equal(t, []string{"line one<br>line two", "second<br><br>message"}[i], m.HTML)
+		require.Equal(t, "alice", m.Sender)
+		require.Equal(t, ack.ID, m.ID)
+		require.False(t, m.Timestamp.IsZero())
+	}
+}
+
+func TestLegacyClient(t *testing.T) {
+	t.Parallel()
+	hub, url := newTestServer(t)
+
+	modern := dial(t, url, false)
+	legacy := dial(t, url, true)
+	waitMembers(t, hub, "lobby", 2)
+
+	// plain text from a legacy client becomes a message envelope from its guest name
+	require.NoError(t, legacy.WriteMessage(websocket.TextMessage, []byte("hello there")))
+	m := readType(t, modern, TypeMessage)
+	require.Equal(t, "hello there", m.Body)
+	require.True(t, strings.HasPrefix(m.Sender, "guest-"))
+
+	// legacy clients receive lines of text and no acks or presence
+	for {
+		require.NoError(t, legacy.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, frame, err := legacy.ReadMessage()
+		require.NoError(t, err)
+		if strings.Contains(string(frame), "joined") {
+			continue
+		}
+		require.Equal(t, m.Sender+": hello there", string(frame))
+		break
+	}
+
+	// markup in the lines is escaped, since legacy clients show them as HTML
+	require.NoError(t, modern.WriteJSON(Message{Type: TypeMessage, Body: `<img src=x onerror="alert(1)">`}))
+	for {
+		require.NoError(t, legacy.SetReadDeadline(time.Now().Add(2*time.Second)))
+		_, frame, err := legacy.ReadMessage()
+		require.NoError(t, err)
+		if strings.Contains(string(frame), "img") {
+			require.True(t, strings.HasSuffix(string(frame), ": &lt;img src=x onerror=&#34;alert(1)&#34;&gt;"), string(frame))
+			break
+		}
+	}
+}
+
+func TestServeWsOrigin(t *testing.T) {
+	t.Parallel()
+
+	hub, srv := newTestServerConfig(t, DefaultConfig())
+	dialOrigin := func(url, origin string, jar http.CookieJar) int {
+		dialer := websocket.Dialer{Jar: jar, Subprotocols: []string{Protocol}}
+		conn, resp, err := dialer.Dial(url, http.Header{"Origin": {origin}})
+		if err != nil {
+			require.NotNil(t, resp, err)
+			return resp.StatusCode
+		}
+		conn.Close()
+		return resp.StatusCode
+	}
+
+	// without a csrf.Protector only pages of the same host may connect
+	require.Equal(t, http.StatusSwitchingProtocols, dialOrigin(wsURL(srv, "/ws"), srv.URL, nil))
+	require.Equal(t, http.StatusForbidden, dialOrigin(wsURL(srv, "/ws"), "http://evil.example", nil))
+
+	// behind a Protector its origins are allowed and its token is required
+	serverCfg := config.Default().Server
+	serverCfg.AllowedOrigins = []string{"https://chat.example"}
+	serverCfg.CSRF = true
+	sessions := newTestSessions(t)
+	r := mux.NewRouter()
+	r.Use(sessions.Middleware, csrf.New(serverCfg).Middleware)
+	r.HandleFunc("/csrf", csrf.TokenHandler())
+	r.HandleFunc("/ws", ServeWs(hub))
+	protected := httptest.NewServer(r)
+	t.Cleanup(protected.Close)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	resp, err := (&http.Client{Jar: jar}).Get(protected.URL + "/csrf")
+	require.NoError(t, err)
+	var body struct{ Token string }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	resp.Body.Close()
+
+	ws := wsURL(protected, "/ws")
+	require.Equal(t, http.StatusForbidden, dialOrigin(ws+"?csrf="+body.Token, protected.URL, jar))
+	require.Equal(t, http.StatusForbidden, dialOrigin(ws, "https://chat.example", jar))
+	require.Equal(t, http.StatusSwitchingProtocols, dialOrigin(ws+"?csrf="+body.Token, "https://chat.example", jar))
+}
@@ -0,0 +1,393 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrCommandExists is returned for a command registered under a name that is taken
+var ErrCommandExists = errors.New("command already registered")
+
+// commandNamePattern restricts command names to what can be typed after the slash
+var commandNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// argPattern matches the words of a command line
+var argPattern = regexp.MustCompile(`\S+`)
+
+// Permission is who may run a command
+type Permission int
+
+// Permissions of commands
+const (
+	// PermissionEveryone lets guests and signed in users run a command
+	PermissionEveryone Permission = iota
+
+	// PermissionSignedIn restricts a command to users who signed in to an account
+	PermissionSignedIn
+
+	// PermissionModerator restricts a command to the moderators, see ModerationConfig
+	PermissionModerator
+)
+
+// allows reports whether u may run commands requiring p
+func (p Permission) allows(u *user) bool {
+	switch p {
+	case PermissionSignedIn:
+		return !u.guest
+	case PermissionModerator:
+		return u.moderator
+	default:
+		return true
+	}
+}
+
+// CommandFunc runs a command on the hub goroutine. It must not call the methods of
+// the Hub, which wait for that goroutine; Call has what commands need. An error is
+// reported to the client that sent the command; other than a ProtocolError, its
+// text is shown as is.
+type CommandFunc func(call *Call) error
+
+// Command is a slash command, sent by a client as a room message starting with /
+// and its name. The hub answers every command to the client that sent it alone:
+// with a reply, an error, or an ack if the command does not reply. Commands count
+// as messages to the flood limits, so muted users cannot run them.
+type Command struct {
+	// Name is typed after the slash, in lower case
+	Name string
+
+	// Args describes the arguments in help, such as "<name> [reason]"
+	Args string
+
+	// Help is a short description shown by /help
+	Help string
+
+	// MinArgs and MaxArgs bound the number of arguments. Words past MaxArgs are
+	// part of the last argument, which keeps its spacing, so a command taking text
+	// has it whole in its last argument.
+	MinArgs int
+	MaxArgs int
+
+	// Permission is who may run the command
+	Permission Permission
+
+	Run CommandFunc
+}
+
+// usage returns the synopsis of c
+func (c *Command) usage() string {
+	if c.Args == "" {
+		return "/" + c.Name
+	}
+	return "/" + c.Name + " " + c.Args
+}
+
+// commands is the registry of the commands of a hub
+type commands struct {
+	mu     sync.RWMutex
+	byName map[string]*Command
+}
+
+func (r *commands) add(cmd Command) error {
+	switch {
+	case !commandNamePattern.MatchString(cmd.Name):
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	case cmd.Run == nil:
+		return fmt.Errorf("command /%v has no Run function", cmd.Name)
+	case cmd.MinArgs < 0 || cmd.MaxArgs < cmd.MinArgs:
+		return fmt.Errorf("command /%v must take between MinArgs and MaxArgs arguments", cmd.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.byName == nil {
+		r.byName = make(map[string]*Command)
+	}
+	if _, ok := r.byName[cmd.Name]; ok {
+		return fmt.Errorf("error registering /%v : %w", cmd.Name, ErrCommandExists)
+	}
+	r.byName[cmd.Name] = &cmd
+	return nil
+}
+
+func (r *commands) get(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.byName[name]
+	return cmd, ok
+}
+
+// list returns the commands u may run, sorted by name
+func (r *commands) list(u *user) []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var cmds []*Command
+	for _, cmd := range r.byName {
+		if cmd.Permission.allows(u) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// RegisterCommand adds cmd to the commands of the hub. It may be called while the
+// hub serves connections.
+func (h *Hub) RegisterCommand(cmd Command) error {
+	return h.commands.add(cmd)
+}
+
+// Call is a command being run, valid until its CommandFunc returns
+type Call struct {
+	// Name is the name of the command
+	Name string
+
+	// Args are the arguments of the command, see Command.MaxArgs
+	Args []string
+
+	// Room is the room the command was sent to
+	Room string
+
+	// User is who sent the command
+	User UserInfo
+
+	hub    *Hub
+	client *Client
+	ref    string
+
+	// answered is set once the client was replied to or acked
+	answered bool
+}
+
+// Reply sends body to the client that sent the command
+func (call *Call) Reply(body string) {
+	call.reply(&Message{Body: body})
+}
+
+// reply sends m to the client that sent the command as a reply to it
+func (call *Call) reply(m *Message) {
+	m.Type = TypeReply
+	m.Metadata = withMeta(m.Metadata, MetaCommand, call.Name)
+	if call.ref != "" {
+		m.Metadata[MetaRef] = call.ref
+	}
+	m.stamp()
+	call.hub.deliver(call.client, m)
+	call.answered = true
+}
+
+// Announce sends body as an announcement to the room the command was sent to and
+// adds it to the room's history
+func (call *Call) Announce(body string) error {
+	m, err := call.hub.outgoing(Message{Body: body})
+	if err != nil {
+		return err
+	}
+	r, ok := call.hub.rooms[call.Room]
+	if !ok {
+		return &ProtocolError{Code: CodeNoSuchRoom, Msg: "no room called " + call.Room}
+	}
+	m.Room = call.Room
+	call.hub.record(r, m)
+	call.hub.broadcast(call.Room, m)
+	return nil
+}
+
+// parseArgs splits the arguments of a command line into at most max arguments, the
+// last of which holds the rest of the line
+func parseArgs(line string, max int) []string {
+	words := argPattern.FindAllStringIndex(line, -1)
+	args := make([]string, 0, len(words))
+	for i, w := range words {
+		if i == max-1 && i < len(words)-1 {
+			args = append(args, strings.TrimRightFunc(line[w[0]:], isSpace))
+			break
+		}
+		args = append(args, line[w[0]:w[1]])
+	}
+	return args
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// command runs the slash command in the body of the room message m from c, sent to
+// the room called room, and reports whether m was a command. A body starting with
+// two slashes is sent with one of them instead.
+func (h *Hub) command(c *Client, m *Message, room string) bool {
+	line := strings.TrimLeftFunc(m.Body, isSpace)
+	if !strings.HasPrefix(line, "/") {
+		return false
+	}
+	if strings.HasPrefix(line, "//") {
+		m.Body = line[1:]
+		return false
+	}
+
+	ref := m.ID
+	name := line[1:]
+	rest := ""
+	if i := strings.IndexFunc(name, isSpace); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	name = strings.ToLower(name)
+
+	cmd, ok := h.commands.get(name)
+	if !ok {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeUnknownCommand, Msg: "unknown command /" + name + ", see /help", Ref: ref}))
+		return true
+	}
+	if !cmd.Permission.allows(c.user) {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeForbidden, Msg: "you may not use /" + name, Ref: ref}))
+		return true
+	}
+	args := parseArgs(rest, cmd.MaxArgs)
+	if len(args) < cmd.MinArgs || len(args) > cmd.MaxArgs {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeInvalidMessage, Msg: "usage: " + cmd.usage(), Ref: ref}))
+		return true
+	}
+
+	call := &Call{Name: name, Args: args, Room: room, User: c.user.info(), hub: h, client: c, ref: ref}
+	if err := cmd.Run(call); err != nil {
+		var perr *ProtocolError
+		if !errors.As(err, &perr) {
+			err = &ProtocolError{Code: CodeCommandFailed, Msg: err.Error()}
+		}
+		h.deliver(c, errorMessage(withRef(err, ref)))
+		return true
+	}
+	if !call.answered {
+		h.deliver(c, ackMessage(ref, ""))
+	}
+	return true
+}
+
+// builtinCommands returns the commands every hub has
+func builtinCommands() []Command {
+	cmds := []Command{
+		{Name: "help", Args: "[command]", Help: "list the commands you may use, or describe one", MaxArgs: 1, Run: runHelp},
+		{Name: "nick", Args: "<name>", Help: "change your nickname", MinArgs: 1, MaxArgs: 1, Run: runNick},
+		{Name: "me", Args: "<action>", Help: "describe what you are doing, as in /me waves", MinArgs: 1, MaxArgs: 1, Run: runMe},
+		{Name: "who", Args: "[room]", Help: "list the users in this room or another one you are in", MaxArgs: 1, Run: runWho},
+		{Name: "join", Args: "<room>", Help: "join a room, which receives your messages from then on", MinArgs: 1, MaxArgs: 1, Run: runJoin},
+		{Name: "leave", Args: "[room]", Help: "leave this room or another one", MaxArgs: 1, Run: runLeave},
+		{Name: "msg", Args: "<name|user id> <text>", Help: "send a private message", MinArgs: 2, MaxArgs: 2, Run: runMsg},
+	}
+	return append(cmds, moderationCommands()...)
+}
+
+func runHelp(call *Call) error {
+	h := call.hub
+	if len(call.Args) == 1 {
+		name := strings.ToLower(strings.TrimPrefix(call.Args[0], "/"))
+		cmd, ok := h.commands.get(name)
+		if !ok || !cmd.Permission.allows(call.client.user) {
+			return &ProtocolError{Code: CodeUnknownCommand, Msg: "unknown command /" + name}
+		}
+		call.Reply(cmd.usage() + ": " + cmd.Help)
+		return nil
+	}
+
+	lines := []string{"Commands (start a message with // to send it as is):"}
+	for _, cmd := range h.commands.list(call.client.user) {
+		lines = append(lines, cmd.usage()+": "+cmd.Help)
+	}
+	call.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+func runNick(call *Call) error {
+	u := call.client.user
+	if err := call.hub.rename(u, call.Args[0], call.Room); err != nil {
+		return err
+	}
+	call.Reply("you are now known as " + u.name)
+	return nil
+}
+
+func runMe(call *Call) error {
+	m := &Message{Type: TypeMessage, ID: call.ref, Body: call.Args[0]}
+	call.hub.say(call.client, m, call.Room, true)
+	call.answered = true
+	return nil
+}
+
+func runWho(call *Call) error {
+	room := call.Room
+	if len(call.Args) == 1 {
+		var ok bool
+		if room, ok = roomName(call.Args[0]); !ok {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid room name"}
+		}
+	}
+	if _, ok := call.hub.rooms[room]; !ok {
+		return &ProtocolError{Code: CodeNoSuchRoom, Msg: "no room called " + room}
+	}
+	if !call.client.rooms[room] {
+		return &ProtocolError{Code: CodeForbidden, Msg: "join room " + room + " to see who is in it"}
+	}
+
+	snapshot := call.hub.snapshot(room)
+	names := make([]string, len(snapshot.Users))
+	for i, u := range snapshot.Users {
+		names[i] = u.Name
+	}
+	call.reply(&Message{Room: room, Users: snapshot.Users, Body: strconv.Itoa(len(names)) + " in " + room + ": " + strings.Join(names, ", ")})
+	return nil
+}
+
+func runJoin(call *Call) error {
+	room, ok := roomName(call.Args[0])
+	if !ok {
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid room name"}
+	}
+	if err := call.hub.enter(call.client, room, "", call.ref); err != nil {
+		return err
+	}
+	call.answered = call.ref != ""
+	return nil
+}
+
+func runLeave(call *Call) error {
+	room := call.Room
+	if len(call.Args) == 1 {
+		var ok bool
+		if room, ok = roomName(call.Args[0]); !ok {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid room name"}
+		}
+	}
+	if err := call.hub.depart(call.client, room, call.ref); err != nil {
+		return err
+	}
+	call.answered = call.ref != ""
+	return nil
+}
+
+func runMsg(call *Call) error {
+	h := call.hub
+	to := ""
+	for _, u := range h.users {
+		if strings.EqualFold(u.name, call.Args[0]) || u.id == call.Args[0] {
+			to = u.id
+			break
+		}
+	}
+	if to == "" {
+		if !strings.HasPrefix(call.Args[0], "u-") && !strings.HasPrefix(call.Args[0], "g-") {
+			return &ProtocolError{Code: CodeNoSuchUser, Msg: "no user called " + call.Args[0]}
+		}
+		to = call.Args[0] // offline users are addressed by id
+	}
+
+	m := &Message{Type: TypeDirect, ID: call.ref, To: to, Body: call.Args[1]}
+	if ok, flagged := h.filter(call.client, m); ok && h.direct(call.client, m) && flagged {
+		h.flag(m)
+	}
+	call.answered = true
+	return nil
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseArgs(t *testing.T) {
+	t.Parallel()
+
+	require.Empty(t, parseArgs("  ", 2))
+	require.Equal(t, []string{"a", "b", "c"}, parseArgs(" a  b c ", 5))
+	require.Equal(t, []string{"bob", "hi  there\nbob"}, parseArgs(" bob hi  there\nbob\n", 2))
+	require.Equal(t, []string{"a", "b"}, parseArgs("a b", 0), "too many arguments are left for the caller to reject")
+}
+
+func TestCommands(t *testing.T) {
+	t.Parallel()
+	cfg := DefaultConfig()
+	cfg.Flood.Rate, cfg.Flood.UserRate = 0, 0
+	hub, srv := newTestServerConfig(t, cfg)
+	url := wsURL(srv, "/ws")
+
+	require.NoError(t, hub.RegisterCommand(Command{
+		Name:    "roll",
+		Args:    "[sides]",
+		Help:    "roll a die",
+		MaxArgs: 1,
+		Run: func(call *Call) error {
+			if len(call.Args) == 1 && call.Args[0] == "0" {
+				return errors.New("a die needs sides")
+			}
+			return call.Announce(call.User.Name + " rolled a 4")
+		},
+	}))
+	require.ErrorIs(t, hub.RegisterCommand(Command{Name: "roll", Run: func(*Call) error { return nil }}), ErrCommandExists)
+	require.Error(t, hub.RegisterCommand(Command{Name: "Bad Name", Run: func(*Call) error { return nil }}))
+
+	alice := dial(t, url, false)
+	aliceID := joinAs(t, alice, "alice")
+	bob := dial(t, url, false)
+	joinAs(t, bob, "bob")
+
+	// help lists the commands a user may run, and replies go to the sender alone
+	help := command(t, alice, "c1", "/help")
+	require.Equal(t, TypeReply, help.Type)
+	require.Equal(t, "help", help.Metadata[MetaCommand])
+	require.Contains(t, help.Body, "/msg <name|user id> <text>: send a private message")
+	require.Contains(t, help.Body, "/roll [sides]: roll a die")
+	require.NotContains(t, help.Body, "/ban")
+	require.Equal(t, CodeUnknownCommand, command(t, alice, "c2", "/help ban").Metadata[MetaCode])
+	require.Equal(t, CodeUnknownCommand, command(t, alice, "c3", "/dance").Metadata[MetaCode])
+	require.Equal(t, CodeForbidden, command(t, alice, "c4", "/ban bob").Metadata[MetaCode])
+	require.Equal(t, CodeInvalidMessage, command(t, alice, "c5", "/msg bob").Metadata[MetaCode])
+
+	require.Equal(t, "you are now known as Alice Liddell", command(t, alice, "c6", "/nick Alice Liddell").Body)
+	for {
+		// skip the snapshot bob got on joining
+		if m := readType(t, bob, TypePresence); m.Users == nil {
+			require.Equal(t, "Alice Liddell", m.Sender)
+			break
+		}
+	}
+
+	who := command(t, alice, "c7", "/who")
+	require.Equal(t, TypeReply, who.Type)
+	require.Len(t, who.Users, 2)
+	require.Equal(t, "2 in lobby: Alice Liddell, bob", who.Body)
+
+	require.Equal(t, TypeAck, command(t, alice, "c8", "/me waves").Type)
+	m := readType(t, bob, TypeMessage)
+	require.Equal(t, "waves", m.Body)
+	require.Equal(t, "true", m.Metadata[MetaAction])
+
+	require.Equal(t, CodeNoSuchUser, command(t, bob, "c9", "/msg alice hi").Metadata[MetaCode], "names with spaces need the user id")
+	require.Equal(t, TypeAck, command(t, bob, "c10", "/msg "+aliceID+" psst  there").Type)
+	m = readType(t, alice, TypeDirect)
+	require.Equal(t, "psst  there", m.Body)
+
+	// a double slash sends the message as is
+	require.Equal(t, TypeAck, command(t, alice, "c11", "//help is not a command").Type)
+	require.Equal(t, "/help is not a command", readType(t, bob, TypeMessage).Body)
+
+	require.Equal(t, TypeAck, command(t, alice, "c12", "/join games").Type)
+	require.Equal(t, "games", readType(t, alice, TypeJoin).Room)
+	require.Equal(t, TypeAck, command(t, bob, "b1", "/join games").Type)
+	require.Equal(t, TypeAck, command(t, alice, "c13", "/roll").Type)
+	m = readType(t, bob, TypeAnnouncement)
+	require.Equal(t, "games", m.Room, "messages go to the room joined last")
+	require.Equal(t, "Alice Liddell rolled a 4", m.Body)
+	failed := command(t, alice, "c14", "/roll 0")
+	require.Equal(t, CodeCommandFailed, failed.Metadata[MetaCode])
+	require.Equal(t, "a die needs sides", failed.Body)
+	require.Equal(t, TypeAck, command(t, alice, "c15", "/leave games").Type)
+	waitMembers(t, hub, "games", 1)
+	require.Equal(t, CodeForbidden, command(t, alice, "c18", "/who games").Metadata[MetaCode], "only members see who is in a room")
+	require.Equal(t, CodeNotMember, command(t, alice, "c16", "/leave games").Metadata[MetaCode])
+	require.Equal(t, CodeNoSuchRoom, command(t, alice, "c17", "/who nowhere").Metadata[MetaCode])
+}
@@ -0,0 +1,483 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aljo242/koch/account"
+	"github.com/aljo242/koch/config"
+)
+
+// roomNamePattern restricts room names to something safe to show and to put in URLs
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// roomName normalises a room name, which is case insensitive like every config key,
+// and reports whether it is valid
+func roomName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return name, roomNamePattern.MatchString(name)
+}
+
+// Config holds the chat specific settings of the [modules.chat] section
+type Config struct {
+	// DefaultRoom is joined by clients that do not ask for a room
+	DefaultRoom string `mapstructure:"defaultRoom"`
+
+	// MaxRoomsPerClient limits how many rooms one connection may be in, 0 for no limit
+	MaxRoomsPerClient int `mapstructure:"maxRoomsPerClient"`
+
+	// AllowCreate lets clients create rooms that are not listed in Rooms
+	AllowCreate bool `mapstructure:"allowCreate"`
+
+	// RoomDefaults applies to rooms created by clients
+	RoomDefaults RoomConfig `mapstructure:"roomDefaults"`
+
+	// Rooms lists the rooms that exist from the start, keyed by name
+	Rooms map[string]RoomConfig `mapstructure:"rooms"`
+
+	// Anonymous lets guests chat without an account. Without it every connection must be signed in.
+	Anonymous bool `mapstructure:"anonymous"`
+
+	// Accounts configures sign up and sign in for the chat
+	Accounts account.Config `mapstructure:"accounts"`
+
+	// OfflineQueue is the number of direct messages kept for a user who is offline,
+	// delivered when they next join. 0 reports offline users to the sender instead.
+	OfflineQueue int `mapstructure:"offlineQueue"`
+
+	// OfflineTTL is how long queued direct messages are kept and how long users who
+	// went offline can still be sent them
+	OfflineTTL time.Duration `mapstructure:"offlineTTL"`
+
+	// OfflineUsers is the number of offline users that may have messages queued at once
+	OfflineUsers int `mapstructure:"offlineUsers"`
+
+	// History configures the messages kept for each room
+	History HistoryConfig `mapstructure:"history"`
+
+	// Resume configures how reconnecting clients catch up with the messages they missed
+	Resume ResumeConfig `mapstructure:"resume"`
+
+	// Connection configures the WebSocket connections of the hub. They are set up
+	// before joining any room, so these settings cannot vary per room.
+	Connection ConnectionConfig `mapstructure:"connection"`
+
+	// Flood limits how fast clients may send, see FloodConfig
+	Flood FloodConfig `mapstructure:"flood"`
+
+	// SlowClients sets what happens to clients that do not read their messages fast enough
+	SlowClients SlowClientConfig `mapstructure:"slowClients"`
+
+	// Moderation configures moderators, word filters and the moderation log
+	Moderation ModerationConfig `mapstructure:"moderation"`
+
+	// Format is how message bodies are rendered to HTML: text, which only links URLs,
+	// or markdown, which also renders a small subset of Markdown
+	Format string `mapstructure:"format"`
+}
+
+// Filter actions, taken on a message that a filter matches
+const (
+	// FilterMask replaces every match with asterisks
+	FilterMask = "mask"
+
+	// FilterReject rejects the message
+	FilterReject = "reject"
+
+	// FilterFlag sends the message and reports it to the moderators
+	FilterFlag = "flag"
+)
+
+// ModerationConfig holds the moderation settings of the hub
+type ModerationConfig struct {
+	// Moderators lists the account names of the users who may kick, ban and mute
+	// others. Guests are never moderators.
+	Moderators []string `mapstructure:"moderators"`
+
+	// Filters apply in order to the body of every room and direct message
+	Filters []FilterConfig `mapstructure:"filters"`
+
+	// LogSize is the number of moderation log entries kept in memory. With a store
+	// every entry is also stored, along with bans and mutes.
+	LogSize int `mapstructure:"logSize"`
+}
+
+// FilterConfig holds a word filter, which matches any of Words or Pattern
+type FilterConfig struct {
+	// Words are matched as whole words, ignoring case
+	Words []string `mapstructure:"words"`
+
+	// Pattern is a regular expression in the syntax of the regexp package
+	Pattern string `mapstructure:"pattern"`
+
+	// Action is one of mask, reject or flag
+	Action string `mapstructure:"action"`
+}
+
+// Slow client policies, applied to a message for a client whose send buffer is full
+const (
+	// PolicyDisconnect closes the connection, which can then be resumed
+	PolicyDisconnect = "disconnect"
+
+	// PolicyDropOldest drops the oldest queued message to make room
+	PolicyDropOldest = "dropOldest"
+
+	// PolicyDropNewest drops the message
+	PolicyDropNewest = "dropNewest"
+
+	// PolicyCoalesce keeps only the latest of the queued presence updates of each
+	// user and room, dropping the oldest messages if that is not enough
+	PolicyCoalesce = "coalesce"
+)
+
+// SlowClientConfig holds the backpressure settings of the hub
+type SlowClientConfig struct {
+	// Policy is one of disconnect, dropOldest, dropNewest or coalesce. Clients that
+	// lost messages are told so once they catch up, and can page through history
+	// for the sequence numbers they missed.
+	Policy string `mapstructure:"policy"`
+
+	// MaxDropped disconnects a client that had this many messages dropped in a row, 0 for no limit
+	MaxDropped int `mapstructure:"maxDropped"`
+}
+
+// ConnectionConfig holds the settings of each WebSocket connection
+type ConnectionConfig struct {
+	// MaxMessageSize is the largest frame read from a client in bytes, the body plus
+	// the JSON envelope. Larger frames close the connection.
+	MaxMessageSize int64 `mapstructure:"maxMessageSize"`
+
+	// PongWait is how long a connection may go without answering a ping. Pings are
+	// sent every nine tenths of it.
+	PongWait time.Duration `mapstructure:"pongWait"`
+
+	// WriteWait is the time allowed to write a message to a client
+	WriteWait time.Duration `mapstructure:"writeWait"`
+
+	// SendBuffer is the number of messages queued for a client before it is dropped as too slow
+	SendBuffer int `mapstructure:"sendBuffer"`
+}
+
+// FloodConfig holds the rate limits of clients. Message rates are token buckets
+// refilled at Rate per second and holding up to Burst messages; 0 turns a limit off.
+// Every message over a limit is rejected and counts as a strike against its user,
+// and strikes escalate from a warning to throttling the connection, muting the
+// user and finally disconnecting the connection.
+type FloodConfig struct {
+	// Rate and Burst limit the messages of each connection
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+
+	// UserRate and UserBurst limit the messages of a user across all their connections
+	UserRate  float64 `mapstructure:"userRate"`
+	UserBurst int     `mapstructure:"userBurst"`
+
+	// ByteRate and ByteBurst limit the bytes read from each connection, catching
+	// bursts of oversized messages that stay under the message rate
+	ByteRate  int `mapstructure:"byteRate"`
+	ByteBurst int `mapstructure:"byteBurst"`
+
+	// Duplicates is the number of times a user may send the same body in a row within
+	// DuplicateWindow, 0 for no limit
+	Duplicates      int           `mapstructure:"duplicates"`
+	DuplicateWindow time.Duration `mapstructure:"duplicateWindow"`
+
+	// ThrottleAfter, MuteAfter and DisconnectAfter are the strikes at which each
+	// response starts, 0 to skip it. Fewer strikes only get a warning.
+	ThrottleAfter   int `mapstructure:"throttleAfter"`
+	MuteAfter       int `mapstructure:"muteAfter"`
+	DisconnectAfter int `mapstructure:"disconnectAfter"`
+
+	// Throttle is how long a throttled connection is not read from after each strike
+	Throttle time.Duration `mapstructure:"throttle"`
+
+	// MuteFor is how long a muted user may not send messages
+	MuteFor time.Duration `mapstructure:"muteFor"`
+
+	// StrikeDecay forgets the strikes of a user who has not had one for this long
+	StrikeDecay time.Duration `mapstructure:"strikeDecay"`
+}
+
+// ResumeConfig holds the settings of resuming connections
+type ResumeConfig struct {
+	// TTL is how long a closed connection can be resumed, 0 to not hand out resume tokens
+	TTL time.Duration `mapstructure:"ttl"`
+
+	// MaxGap is the largest number of missed messages of a room replayed to a resuming
+	// client. Clients that missed more are told to resync.
+	MaxGap int `mapstructure:"maxGap"`
+}
+
+// HistoryConfig holds the settings of room history
+type HistoryConfig struct {
+	// Size is the number of recent messages of each room kept in memory, 0 to keep none
+	Size int `mapstructure:"size"`
+
+	// Replay is the number of recent messages sent to a client when it joins a room, at most Size
+	Replay int `mapstructure:"replay"`
+
+	// PageSize limits the number of messages in one history page
+	PageSize int `mapstructure:"pageSize"`
+
+	// Persist writes the messages of every room to the module store, so history
+	// outlives empty rooms and restarts
+	Persist bool `mapstructure:"persist"`
+
+	// Retention is the number of stored messages kept per room, 0 for no limit
+	Retention int `mapstructure:"retention"`
+
+	// MaxAge removes stored messages older than this, 0 to keep them
+	MaxAge time.Duration `mapstructure:"maxAge"`
+}
+
+// RoomConfig holds the settings of a single room
+type RoomConfig struct {
+	// MaxMembers limits the number of connections in the room, 0 for no limit
+	MaxMembers int `mapstructure:"maxMembers"`
+
+	// Persistent rooms are kept when their last member leaves
+	Persistent bool `mapstructure:"persistent"`
+
+	// Authenticated rooms may only be joined by signed in users
+	Authenticated bool `mapstructure:"authenticated"`
+
+	// SlowMode is the time each user must wait between messages to the room, 0 for none
+	SlowMode time.Duration `mapstructure:"slowMode"`
+}
+
+// DefaultConfig returns the settings used for keys missing from [modules.chat]
+func DefaultConfig() Config {
+	return Config{
+		DefaultRoom:       "lobby",
+		MaxRoomsPerClient: 8,
+		AllowCreate:       true,
+		Anonymous:         true,
+		OfflineTTL:        7 * 24 * time.Hour,
+		OfflineUsers:      1000,
+		Accounts:          account.DefaultConfig(),
+		RoomDefaults:      RoomConfig{MaxMembers: 100},
+		Rooms: map[string]RoomConfig{
+			"lobby": {Persistent: true},
+		},
+		History: HistoryConfig{
+			Size:      200,
+			Replay:    50,
+			PageSize:  100,
+			Retention: 10000,
+		},
+		Resume: ResumeConfig{
+			TTL:    2 * time.Minute,
+			MaxGap: 200,
+		},
+		Connection: ConnectionConfig{
+			MaxMessageSize: maxBodyLength + 2048,
+			PongWait:       60 * time.Second,
+			WriteWait:      10 * time.Second,
+			SendBuffer:     256,
+		},
+		Flood: FloodConfig{
+			Rate:            5,
+			Burst:           10,
+			UserRate:        8,
+			UserBurst:       16,
+			ByteRate:        16 << 10,
+			ByteBurst:       64 << 10,
+			Duplicates:      3,
+			DuplicateWindow: 30 * time.Second,
+			ThrottleAfter:   3,
+			MuteAfter:       6,
+			DisconnectAfter: 10,
+			Throttle:        2 * time.Second,
+			MuteFor:         time.Minute,
+			StrikeDecay:     time.Minute,
+		},
+		SlowClients: SlowClientConfig{
+			Policy:     PolicyDisconnect,
+			MaxDropped: 1000,
+		},
+		Moderation: ModerationConfig{
+			LogSize: 500,
+		},
+		Format: FormatMarkdown,
+	}
+}
+
+// Validate checks the room names and limits
+func (c *Config) Validate() error {
+	verr := &config.ValidationError{}
+	add := func(key, msg string) {
+		verr.Errors = append(verr.Errors, config.FieldError{Key: key, Msg: msg})
+	}
+
+	if name, ok := roomName(c.DefaultRoom); !ok {
+		add("defaultRoom", fmt.Sprintf("invalid room name %q", c.DefaultRoom))
+	} else if _, ok := c.Rooms[name]; !ok {
+		add("defaultRoom", fmt.Sprintf("room %q is not listed in rooms", c.DefaultRoom))
+	}
+	if c.MaxRoomsPerClient < 0 {
+		add("maxRoomsPerClient", "must not be negative")
+	}
+	if c.OfflineQueue < 0 {
+		add("offlineQueue", "must not be negative")
+	}
+	if c.OfflineQueue > 0 && c.OfflineTTL <= 0 {
+		add("offlineTTL", "must be positive when offlineQueue is set")
+	}
+	if c.OfflineQueue > 0 && c.OfflineUsers < 1 {
+		add("offlineUsers", "must be positive when offlineQueue is set")
+	}
+	var aerr *config.ValidationError
+	if errors.As(c.Accounts.Validate(), &aerr) {
+		for _, fe := range aerr.Errors {
+			add("accounts."+fe.Key, fe.Msg)
+		}
+	}
+	if c.History.Size < 0 {
+		add("history.size", "must not be negative")
+	}
+	if c.History.Replay < 0 || c.History.Replay > c.History.Size {
+		add("history.replay", fmt.Sprintf("must be between 0 and history.size (%v)", c.History.Size))
+	}
+	if c.History.PageSize < 1 {
+		add("history.pageSize", "must be at least 1")
+	}
+	if c.History.Retention < 0 {
+		add("history.retention", "must not be negative")
+	}
+	if c.History.MaxAge < 0 {
+		add("history.maxAge", "must not be negative")
+	}
+	if c.Resume.TTL < 0 {
+		add("resume.ttl", "must not be negative")
+	}
+	if c.Resume.MaxGap < 0 {
+		add("resume.maxGap", "must not be negative")
+	}
+	c.Connection.validate(add)
+	c.Flood.validate(c.Connection, add)
+	switch c.SlowClients.Policy {
+	case PolicyDisconnect, PolicyDropOldest, PolicyDropNewest, PolicyCoalesce:
+	default:
+		add("slowClients.policy", fmt.Sprintf("must be one of %v, %v, %v or %v", PolicyDisconnect, PolicyDropOldest, PolicyDropNewest, PolicyCoalesce))
+	}
+	if c.SlowClients.MaxDropped < 0 {
+		add("slowClients.maxDropped", "must not be negative")
+	}
+	c.Moderation.validate(add)
+	if c.Format != FormatText && c.Format != FormatMarkdown {
+		add("format", fmt.Sprintf("must be %v or %v", FormatText, FormatMarkdown))
+	}
+	if c.RoomDefaults.MaxMembers < 0 {
+		add("roomDefaults.maxMembers", "must not be negative")
+	}
+	if c.RoomDefaults.SlowMode < 0 {
+		add("roomDefaults.slowMode", "must not be negative")
+	}
+
+	names := make([]string, 0, len(c.Rooms))
+	for name := range c.Rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := roomName(name); !ok || name != strings.ToLower(name) {
+			add("rooms."+name, "invalid room name")
+		}
+		if c.Rooms[name].MaxMembers < 0 {
+			add("rooms."+name+".maxMembers", "must not be negative")
+		}
+		if c.Rooms[name].SlowMode < 0 {
+			add("rooms."+name+".slowMode", "must not be negative")
+		}
+	}
+
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// validate checks the connection settings
+func (c *ConnectionConfig) validate(add func(key, msg string)) {
+	if c.MaxMessageSize < 512 {
+		add("connection.maxMessageSize", "must be at least 512")
+	}
+	if c.PongWait < time.Second {
+		add("connection.pongWait", "must be at least 1s")
+	}
+	if c.WriteWait <= 0 {
+		add("connection.writeWait", "must be positive")
+	}
+	if c.SendBuffer < 1 {
+		add("connection.sendBuffer", "must be at least 1")
+	}
+}
+
+// validate checks the rate limits, whose byte burst must fit the largest message of conn
+func (f *FloodConfig) validate(conn ConnectionConfig, add func(key, msg string)) {
+	bucket := func(key string, rate float64, burst int) {
+		if rate < 0 {
+			add("flood."+key+"Rate", "must not be negative")
+		}
+		if rate > 0 && burst < 1 {
+			add("flood."+key+"Burst", "must be at least 1")
+		}
+	}
+	bucket("", f.Rate, f.Burst)
+	bucket("user", f.UserRate, f.UserBurst)
+	bucket("byte", float64(f.ByteRate), f.ByteBurst)
+	if f.ByteRate > 0 && int64(f.ByteBurst) < conn.MaxMessageSize {
+		add("flood.byteBurst", fmt.Sprintf("must be at least connection.maxMessageSize (%v)", conn.MaxMessageSize))
+	}
+	if f.Duplicates < 0 {
+		add("flood.duplicates", "must not be negative")
+	}
+	if f.Duplicates > 0 && f.DuplicateWindow <= 0 {
+		add("flood.duplicateWindow", "must be positive")
+	}
+	if f.ThrottleAfter < 0 {
+		add("flood.throttleAfter", "must not be negative")
+	}
+	if f.MuteAfter < 0 {
+		add("flood.muteAfter", "must not be negative")
+	}
+	if f.DisconnectAfter < 0 {
+		add("flood.disconnectAfter", "must not be negative")
+	}
+	if f.ThrottleAfter > 0 && f.Throttle <= 0 {
+		add("flood.throttle", "must be positive")
+	}
+	if f.MuteAfter > 0 && f.MuteFor <= 0 {
+		add("flood.muteFor", "must be positive")
+	}
+	if f.StrikeDecay <= 0 {
+		add("flood.strikeDecay", "must be positive")
+	}
+}
+
+// validate checks the log size and compiles the filters
+func (m *ModerationConfig) validate(add func(key, msg string)) {
+	if m.LogSize < 0 {
+		add("moderation.logSize", "must not be negative")
+	}
+	for i, f := range m.Filters {
+		key := fmt.Sprintf("moderation.filters.%v", i)
+		switch f.Action {
+		case FilterMask, FilterReject, FilterFlag:
+		default:
+			add(key+".action", fmt.Sprintf("must be one of %v, %v or %v", FilterMask, FilterReject, FilterFlag))
+		}
+		if len(f.Words) == 0 && f.Pattern == "" {
+			add(key, "needs words or a pattern")
+		}
+		if _, err := f.compile(); errors.Is(err, errBlankWord) {
+			add(key+".words", err.Error())
+		} else if err != nil {
+			add(key+".pattern", err.Error())
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package chat
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+)
+
+// filter is a compiled FilterConfig
+type filter struct {
+	re     *regexp.Regexp
+	action string
+}
+
+// errBlankWord is returned for a filter with a blank word, which would match everywhere
+var errBlankWord = errors.New("words must not be blank")
+
+// compile returns a regular expression matching any of the words of f, ignoring
+// case, or its pattern
+func (f FilterConfig) compile() (*regexp.Regexp, error) {
+	var alts []string
+	if len(f.Words) > 0 {
+		words := make([]string, len(f.Words))
+		for i, w := range f.Words {
+			if strings.TrimSpace(w) == "" {
+				return nil, errBlankWord
+			}
+			words[i] = regexp.QuoteMeta(strings.TrimSpace(w))
+		}
+		alts = append(alts, `(?i:\b(?:`+strings.Join(words, "|")+`)\b)`)
+	}
+	if f.Pattern != "" {
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			return nil, err
+		}
+		alts = append(alts, "(?:"+f.Pattern+")")
+	}
+	return regexp.Compile(strings.Join(alts, "|"))
+}
+
+// compileFilters compiles the filters of cfg, skipping those that do not compile,
+// which Validate reports
+func compileFilters(cfg []FilterConfig) []filter {
+	filters := make([]filter, 0, len(cfg))
+	for i, f := range cfg {
+		re, err := f.compile()
+		if err != nil {
+			log.Error().Err(err).Int("filter", i).Msg("skipping invalid chat filter")
+			continue
+		}
+		filters = append(filters, filter{re: re, action: f.Action})
+	}
+	return filters
+}
+
+// applyFilters runs filters over body, returning it with the matches of mask filters
+// replaced, and whether a reject or flag filter matched it
+func applyFilters(filters []filter, body string) (masked string, reject, flag bool) {
+	for _, f := range filters {
+		if !f.re.MatchString(body) {
+			continue
+		}
+		switch f.action {
+		case FilterReject:
+			reject = true
+		case FilterFlag:
+			flag = true
+		case FilterMask:
+			body = f.re.ReplaceAllStringFunc(body, func(match string) string {
+				return strings.Repeat("*", utf8.RuneCountInString(match))
+			})
+		}
+	}
+	return body, reject, flag
+}
@@ -0,0 +1,206 @@
+package chat
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// bucket is a token bucket, owned by the hub goroutine
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens from a bucket refilled at rate per second up to burst, and
+// reports whether there were enough. A rate of 0 never limits.
+func (b *bucket) take(now time.Time, rate float64, burst int, n float64) bool {
+	if rate <= 0 {
+		return true
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if b.tokens += now.Sub(b.last).Seconds() * rate; b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// limiter holds the flood state of a user. It outlives the user's connections
+// until its strikes decay and any mute ends, so reconnecting does not reset it.
+type limiter struct {
+	rate bucket
+
+	// strikes counts the violations since lastStrike minus StrikeDecay
+	strikes    int
+	lastStrike time.Time
+
+	mutedUntil time.Time
+
+	// last is the body of the user's last message, repeated repeats times, the last at lastAt
+	last    string
+	repeats int
+	lastAt  time.Time
+
+	// sent is when the user last sent to each room, for slow mode
+	sent map[string]time.Time
+}
+
+// idle reports whether l holds nothing that must be kept at now
+func (l *limiter) idle(now time.Time, f FloodConfig) bool {
+	return now.After(l.mutedUntil) && now.Sub(l.lastStrike) > f.StrikeDecay
+}
+
+// duplicate records a message with body and reports whether the body was repeated too often
+func (l *limiter) duplicate(now time.Time, body string, f FloodConfig) bool {
+	if f.Duplicates == 0 {
+		return false
+	}
+	if body == l.last && now.Sub(l.lastAt) < f.DuplicateWindow {
+		l.repeats++
+	} else {
+		l.last, l.repeats = body, 1
+	}
+	l.lastAt = now
+	return l.repeats > f.Duplicates
+}
+
+// limiter returns the flood state of the user id, forgetting idle users
+func (h *Hub) limiter(id string, now time.Time) *limiter {
+	if l, ok := h.limits[id]; ok {
+		return l
+	}
+	for uid, l := range h.limits {
+		if _, online := h.users[uid]; !online && l.idle(now, h.cfg.Flood) {
+			delete(h.limits, uid)
+		}
+	}
+	l := &limiter{sent: make(map[string]time.Time)}
+	h.limits[id] = l
+	return l
+}
+
+// admit applies the flood limits to a frame of size bytes read from c, carrying m
+// unless it could not be decoded. It reports whether the frame may be handled,
+// and rejects it otherwise.
+func (h *Hub) admit(c *Client, m *Message, size int) bool {
+	f := h.cfg.Flood
+	now := time.Now()
+	l := h.limiter(c.user.id, now)
+	ref := ""
+	if m != nil {
+		ref = m.ID
+	}
+
+	var reason string
+	switch {
+	case !c.rate.take(now, f.Rate, f.Burst, 1), !l.rate.take(now, f.UserRate, f.UserBurst, 1):
+		reason = "sending too fast"
+	case !c.bytes.take(now, float64(f.ByteRate), f.ByteBurst, float64(size)):
+		reason = "sending too much"
+	case m != nil && (m.Type == TypeMessage || m.Type == TypeDirect) && l.duplicate(now, m.Body, f):
+		reason = "repeating the same message"
+	}
+	if reason != "" {
+		h.strike(c, l, now, reason, ref)
+		return false
+	}
+
+	if m == nil || (m.Type != TypeMessage && m.Type != TypeDirect) {
+		return true
+	}
+	if now.Before(l.mutedUntil) {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeMuted, Msg: fmt.Sprintf("muted for %v", l.mutedUntil.Sub(now).Round(time.Second)), Ref: ref}))
+		return false
+	}
+	if s := h.sanctioned(ActionMute, c, now); s != nil {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeMuted, Msg: s.describe(now), Ref: ref}))
+		return false
+	}
+	if m.Type == TypeMessage {
+		name := c.room
+		if m.Room != "" {
+			name, _ = roomName(m.Room) // checked by handle
+		}
+		if r, ok := h.rooms[name]; ok && r.cfg.SlowMode > 0 && c.rooms[name] {
+			if wait := l.sent[name].Add(r.cfg.SlowMode).Sub(now); wait > 0 {
+				h.deliver(c, errorMessage(&ProtocolError{Code: CodeSlowMode, Msg: fmt.Sprintf("slow mode is on in %v, wait %v", name, wait.Round(time.Second)), Ref: ref}))
+				return false
+			}
+			l.sent[name] = now
+		}
+	}
+	return true
+}
+
+// strike responds to a flood violation of c, escalating with the strikes of its user
+func (h *Hub) strike(c *Client, l *limiter, now time.Time, reason, ref string) {
+	f := h.cfg.Flood
+	if now.Sub(l.lastStrike) > f.StrikeDecay {
+		l.strikes = 0
+	}
+	l.strikes++
+	l.lastStrike = now
+
+	action := "warn"
+	switch {
+	case f.DisconnectAfter > 0 && l.strikes >= f.DisconnectAfter:
+		action = "disconnect"
+	case f.MuteAfter > 0 && l.strikes >= f.MuteAfter:
+		action = "mute"
+	case f.ThrottleAfter > 0 && l.strikes >= f.ThrottleAfter:
+		action = "throttle"
+	}
+	log.Warn().
+		Str("user", c.user.id).
+		Str("reason", reason).
+		Int("strikes", l.strikes).
+		Str("action", action).
+		Msg("chat flood limit")
+
+	switch action {
+	case "disconnect":
+		c.token = "" // a disconnected flooder cannot resume
+		h.disconnect(c, websocket.ClosePolicyViolation, reason)
+		return
+	case "mute":
+		if now.After(l.mutedUntil) {
+			l.mutedUntil = now.Add(f.MuteFor)
+		}
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeMuted, Msg: reason + ", muted for " + f.MuteFor.String(), Ref: ref}))
+		return
+	case "throttle":
+		atomic.StoreInt64(&c.pause, int64(f.Throttle))
+	}
+	h.deliver(c, errorMessage(&ProtocolError{Code: CodeRateLimited, Msg: reason + ", slow down", Ref: ref}))
+}
+
+// maxCloseReason is the longest reason that fits in a close frame
+const maxCloseReason = 123
+
+// disconnect removes c, closing its connection with code and reason
+func (h *Hub) disconnect(c *Client, code int, reason string) {
+	c.closeMsg = websocket.FormatCloseMessage(code, closeReason(reason))
+	h.remove(c)
+}
+
+// closeReason shortens reason to fit in a close frame, on a UTF-8 boundary
+func closeReason(reason string) string {
+	if len(reason) <= maxCloseReason {
+		return reason
+	}
+	cut := maxCloseReason
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return reason[:cut]
+}
@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	var b bucket
+	for i := 0; i < 3; i++ {
+		require.True(t, b.take(now, 2, 3, 1), "burst %v", i)
+	}
+	require.False(t, b.take(now, 2, 3, 1))
+	require.True(t, b.take(now.Add(500*time.Millisecond), 2, 3, 1))
+	require.False(t, b.take(now.Add(500*time.Millisecond), 2, 3, 1))
+	require.True(t, b.take(now.Add(time.Hour), 2, 3, 3), "refills up to the burst")
+	require.False(t, b.take(now.Add(time.Hour), 2, 3, 1))
+
+	var off bucket
+	require.True(t, off.take(now, 0, 0, 100))
+}
+
+func TestFloodEscalates(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Flood.Rate, cfg.Flood.Burst = 0.01, 2
+	cfg.Flood.ThrottleAfter, cfg.Flood.MuteAfter, cfg.Flood.DisconnectAfter = 2, 3, 4
+	cfg.Flood.Throttle = time.Millisecond
+	_, srv := newTestServerConfig(t, cfg)
+
+	conn := dial(t, wsURL(srv, "/ws"), false)
+	readType(t, conn, TypePresence)
+	send := func(i int) Message {
+		id := "m" + strconv.Itoa(i)
+		require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: id, Body: id}))
+		for {
+			if m := readType(t, conn, TypeAck, TypeError); m.Metadata[MetaRef] == id {
+				return m
+			}
+		}
+	}
+
+	require.Equal(t, TypeAck, send(1).Type)
+	require.Equal(t, TypeAck, send(2).Type)
+	for i, code := range []string{CodeRateLimited, CodeRateLimited, CodeMuted} {
+		m := send(3 + i)
+		require.Equal(t, TypeError, m.Type)
+		require.Equal(t, code, m.Metadata[MetaCode], "strike %v", i+1)
+	}
+
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, Body: "again"}))
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		var m Message
+		if err := conn.ReadJSON(&m); err != nil {
+			require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+			break
+		}
+	}
+}
+
+func TestFloodDuplicatesAndMutes(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Flood.Duplicates = 2
+	cfg.Flood.ThrottleAfter, cfg.Flood.MuteAfter, cfg.Flood.DisconnectAfter = 0, 2, 0
+	_, srv := newTestServerConfig(t, cfg)
+
+	conn := dial(t, wsURL(srv, "/ws"), false)
+	readType(t, conn, TypePresence)
+	send := func(id, body string) Message {
+		require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: id, Body: body}))
+		for {
+			if m := readType(t, conn, TypeAck, TypeError); m.Metadata[MetaRef] == id {
+				return m
+			}
+		}
+	}
+
+	require.Equal(t, TypeAck, send("1", "spam").Type)
+	require.Equal(t, TypeAck, send("2", "spam").Type)
+	require.Equal(t, CodeRateLimited, send("3", "spam").Metadata[MetaCode])
+	require.Equal(t, CodeMuted, send("4", "spam").Metadata[MetaCode])
+
+	// muted users cannot send anything, but may still join rooms
+	require.Equal(t, CodeMuted, send("5", "something else").Metadata[MetaCode])
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeJoin, Room: "games"}))
+	require.Equal(t, "games", readType(t, conn, TypeJoin).Room)
+}
+
+func TestFloodReload(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Flood.Rate, cfg.Flood.UserRate = 0, 0
+	m, srv := newTestModule(t, cfg, nil)
+
+	conn := dial(t, wsURL(srv, "/ws"), false)
+	readType(t, conn, TypePresence)
+	send := func(id string) Message {
+		require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: id, Body: id}))
+		for {
+			if m := readType(t, conn, TypeAck, TypeError); m.Metadata[MetaRef] == id {
+				return m
+			}
+		}
+	}
+	require.Equal(t, TypeAck, send("1").Type)
+	require.Equal(t, TypeAck, send("2").Type)
+
+	next := m.NewConfig().(*Config)
+	*next = cfg
+	next.Flood.Rate, next.Flood.Burst = 0.01, 1
+	require.NoError(t, m.Reload(next))
+	require.Equal(t, TypeAck, send("3").Type)
+	require.Equal(t, CodeRateLimited, send("4").Metadata[MetaCode], "the new limits apply to connected clients")
+}
+
+func TestSlowMode(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Rooms["slow"] = RoomConfig{SlowMode: time.Hour}
+	_, srv := newTestServerConfig(t, cfg)
+
+	conn := dial(t, wsURL(srv, "/ws/slow"), false)
+	readType(t, conn, TypePresence)
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: "1", Body: "first"}))
+	require.Equal(t, TypeAck, readType(t, conn, TypeAck, TypeError).Type)
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: "2", Body: "second"}))
+	m := readType(t, conn, TypeAck, TypeError)
+	require.Equal(t, CodeSlowMode, m.Metadata[MetaCode])
+
+	// slow mode only applies to its room
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeJoin, Room: "lobby"}))
+	readType(t, conn, TypeJoin)
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: "3", Room: "lobby", Body: "hi"}))
+	for {
+		if m = readType(t, conn, TypeAck, TypeError); m.Metadata[MetaRef] == "3" {
+			break
+		}
+	}
+	require.Equal(t, TypeAck, m.Type)
+}
@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Formats of message bodies, see Config.Format
+const (
+	// FormatText shows bodies as they are, with links to the URLs in them
+	FormatText = "text"
+
+	// FormatMarkdown also renders **bold**, *italic* or _italic_, ~~strikethrough~~,
+	// `code` and [links](https://example.com)
+	FormatMarkdown = "markdown"
+)
+
+var (
+	// urlPattern matches the URLs that are linked in every format
+	urlPattern = regexp.MustCompile(`\b(?:https?://|mailto:)[^\s<>"]+`)
+
+	// markdownPattern matches the inline Markdown spans, then URLs. Its groups are
+	// code, link text and URL, URL, bold, strikethrough, and the two italics.
+	markdownPattern = regexp.MustCompile("`([^`\n]+)`" +
+		`|\[([^\]\n]+)\]\(((?:https?://|mailto:)[^\s()<>"]+)\)` +
+		`|(\b(?:https?://|mailto:)[^\s<>"]+)` +
+		`|\*\*(\S(?:.*?\S)?)\*\*` +
+		`|~~(\S(?:.*?\S)?)~~` +
+		`|\*([^*\s](?:[^*]*[^*\s])?)\*` +
+		`|\b_([^_\s](?:[^_]*[^_\s])?)_\b`)
+)
+
+// renderBody returns body as HTML in format. Its only elements are a, br, code,
+// del, em and strong, links only ever have an http, https or mailto href, and
+// everything else is escaped, so the result is safe to insert into a page.
+func renderBody(body, format string) string {
+	var b strings.Builder
+	for i, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		if i > 0 {
+			b.WriteString("<br>")
+		}
+		if format == FormatMarkdown {
+			renderMarkdown(&b, line, true)
+		} else {
+			renderText(&b, line)
+		}
+	}
+	return b.String()
+}
+
+// renderText escapes s, linking its URLs
+func renderText(b *strings.Builder, s string) {
+	for s != "" {
+		loc := urlPattern.FindStringIndex(s)
+		if loc == nil {
+			b.WriteString(html.EscapeString(s))
+			return
+		}
+		b.WriteString(html.EscapeString(s[:loc[0]]))
+		end := link(b, s[loc[0]:loc[1]], "")
+		b.WriteString(html.EscapeString(s[loc[0]+end : loc[1]]))
+		s = s[loc[1]:]
+	}
+}
+
+// renderMarkdown renders the inline Markdown of s, linking URLs unless s is the text of a link
+func renderMarkdown(b *strings.Builder, s string, links bool) {
+	for s != "" {
+		m := markdownPattern.FindStringSubmatchIndex(s)
+		if m == nil {
+			b.WriteString(html.EscapeString(s))
+			return
+		}
+		b.WriteString(html.EscapeString(s[:m[0]]))
+		group := func(i int) string { return s[m[2*i]:m[2*i+1]] }
+		matched := func(i int) bool { return m[2*i] >= 0 }
+		next := m[1]
+
+		switch {
+		case matched(1):
+			b.WriteString("<code>" + html.EscapeString(group(1)) + "</code>")
+		case matched(2) && links:
+			if link(b, group(3), group(2)) < len(group(3)) {
+				// not a URL after all, so the brackets are just text
+				b.WriteString(html.EscapeString("[" + group(2) + "]("))
+				next = m[6]
+			}
+		case matched(4) && links:
+			end := link(b, group(4), "")
+			next = m[8] + end
+		case matched(2), matched(4):
+			// links inside the text of a link stay text
+			b.WriteString(html.EscapeString(s[m[0]:m[1]]))
+		case matched(5):
+			wrap(b, "strong", group(5), links)
+		case matched(6):
+			wrap(b, "del", group(6), links)
+		case matched(7):
+			wrap(b, "em", group(7), links)
+		case matched(8):
+			wrap(b, "em", group(8), links)
+		}
+		s = s[next:]
+	}
+}
+
+// wrap renders the Markdown of s inside the element tag
+func wrap(b *strings.Builder, tag, s string, links bool) {
+	b.WriteString("<" + tag + ">")
+	renderMarkdown(b, s, links)
+	b.WriteString("</" + tag + ">")
+}
+
+// link writes a link to the URL at the start of raw, with text or the URL itself
+// as its text, and returns the length of the URL. Trailing punctuation is left out
+// of URLs found in text. Nothing is written if raw is not a safe URL.
+func link(b *strings.Builder, raw, text string) int {
+	if text == "" {
+		raw = strings.TrimRight(raw, ".,;:!?'*_~)")
+	}
+	u, ok := safeURL(raw)
+	if !ok {
+		if text == "" {
+			b.WriteString(html.EscapeString(raw))
+			return len(raw)
+		}
+		return 0
+	}
+
+	b.WriteString(`<a href="` + html.EscapeString(u.String()) + `" rel="nofollow noopener noreferrer" target="_blank">`)
+	if text == "" {
+		b.WriteString(html.EscapeString(raw))
+	} else {
+		renderMarkdown(b, text, false)
+	}
+	b.WriteString("</a>")
+	return len(raw)
+}
+
+// safeURL parses raw and reports whether it may be linked to: an http or https URL
+// with a host and no credentials, or a mailto URL
+func safeURL(raw string) (*url.URL, bool) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u, u.Host != "" && u.User == nil
+	case "mailto":
+		return u, u.Opaque != ""
+	}
+	return nil, false
+}
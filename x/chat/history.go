@@ -0,0 +1,291 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aljo242/koch/storage"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// historyBucket holds the stored messages of every room keyed by room and sequence number
+	historyBucket = "chat.history"
+
+	// historySeqBucket holds the last sequence number of every room with stored messages
+	historySeqBucket = "chat.history.seq"
+
+	// historyTimeout bounds the store reads made while the hub waits
+	historyTimeout = 5 * time.Second
+
+	// historyQueue is the number of messages waiting to be written before senders block
+	historyQueue = 256
+
+	// maxPrune is the number of expired messages removed with each write, so pruning a
+	// large backlog is spread over several writes
+	maxPrune = 100
+)
+
+// ErrHistoryUnavailable is returned for history that could not be read from the store
+var ErrHistoryUnavailable = errors.New("chat history is unavailable")
+
+// HistoryPage is a page of the messages of a room, oldest first. Cursor fetches the
+// page before it and is empty when there are no older messages.
+type HistoryPage struct {
+	Room     string     `json:"room"`
+	Messages []*Message `json:"messages"`
+	Cursor   string     `json:"cursor,omitempty"`
+}
+
+// parseCursor returns the sequence number a history page ends before, 0 for the latest page
+func parseCursor(cursor string) (uint64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil || seq == 0 {
+		return 0, &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid history cursor"}
+	}
+	return seq, nil
+}
+
+// ring keeps the most recent messages of a room
+type ring struct {
+	buf  []*Message
+	next int
+	n    int
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([]*Message, size)}
+}
+
+func (r *ring) add(m *Message) {
+	if len(r.buf) == 0 {
+		return
+	}
+	r.buf[r.next] = m
+	r.next = (r.next + 1) % len(r.buf)
+	if r.n < len(r.buf) {
+		r.n++
+	}
+}
+
+// before returns up to limit messages older than seq, or the newest if seq is 0, oldest first
+func (r *ring) before(seq uint64, limit int) []*Message {
+	var msgs []*Message
+	for i := 1; i <= r.n && len(msgs) < limit; i++ {
+		m := r.buf[(r.next-i+len(r.buf))%len(r.buf)]
+		if seq == 0 || m.Seq < seq {
+			msgs = append(msgs, m)
+		}
+	}
+	reverse(msgs)
+	return msgs
+}
+
+// find returns the message with the id, or nil if it is not among the recent messages
+func (r *ring) find(id string) *Message {
+	for i := 1; i <= r.n; i++ {
+		if m := r.buf[(r.next-i+len(r.buf))%len(r.buf)]; m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// after returns the messages newer than seq, oldest first
+func (r *ring) after(seq uint64) []*Message {
+	var msgs []*Message
+	for i := 1; i <= r.n; i++ {
+		m := r.buf[(r.next-i+len(r.buf))%len(r.buf)]
+		if m.Seq <= seq {
+			break
+		}
+		msgs = append(msgs, m)
+	}
+	reverse(msgs)
+	return msgs
+}
+
+func reverse(msgs []*Message) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
+
+// historyStore writes the messages of every room to a storage.Store in the background
+// and reads back older pages
+type historyStore struct {
+	store storage.Store
+	cfg   HistoryConfig
+
+	writes chan *Message
+	done   chan struct{}
+}
+
+func newHistoryStore(s storage.Store, cfg HistoryConfig) *historyStore {
+	hs := &historyStore{
+		store:  s,
+		cfg:    cfg,
+		writes: make(chan *Message, historyQueue),
+		done:   make(chan struct{}),
+	}
+	go hs.run()
+	return hs
+}
+
+// historyKey is the key of the message seq of room; keys of a room sort by sequence number
+func historyKey(room string, seq uint64) []byte {
+	return []byte(room + "/" + storage.SeqKey(seq))
+}
+
+// append queues m to be stored
+func (hs *historyStore) append(m *Message) {
+	hs.writes <- m
+}
+
+// close writes the queued messages and stops the writer
+func (hs *historyStore) close() {
+	close(hs.writes)
+	<-hs.done
+}
+
+func (hs *historyStore) run() {
+	defer close(hs.done)
+	for m := range hs.writes {
+		if err := hs.write(m); err != nil {
+			log.Error().Err(err).Str("room", m.Room).Msg("error storing chat message")
+		}
+	}
+}
+
+// write stores m, records the room's sequence number and prunes messages past the retention limits
+func (hs *historyStore) write(m *Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return hs.store.Update(context.Background(), func(tx storage.Tx) error {
+		msgs, err := tx.Bucket(historyBucket)
+		if err != nil {
+			return err
+		}
+		seqs, err := tx.Bucket(historySeqBucket)
+		if err != nil {
+			return err
+		}
+		if err := msgs.Put(historyKey(m.Room, m.Seq), b); err != nil {
+			return err
+		}
+		if err := seqs.Put([]byte(m.Room), []byte(strconv.FormatUint(m.Seq, 10))); err != nil {
+			return err
+		}
+		return hs.prune(msgs, m.Room, m.Seq)
+	})
+}
+
+// prune deletes the oldest messages of room beyond the retention count or older than MaxAge
+func (hs *historyStore) prune(b storage.Bucket, room string, seq uint64) error {
+	prefix := []byte(room + "/")
+	cutoff := time.Now().Add(-hs.cfg.MaxAge)
+
+	var expired [][]byte
+	err := b.Range(prefix, false, func(k, v []byte) error {
+		if !bytes.HasPrefix(k, prefix) || len(expired) >= maxPrune {
+			return storage.ErrStop
+		}
+		old := hs.cfg.Retention > 0 && keySeq(k, prefix)+uint64(hs.cfg.Retention) <= seq
+		if !old && hs.cfg.MaxAge > 0 {
+			var m Message
+			if err := json.Unmarshal(v, &m); err == nil {
+				old = m.Timestamp.Before(cutoff)
+			}
+		}
+		if !old {
+			return storage.ErrStop
+		}
+		expired = append(expired, append([]byte(nil), k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keySeq(k, prefix []byte) uint64 {
+	seq, _ := strconv.ParseUint(string(k[len(prefix):]), 10, 64)
+	return seq
+}
+
+// lastSeq returns the last sequence number stored for room, 0 if it has none
+func (hs *historyStore) lastSeq(ctx context.Context, room string) (uint64, error) {
+	var seq uint64
+	err := hs.store.View(ctx, func(tx storage.Tx) error {
+		b, err := tx.Bucket(historySeqBucket)
+		if err != nil {
+			return err
+		}
+		v, err := b.Get([]byte(room))
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seq, err = strconv.ParseUint(string(v), 10, 64)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading the history of %v : %w", room, err)
+	}
+	return seq, nil
+}
+
+// before reads up to limit stored messages of room older than seq, or the newest if
+// seq is 0, oldest first
+func (hs *historyStore) before(ctx context.Context, room string, seq uint64, limit int) ([]*Message, error) {
+	prefix := []byte(room + "/")
+	from := []byte(room + "/~") // sorts after every sequence number
+	if seq > 0 {
+		from = historyKey(room, seq-1)
+	}
+
+	var msgs []*Message
+	err := hs.store.View(ctx, func(tx storage.Tx) error {
+		b, err := tx.Bucket(historyBucket)
+		if err != nil {
+			return err
+		}
+		return b.Range(from, true, func(k, v []byte) error {
+			if !bytes.HasPrefix(k, prefix) || len(msgs) >= limit {
+				return storage.ErrStop
+			}
+			m := &Message{}
+			if err := json.Unmarshal(v, m); err != nil {
+				return fmt.Errorf("error decoding message %s : %w", k, err)
+			}
+			m.Seq = keySeq(k, prefix)
+			msgs = append(msgs, m)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading the history of %v : %w", room, err)
+	}
+	reverse(msgs)
+	return msgs, nil
+}
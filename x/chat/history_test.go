@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aljo242/koch/storage"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// send posts bodies to the default room and waits for their acks
+func send(t *testing.T, conn *websocket.Conn, bodies ...string) {
+	t.Helper()
+
+	for _, body := range bodies {
+		require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: body, Body: body}))
+		for readType(t, conn, TypeAck).Metadata[MetaRef] != body {
+		}
+	}
+}
+
+func bodies(msgs []*Message) []string {
+	var out []string
+	for _, m := range msgs {
+		out = append(out, m.Body)
+	}
+	return out
+}
+
+// getHistory fetches a history page over HTTP
+func getHistory(t *testing.T, srv *httptest.Server, room, query string) (HistoryPage, int) {
+	t.Helper()
+
+	resp, err := http.Get(srv.URL + "/rooms/" + room + "/history" + query)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var page HistoryPage
+	if resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	}
+	return page, resp.StatusCode
+}
+
+func TestRing(t *testing.T) {
+	t.Parallel()
+
+	r := newRing(3)
+	require.Empty(t, r.before(0, 10))
+	for seq := uint64(1); seq <= 5; seq++ {
+		r.add(&Message{Body: fmt.Sprint(seq), Seq: seq})
+	}
+	require.Equal(t, []string{"3", "4", "5"}, bodies(r.before(0, 10)))
+	require.Equal(t, []string{"4", "5"}, bodies(r.before(0, 2)))
+	require.Equal(t, []string{"3"}, bodies(r.before(4, 2)))
+	require.Empty(t, r.before(3, 2))
+
+	newRing(0).add(&Message{Seq: 1})
+}
+
+func TestHubHistory(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.History = HistoryConfig{Size: 5, Replay: 3, PageSize: 2}
+	_, srv := newTestServerConfig(t, cfg)
+
+	alice := dial(t, wsURL(srv, "/ws"), false)
+	send(t, alice, "1", "2", "3", "4", "5", "6")
+
+	// joining replays the latest messages
+	bob := dial(t, wsURL(srv, "/ws"), false)
+	replay := readType(t, bob, TypeHistory)
+	require.Equal(t, "lobby", replay.Room)
+	require.Equal(t, []string{"4", "5", "6"}, bodies(replay.History))
+	require.Equal(t, "4", replay.Cursor)
+
+	// older pages are fetched with the cursor until the memory runs out
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeHistory, ID: "h1", Cursor: replay.Cursor}))
+	page := readType(t, bob, TypeHistory)
+	require.Equal(t, "h1", page.Metadata[MetaRef])
+	require.Equal(t, []string{"2", "3"}, bodies(page.History))
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeHistory, ID: "h2", Cursor: page.Cursor}))
+	require.Empty(t, readType(t, bob, TypeHistory).History)
+
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeHistory, ID: "h3", Room: "games"}))
+	require.Equal(t, CodeNotMember, readType(t, bob, TypeError).Metadata[MetaCode])
+
+	// the same pages are served over HTTP
+	p, status := getHistory(t, srv, "lobby", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{"5", "6"}, bodies(p.Messages))
+	p, _ = getHistory(t, srv, "lobby", "?before="+p.Cursor+"&limit=1")
+	require.Equal(t, []string{"4"}, bodies(p.Messages))
+	_, status = getHistory(t, srv, "nowhere", "")
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = getHistory(t, srv, "lobby", "?before=soon")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestHubHistoryPersist(t *testing.T) {
+	t.Parallel()
+
+	store := storage.NewMemory()
+	cfg := DefaultConfig()
+	cfg.History = HistoryConfig{Size: 2, Replay: 2, PageSize: 10, Persist: true, Retention: 3}
+
+	m, srv := newTestModule(t, cfg, store)
+	send(t, dial(t, wsURL(srv, "/ws"), false), "1", "2", "3", "4")
+	require.NoError(t, m.Stop(context.Background()))
+
+	// a new hub picks up where the last one stopped, reading older messages from the
+	// store, which only keeps the retained ones
+	_, srv = newTestModule(t, cfg, store)
+	p, status := getHistory(t, srv, "lobby", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{"2", "3", "4"}, bodies(p.Messages))
+	require.Empty(t, p.Cursor)
+
+	conn := dial(t, wsURL(srv, "/ws"), false)
+	require.Equal(t, []string{"3", "4"}, bodies(readType(t, conn, TypeHistory).History))
+	send(t, conn, "5")
+	p, _ = getHistory(t, srv, "lobby", "?limit=1")
+	require.Equal(t, []string{"5"}, bodies(p.Messages))
+	require.Equal(t, "5", p.Cursor)
+}
@@ -1,51 +1,1022 @@
 package chat
 
-// Hub maintains the set of active clients and broadcasts messages
-// to the clients
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrStopped is returned by calls to a hub that has stopped
+var ErrStopped = errors.New("chat hub is stopped")
+
+// inbound is a message read from a client, or the reason it was rejected
+type inbound struct {
+	client *Client
+	msg    *Message
+	err    error
+
+	// size is the length of the frame in bytes
+	size int
+}
+
+// room is a named set of clients that receive each other's messages
+type room struct {
+	name    string
+	cfg     RoomConfig
+	members map[*Client]bool
+
+	// seq is the sequence number of the last message sent to the room
+	seq uint64
+
+	// recent holds the latest messages of the room
+	recent *ring
+}
+
+// RoomInfo describes a room for listings
+type RoomInfo struct {
+	Name       string `json:"name"`
+	Members    int    `json:"members"`
+	MaxMembers int    `json:"maxMembers,omitempty"`
+}
+
+// Hub maintains the set of active clients and the rooms they are in, and
+// broadcasts messages to the members of a room
 type Hub struct {
+	cfg Config
+
+	// identify returns the identity of new connections
+	identify IdentifyFunc
+
 	// Registered Clients
 	clients map[*Client]bool
 
+	// Rooms by name
+	rooms map[string]*room
+
+	// users with at least one connection, by user id
+	users map[string]*user
+
+	// history stores the messages of every room if persistence is on
+	history *historyStore
+
+	// resumable holds the state of closed connections by resume token
+	resumable map[string]*resumeState
+
+	// limits holds the flood state of users by user id, see FloodConfig
+	limits map[string]*limiter
+
+	// offline holds direct messages for users without connections by user id, oldest first
+	offline map[string][]*Message
+
+	// seen holds when users went offline by user id, until OfflineTTL passes
+	seen map[string]time.Time
+
+	// accounts maps the user ids of every account to their lower case names and
+	// accountNames the names to the ids, kept current by the module. Both are nil
+	// without accounts.
+	accounts     map[string]string
+	accountNames map[string]string
+
 	// Inbound messages from the clients
-	broadcast chan []byte
+	inbound chan inbound
 
 	// Register requests from the clients
 	register chan *Client
 
 	// Unregister requests from clients
 	unregister chan *Client
+
+	// calls run on the hub goroutine, see do
+	calls chan func()
+
+	// stats counts the slow client policy at work
+	stats Stats
+
+	// moderators holds the lower case account names of the moderators
+	moderators map[string]bool
+
+	// filters apply to every room and direct message, see ModerationConfig
+	filters []filter
+
+	// sanctions holds the bans and mutes in force by action and target
+	sanctions map[string]*Sanction
+
+	// modLog holds the latest moderation log entries, oldest first
+	modLog []LogEntry
+
+	// modStore keeps the sanctions and moderation log if the module has a store
+	modStore *moderationStore
+
+	// commands are the slash commands clients may run, see RegisterCommand
+	commands commands
+
+	// quit asks Run to stop, see Stop; done is closed when it has
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// stopping is set once Run is stopping, and pumps counts the running pumps of
+	// every connection it has seen, owned by the hub goroutine
+	stopping bool
+	pumps    int
+
+	// exited receives from each pump as it returns
+	exited chan struct{}
 }
 
 // NewHub returns a new Hub type with default config
 func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
+	h := &Hub{
+		identify:   GuestIdentity,
+		inbound:    make(chan inbound),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		calls:      make(chan func()),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+		exited:     make(chan struct{}),
 		clients:    make(map[*Client]bool),
+		users:      make(map[string]*user),
+		offline:    make(map[string][]*Message),
+		seen:       make(map[string]time.Time),
+		limits:     make(map[string]*limiter),
+		resumable:  make(map[string]*resumeState),
+	}
+	for _, cmd := range builtinCommands() {
+		if err := h.commands.add(cmd); err != nil {
+			panic(err) // the built in commands are valid
+		}
 	}
+	h.configure(DefaultConfig())
+	return h
 }
 
-// Run ...
+// SetIdentify replaces how new connections are identified, GuestIdentity by default.
+// It must be called before the hub serves connections.
+func (h *Hub) SetIdentify(fn IdentifyFunc) {
+	h.identify = fn
+}
+
+// configure replaces the settings and configured rooms of a hub that is not running yet
+func (h *Hub) configure(cfg Config) {
+	h.cfg = cfg
+	h.cfg.DefaultRoom, _ = roomName(cfg.DefaultRoom)
+	h.rooms = make(map[string]*room)
+	for name, rc := range cfg.Rooms {
+		h.rooms[name] = h.newRoom(name, rc)
+	}
+	// the default room is never removed
+	if r, ok := h.rooms[h.cfg.DefaultRoom]; ok {
+		r.cfg.Persistent = true
+	} else {
+		h.rooms[h.cfg.DefaultRoom] = h.newRoom(h.cfg.DefaultRoom, RoomConfig{Persistent: true})
+	}
+	h.configureModeration(cfg.Moderation)
+}
+
+// setFlood replaces the flood limits of a running hub. Users keep their strikes and
+// mutes, and their buckets refill at the new rates.
+func (h *Hub) setFlood(ctx context.Context, f FloodConfig) error {
+	return h.do(ctx, func() { h.cfg.Flood = f })
+}
+
+// newRoom returns an empty room, picking up its history from the store if there is one
+func (h *Hub) newRoom(name string, cfg RoomConfig) *room {
+	r := &room{name: name, cfg: cfg, members: make(map[*Client]bool), recent: newRing(h.cfg.History.Size)}
+	if h.history == nil {
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), historyTimeout)
+	defer cancel()
+	seq, err := h.history.lastSeq(ctx, name)
+	if err == nil {
+		var msgs []*Message
+		if msgs, err = h.history.before(ctx, name, 0, h.cfg.History.Size); err == nil {
+			r.seq = seq
+			for _, m := range msgs {
+				r.recent.add(m)
+			}
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("room", name).Msg("error loading chat history")
+	}
+	return r
+}
+
+// Run serves the clients of the hub until Stop is called and every connection has
+// closed. A hub cannot be run again once it has stopped.
 func (h *Hub) Run() {
-	for {
+	defer close(h.done)
+
+	quit := h.quit
+	for !h.stopping || h.pumps > 0 {
 		select {
 		case client := <-h.register:
-			h.clients[client] = true
+			h.pumps += 2
+			h.add(client)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
+			}
+		case <-h.exited:
+			h.pumps--
+		case in := <-h.inbound:
+			h.handle(in)
+		case fn := <-h.calls:
+			fn()
+		case <-quit:
+			quit = nil
+			h.shutdown()
+		}
+	}
+}
+
+// Stop stops the hub from accepting connections, closes every connection with
+// CloseGoingAway and waits for their pumps to exit, then writes the history and
+// moderation changes that are still queued for the store. It gives up when ctx is done.
+func (h *Hub) Stop(ctx context.Context) error {
+	h.stopOnce.Do(func() { close(h.quit) })
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// the hub goroutine has returned, so its stores are ours
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		if h.history != nil {
+			h.history.close()
+			h.history = nil
+		}
+		if h.modStore != nil {
+			h.modStore.close()
+			h.modStore = nil
+		}
+	}()
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown closes every connection, as the hub stops
+func (h *Hub) shutdown() {
+	h.stopping = true
+	log.Info().Int("clients", len(h.clients)).Msg("stopping chat hub")
+	for c := range h.clients {
+		h.disconnect(c, websocket.CloseGoingAway, "server is shutting down")
+	}
+}
+
+// exit tells the hub that a pump of one of its connections returned
+func (h *Hub) exit() {
+	select {
+	case h.exited <- struct{}{}:
+	case <-h.done:
+	}
+}
+
+// do runs fn on the hub goroutine and waits for it to return, giving up if ctx is
+// done before the hub picks it up
+func (h *Hub) do(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	select {
+	case h.calls <- func() { fn(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-h.done:
+		return ErrStopped
+	}
+	<-done
+	return nil
+}
+
+// Rooms lists every room with its member count, sorted by name
+func (h *Hub) Rooms(ctx context.Context) ([]RoomInfo, error) {
+	var rooms []RoomInfo
+	err := h.do(ctx, func() {
+		for _, r := range h.rooms {
+			rooms = append(rooms, RoomInfo{Name: r.name, Members: len(r.members), MaxMembers: r.cfg.MaxMembers})
+		}
+	})
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms, err
+}
+
+// add registers a new connection under its user, who comes online with their
+// first connection, and joins the connection's initial room
+func (h *Hub) add(c *Client) {
+	if h.stopping {
+		c.closeMsg = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+		close(c.send)
+		return
+	}
+	if s := h.sanctioned(ActionBan, c, time.Now()); s != nil {
+		c.closeMsg = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, closeReason(s.describe(time.Now())))
+		close(c.send)
+		return
+	}
+	h.clients[c] = true
+
+	u, ok := h.users[c.identity.UserID]
+	if !ok {
+		u = &user{
+			id:     c.identity.UserID,
+			name:   h.freeName(c.identity),
+			status: StatusOnline,
+			guest:  c.identity.Guest,
+			conns:  make(map[*Client]bool),
+		}
+		if !u.guest {
+			u.account = c.identity.Name
+			u.moderator = h.isModerator(u)
+		}
+		h.users[u.id] = u
+	}
+	u.conns[c] = true
+	c.user = u
+
+	// direct messages kept while the user was offline
+	h.expireOffline(time.Now())
+	for _, m := range h.offline[u.id] {
+		h.deliver(c, m)
+	}
+	delete(h.offline, u.id)
+
+	if h.cfg.Resume.TTL > 0 {
+		c.token = newID()
+		resume := &Message{Type: TypeResume}
+		resume.stamp()
+		resume.Token = c.token
+		h.deliver(c, resume)
+	}
+	if c.resume != nil && h.resume(c) {
+		return
+	}
+
+	if c.room == "" {
+		c.room = h.cfg.DefaultRoom
+	}
+	if err := h.join(c, c.room); err != nil {
+		h.deliver(c, errorMessage(err))
+		return
+	}
+	h.announce(c, TypeJoin, c.room, "")
+	h.replay(c, c.room)
+}
+
+// freeName returns the nickname of a user coming online: their preferred name, or a
+// generated guest name, that no other online user has. Guests never get the name of an account.
+func (h *Hub) freeName(id Identity) string {
+	if name, ok := cleanName(id.Name); ok && !h.nameInUse(name, id.UserID) && (!id.Guest || !h.isReserved(name)) {
+		return name
+	}
+	for {
+		if name := guestName(); !h.nameInUse(name, id.UserID) && !h.isReserved(name) {
+			return name
+		}
+	}
+}
+
+// isReserved reports whether name is the name of an account
+func (h *Hub) isReserved(name string) bool {
+	_, ok := h.accountNames[strings.ToLower(name)]
+	return ok
+}
+
+func (h *Hub) nameInUse(name, userID string) bool {
+	for _, u := range h.users {
+		if u.id != userID && strings.EqualFold(u.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameTaken reports whether another user in the room called room goes by name
+func (h *Hub) nameTaken(name, room string, u *user) bool {
+	r, ok := h.rooms[room]
+	if !ok {
+		return false
+	}
+	for member := range r.members {
+		if member.user != u && strings.EqualFold(member.user.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle acts on a message from a client. The hub owns the identity and rooms of
+// every client, so the sender and room of every message are set here.
+func (h *Hub) handle(in inbound) {
+	c := in.client
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	if !h.admit(c, in.msg, in.size) {
+		return
+	}
+	if in.err != nil {
+		h.deliver(c, errorMessage(in.err))
+		return
+	}
+
+	m := in.msg
+	ref := m.ID
+	name := c.room
+	if m.Room != "" {
+		var ok bool
+		if name, ok = roomName(m.Room); !ok {
+			h.deliver(c, errorMessage(&ProtocolError{Code: CodeInvalidMessage, Msg: "invalid room name", Ref: ref}))
+			return
+		}
+	}
+
+	switch m.Type {
+	case TypeJoin:
+		if name == "" {
+			name = h.cfg.DefaultRoom
+		}
+		if err := h.enter(c, name, m.Sender, ref); err != nil {
+			h.deliver(c, errorMessage(withRef(err, ref)))
+		}
+	case TypeLeave:
+		if err := h.depart(c, name, ref); err != nil {
+			h.deliver(c, errorMessage(withRef(err, ref)))
+		}
+	case TypeMessage:
+		if h.command(c, m, name) {
+			return
+		}
+		h.say(c, m, name, false)
+	case TypeDirect:
+		ok, flagged := h.filter(c, m)
+		if !ok {
+			return
+		}
+		if h.direct(c, m) && flagged {
+			h.flag(m)
+		}
+	case TypeReport:
+		if !c.rooms[name] {
+			h.deliver(c, errorMessage(&ProtocolError{Code: CodeNotMember, Msg: "join room " + name + " to report its messages", Ref: ref}))
+			return
+		}
+		h.report(c, m, name)
+	case TypePresence:
+		c.user.status = m.Body
+		h.deliver(c, ackMessage(ref, ""))
+		h.presence(c.user)
+	case TypeHistory:
+		if !c.rooms[name] {
+			h.deliver(c, errorMessage(&ProtocolError{Code: CodeNotMember, Msg: "join room " + name + " to read its history", Ref: ref}))
+			return
+		}
+		before, _ := parseCursor(m.Cursor) // checked by validate
+		page, err := h.page(name, before, m.Limit)
+		if err != nil {
+			h.deliver(c, errorMessage(withRef(err, ref)))
+			return
+		}
+		h.deliver(c, historyMessage(page, ref))
+	}
+}
+
+// enter joins c to the room called name and tells the room, taking the nickname
+// nick first if it is not empty. The join is acked to ref if it is not empty.
+func (h *Hub) enter(c *Client, name, nick, ref string) error {
+	if nick != "" {
+		if err := h.rename(c.user, nick, name); err != nil {
+			return err
+		}
+	} else if h.nameTaken(c.user.name, name, c.user) {
+		return &ProtocolError{Code: CodeNameTaken, Msg: c.user.name + " is taken in " + name + ", join with another name"}
+	}
+	if err := h.join(c, name); err != nil {
+		return err
+	}
+	c.room = name
+	h.announce(c, TypeJoin, name, ref)
+	h.replay(c, name)
+	return nil
+}
+
+// depart takes c out of the room called name and tells the room, acking to ref
+// if it is not empty
+func (h *Hub) depart(c *Client, name, ref string) error {
+	if !c.rooms[name] {
+		return &ProtocolError{Code: CodeNotMember, Msg: "not in room " + name}
+	}
+	h.announce(c, TypeLeave, name, ref)
+	h.leave(c, name)
+	return nil
+}
+
+// say sends the room message m from c to the members of the room called name,
+// after the filters, and acks it to c. Actions are marked with MetaAction.
+func (h *Hub) say(c *Client, m *Message, name string, action bool) {
+	ref := m.ID
+	if !c.rooms[name] {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeNotMember, Msg: "join room " + name + " before sending to it", Ref: ref}))
+		return
+	}
+	ok, flagged := h.filter(c, m)
+	if !ok {
+		return
+	}
+	h.sign(c, m)
+	if action {
+		m.Metadata = withMeta(m.Metadata, MetaAction, "true")
+	}
+	h.render(m)
+	m.Room = name
+	h.record(h.rooms[name], m)
+	h.deliver(c, ackMessage(ref, m.ID))
+	h.broadcast(name, m)
+	if flagged {
+		h.flag(m)
+	}
+}
+
+// record adds a message sent to r to the room's history
+func (h *Hub) record(r *room, m *Message) {
+	r.seq++
+	m.Seq = r.seq
+	r.recent.add(m)
+	if h.history != nil {
+		h.history.append(m)
+	}
+}
+
+// page returns up to limit messages of the room called name before the sequence
+// number before, or the latest if before is 0. Messages that are no longer in
+// memory are read from the store.
+func (h *Hub) page(name string, before uint64, limit int) (HistoryPage, error) {
+	if limit <= 0 || limit > h.cfg.History.PageSize {
+		limit = h.cfg.History.PageSize
+	}
+	page := HistoryPage{Room: name, Messages: []*Message{}}
+
+	r, ok := h.rooms[name]
+	if !ok && h.history == nil {
+		return page, &ProtocolError{Code: CodeNoSuchRoom, Msg: "no room called " + name}
+	}
+	if ok {
+		page.Messages = r.recent.before(before, limit)
+	}
+
+	if n := len(page.Messages); n < limit && h.history != nil {
+		if n > 0 {
+			before = page.Messages[0].Seq
+		}
+		if before != 1 {
+			ctx, cancel := context.WithTimeout(context.Background(), historyTimeout)
+			defer cancel()
+			older, err := h.history.before(ctx, name, before, limit-n)
+			if err != nil {
+				log.Error().Err(err).Str("room", name).Msg("error reading chat history")
+				return page, ErrHistoryUnavailable
 			}
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+			page.Messages = append(older, page.Messages...)
+		}
+	}
+
+	if len(page.Messages) == limit && page.Messages[0].Seq > 1 {
+		page.Cursor = strconv.FormatUint(page.Messages[0].Seq, 10)
+	}
+	return page, nil
+}
+
+// History returns a page of the history of the room called room, see HistoryPage
+func (h *Hub) History(ctx context.Context, room, cursor string, limit int) (HistoryPage, error) {
+	return h.historyFor(ctx, nil, room, cursor, limit)
+}
+
+// historyFor returns a page of history like History, checking first that reader
+// may read the room unless reader is nil
+func (h *Hub) historyFor(ctx context.Context, reader *Identity, room, cursor string, limit int) (HistoryPage, error) {
+	name, ok := roomName(room)
+	if !ok {
+		return HistoryPage{}, &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid room name"}
+	}
+	before, err := parseCursor(cursor)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+
+	var page HistoryPage
+	read := func() {
+		if reader != nil {
+			if err = h.access(name, reader.Guest); err != nil {
+				return
 			}
 		}
+		page, err = h.page(name, before, limit)
+	}
+	if doErr := h.do(ctx, read); doErr != nil {
+		return HistoryPage{}, doErr
+	}
+	return page, err
+}
+
+// historyMessage returns page as the reply to the history request ref
+func historyMessage(page HistoryPage, ref string) *Message {
+	m := &Message{Type: TypeHistory, Room: page.Room, History: page.Messages, Cursor: page.Cursor}
+	if ref != "" {
+		m.Metadata = map[string]string{MetaRef: ref}
+	}
+	m.stamp()
+	return m
+}
+
+// sign sets the server owned fields of a message sent by c and drops the metadata
+// clients may not set
+func (h *Hub) sign(c *Client, m *Message) {
+	m.Sender = c.user.name
+	m.SenderID = c.user.id
+	m.Users, m.History, m.Seq, m.Token, m.HTML = nil, nil, 0, "", ""
+	meta := m.Metadata
+	m.Metadata = nil
+	for _, key := range clientMeta {
+		if v, ok := meta[key]; ok {
+			m.Metadata = withMeta(m.Metadata, key, v)
+		}
+	}
+	m.stamp()
+}
+
+// render sets the HTML of a message with a body in the format of the hub, or as
+// plain text if the message asks for it
+func (h *Hub) render(m *Message) {
+	format := h.cfg.Format
+	if m.Metadata[MetaFormat] == FormatText {
+		format = FormatText
+	}
+	m.HTML = renderBody(m.Body, format)
+}
+
+// rename changes the nickname of u, which must be free in every room u is in and in
+// the room u is joining
+func (h *Hub) rename(u *user, requested, joining string) error {
+	name, ok := cleanName(requested)
+	if !ok {
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid name"}
+	}
+	if name == u.name {
+		return nil
+	}
+	if !strings.EqualFold(name, u.account) && h.isReserved(name) {
+		return &ProtocolError{Code: CodeNameTaken, Msg: name + " belongs to an account, sign in to use it"}
+	}
+
+	rooms := map[string]bool{joining: true}
+	for c := range u.conns {
+		for r := range c.rooms {
+			rooms[r] = true
+		}
+	}
+	for r := range rooms {
+		if h.nameTaken(name, r, u) {
+			return &ProtocolError{Code: CodeNameTaken, Msg: name + " is taken in " + r}
+		}
+	}
+
+	u.name = name
+	h.presence(u)
+	return nil
+}
+
+// announce acks a join or leave of c and tells the room about it. Joining clients
+// also get a snapshot of who is in the room.
+func (h *Hub) announce(c *Client, typ MessageType, name, ref string) {
+	m := &Message{Type: typ, Room: name}
+	h.sign(c, m)
+	if ref != "" {
+		h.deliver(c, ackMessage(ref, m.ID))
+	}
+	h.broadcast(name, m)
+
+	if typ == TypeJoin {
+		h.deliver(c, h.snapshot(name))
+	}
+}
+
+// replay sends the latest messages of the room called name to c, which just joined it
+func (h *Hub) replay(c *Client, name string) {
+	r := h.rooms[name]
+	if h.cfg.History.Replay == 0 || r.recent.n == 0 {
+		return
+	}
+
+	msgs := r.recent.before(0, h.cfg.History.Replay)
+	page := HistoryPage{Room: r.name, Messages: msgs}
+	if len(msgs) > 0 && msgs[0].Seq > 1 {
+		page.Cursor = strconv.FormatUint(msgs[0].Seq, 10)
+	}
+	h.deliver(c, historyMessage(page, ""))
+}
+
+// snapshot lists the users in the room called name
+func (h *Hub) snapshot(name string) *Message {
+	m := &Message{Type: TypePresence, Room: name, Users: []UserInfo{}}
+	seen := make(map[*user]bool)
+	if r, ok := h.rooms[name]; ok {
+		for member := range r.members {
+			if !seen[member.user] {
+				seen[member.user] = true
+				m.Users = append(m.Users, member.user.info())
+			}
+		}
+	}
+	sort.Slice(m.Users, func(i, j int) bool { return m.Users[i].Name < m.Users[j].Name })
+	m.stamp()
+	return m
+}
+
+// presence tells every room u is in about u's status and name
+func (h *Hub) presence(u *user) {
+	h.presenceVia(u, u.conns)
+}
+
+// presenceVia sends the presence of u to conns and everyone sharing a room with them
+func (h *Hub) presenceVia(u *user, conns map[*Client]bool) {
+	m := &Message{Type: TypePresence, Sender: u.name, SenderID: u.id, Body: u.status}
+	m.stamp()
+	h.toRoomsOf(conns, m)
+}
+
+// toRoomsOf delivers m once to each of conns and every client sharing a room with them
+func (h *Hub) toRoomsOf(conns map[*Client]bool, m *Message) {
+	sent := make(map[*Client]bool)
+	send := func(c *Client) {
+		if !sent[c] {
+			sent[c] = true
+			h.deliver(c, m)
+		}
+	}
+	for c := range conns {
+		send(c)
+		for name := range c.rooms {
+			for member := range h.rooms[name].members {
+				send(member)
+			}
+		}
+	}
+}
+
+// direct routes a direct message to every connection of its recipient only and
+// acks it to the sender, queueing it if the recipient is offline and queueing is
+// on. It reports whether the message was sent.
+func (h *Hub) direct(c *Client, m *Message) bool {
+	ref := m.ID
+	h.sign(c, m)
+	h.render(m)
+	m.Room = ""
+
+	queued, err := h.toUser(m.To, m)
+	if err != nil {
+		h.deliver(c, errorMessage(withRef(err, ref)))
+		return false
+	}
+	ack := ackMessage(ref, m.ID)
+	if queued {
+		ack.Metadata = withMeta(ack.Metadata, MetaQueued, "true")
+	}
+	h.deliver(c, ack)
+	return true
+}
+
+// toUser delivers m to every connection of the user id, or keeps it for when they
+// are next online if queueing is on, and reports whether it was queued
+func (h *Hub) toUser(id string, m *Message) (bool, error) {
+	to, online := h.users[id]
+	if online {
+		for conn := range to.conns {
+			h.deliver(conn, m)
+		}
+		return false, nil
+	}
+	if h.cfg.OfflineQueue == 0 {
+		return false, &ProtocolError{Code: CodeUserOffline, Msg: "user " + id + " is offline"}
+	}
+	h.expireOffline(time.Now())
+	_, seen := h.seen[id]
+	if _, account := h.accounts[id]; !seen && !account {
+		return false, &ProtocolError{Code: CodeNoSuchUser, Msg: "no user " + id}
+	}
+	if _, ok := h.offline[id]; !ok && len(h.offline) >= h.cfg.OfflineUsers {
+		return false, &ProtocolError{Code: CodeUserOffline, Msg: "user " + id + " is offline and too many messages are waiting already"}
+	}
+
+	queue := append(h.offline[id], m)
+	if len(queue) > h.cfg.OfflineQueue {
+		queue = queue[len(queue)-h.cfg.OfflineQueue:]
+	}
+	h.offline[id] = queue
+	return true, nil
+}
+
+// expireOffline drops the queued direct messages and offline users older than OfflineTTL
+func (h *Hub) expireOffline(now time.Time) {
+	cutoff := now.Add(-h.cfg.OfflineTTL)
+	for id, at := range h.seen {
+		if at.Before(cutoff) {
+			delete(h.seen, id)
+		}
+	}
+	for id, queue := range h.offline {
+		i := 0
+		for i < len(queue) && queue[i].Timestamp.Before(cutoff) {
+			i++
+		}
+		if i == len(queue) {
+			delete(h.offline, id)
+		} else if i > 0 {
+			h.offline[id] = queue[i:]
+		}
+	}
+}
+
+// join adds c to the room called name, creating the room if allowed
+func (h *Hub) join(c *Client, name string) error {
+	if c.rooms[name] {
+		return nil
+	}
+
+	if err := h.access(name, c.user.guest); err != nil {
+		return err
+	}
+	r, ok := h.rooms[name]
+	switch {
+	case h.cfg.MaxRoomsPerClient > 0 && len(c.rooms) >= h.cfg.MaxRoomsPerClient:
+		return &ProtocolError{Code: CodeTooManyRooms, Msg: "too many rooms joined"}
+	case ok && r.cfg.MaxMembers > 0 && len(r.members) >= r.cfg.MaxMembers:
+		return &ProtocolError{Code: CodeRoomFull, Msg: "room " + name + " is full"}
+	}
+
+	if !ok {
+		r = h.newRoom(name, h.cfg.RoomDefaults)
+		h.rooms[name] = r
+	}
+	r.members[c] = true
+	c.rooms[name] = true
+	return nil
+}
+
+// access checks that a user, who is a guest if guest is set, may join or read the
+// room called name
+func (h *Hub) access(name string, guest bool) error {
+	r, ok := h.rooms[name]
+	cfg := h.cfg.RoomDefaults
+	if ok {
+		cfg = r.cfg
+	}
+	switch {
+	case !ok && !h.cfg.AllowCreate:
+		return &ProtocolError{Code: CodeNoSuchRoom, Msg: "no room called " + name}
+	case cfg.Authenticated && guest:
+		return &ProtocolError{Code: CodeSignInRequired, Msg: "sign in to join " + name}
+	}
+	return nil
+}
+
+// leave removes c from the room called name, dropping the room if it is empty and not persistent
+func (h *Hub) leave(c *Client, name string) {
+	r, ok := h.rooms[name]
+	if !ok {
+		return
+	}
+	delete(r.members, c)
+	delete(c.rooms, name)
+	if len(r.members) == 0 && !r.cfg.Persistent {
+		delete(h.rooms, name)
+	}
+}
+
+// endSession closes the connections of the sign in session id
+func (h *Hub) endSession(ctx context.Context, id string) error {
+	return h.signOut(ctx, func(c *Client) bool { return c.identity.Session == id })
+}
+
+// endUser closes the connections of the user id, whose account was deleted, and
+// drops the direct messages waiting for them
+func (h *Hub) endUser(ctx context.Context, id string) error {
+	if err := h.signOut(ctx, func(c *Client) bool { return c.identity.UserID == id }); err != nil {
+		return err
+	}
+	return h.do(ctx, func() {
+		delete(h.accountNames, h.accounts[id])
+		delete(h.accounts, id)
+		delete(h.seen, id)
+		delete(h.offline, id)
+	})
+}
+
+// addAccount makes a new account known, so it can be sent direct messages before it
+// first connects and guests cannot take its name
+func (h *Hub) addAccount(ctx context.Context, id, name string) error {
+	return h.do(ctx, func() { h.setAccount(id, name) })
+}
+
+// setAccount records the account of the user id called name
+func (h *Hub) setAccount(id, name string) {
+	name = strings.ToLower(name)
+	h.accounts[id] = name
+	h.accountNames[name] = id
+}
+
+// signOut closes the connections that match
+func (h *Hub) signOut(ctx context.Context, match func(c *Client) bool) error {
+	return h.do(ctx, func() {
+		for c := range h.clients {
+			if match(c) {
+				c.token = "" // a signed out connection cannot be resumed
+				h.remove(c)
+			}
+		}
+	})
+}
+
+// broadcast sends m to every member of the room called name
+func (h *Hub) broadcast(name string, m *Message) {
+	r, ok := h.rooms[name]
+	if !ok {
+		return
+	}
+	for client := range r.members {
+		h.deliver(client, m)
+	}
+}
+
+// deliver queues m for c, applying the slow client policy if its buffer is full.
+// A client that lost messages is told how many once it has room again.
+func (h *Hub) deliver(c *Client, m *Message) {
+	if c.dropped > 0 && len(c.send) < cap(c.send)-1 {
+		c.send <- droppedMessage(c.dropped)
+		c.dropped = 0
+	}
+	select {
+	case c.send <- m:
+	default:
+		h.overflow(c, m)
+	}
+}
+
+// remove unregisters c, takes it out of its rooms and closes its send channel. A
+// user goes offline with their last connection, and leaves a room with their last
+// connection in it.
+func (h *Hub) remove(c *Client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+
+	u := c.user
+	delete(u.conns, c)
+	if len(u.conns) == 0 {
+		// the rooms of the last connection are the rooms the user was in
+		u.status = StatusOffline
+		h.presenceVia(u, map[*Client]bool{c: true})
+		delete(h.users, u.id)
+		if h.cfg.OfflineQueue > 0 {
+			h.expireOffline(time.Now())
+			h.seen[u.id] = time.Now()
+		}
+	}
+
+	h.keepResume(c)
+	for name := range c.rooms {
+		h.leave(c, name)
+		if inRoom(u, name) {
+			continue
+		}
+		m := &Message{Type: TypeLeave, Room: name}
+		h.sign(c, m)
+		h.broadcast(name, m)
+	}
+	close(c.send)
+}
+
+// inRoom reports whether a connection of u is in the room called name
+func inRoom(u *user, name string) bool {
+	for c := range u.conns {
+		if c.rooms[name] {
+			return true
+		}
 	}
+	return false
 }
@@ -1,3 +1,327 @@
 package chat
 
-// TODO add test
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aljo242/koch/config"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHubRejectsInvalidMessages(t *testing.T) {
+	t.Parallel()
+	_, url := newTestServer(t)
+
+	conn := dial(t, url, false)
+	readType(t, conn, TypePresence)
+	for _, tc := range []struct {
+		msg  Message
+		code string
+	}{
+		{Message{Type: TypeMessage, ID: "empty", Body: "  "}, CodeInvalidMessage},
+		{Message{Type: TypeAck, ID: "ack"}, CodeUnsupportedType},
+		{Message{Version: 9, Type: TypeMessage, ID: "v9", Body: "hi"}, CodeInvalidMessage},
+		{Message{Type: TypeJoin, ID: "name", Sender: "\x07bell"}, CodeInvalidMessage},
+	} {
+		require.NoError(t, conn.WriteJSON(tc.msg))
+		m := readAny(t, conn)
+		require.Equal(t, TypeError, m.Type, tc.msg.ID)
+		require.Equal(t, tc.code, m.Metadata[MetaCode], tc.msg.ID)
+		require.Equal(t, tc.msg.ID, m.Metadata[MetaRef])
+	}
+}
+
+func TestHubBroadcastsLeave(t *testing.T) {
+	t.Parallel()
+	hub, url := newTestServer(t)
+
+	alice := dial(t, url, false)
+	bob := dial(t, url, false)
+	waitMembers(t, hub, "lobby", 2)
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeJoin, Sender: "bob"}))
+	for readType(t, alice, TypeJoin).Sender != "bob" {
+	}
+
+	require.NoError(t, bob.Close())
+	m := readType(t, alice, TypePresence)
+	require.Equal(t, "bob", m.Sender)
+	require.Equal(t, StatusOffline, m.Body)
+	m = readType(t, alice, TypeLeave)
+	require.Equal(t, "bob", m.Sender)
+
+	// a user with two connections leaves with the last of them
+	dialer := websocket.Dialer{Subprotocols: []string{Protocol}}
+	header := http.Header{"Cookie": {GuestCookie + "=" + strings.Repeat("ab", guestTokenLength)}}
+	carol1, _, err := dialer.Dial(url, header)
+	require.NoError(t, err)
+	defer carol1.Close()
+	carol2, _, err := dialer.Dial(url, header)
+	require.NoError(t, err)
+	waitMembers(t, hub, "lobby", 3)
+
+	require.NoError(t, carol2.Close())
+	waitMembers(t, hub, "lobby", 2)
+	require.NoError(t, carol1.WriteJSON(Message{Type: TypeMessage, Body: "still here"}))
+	require.Equal(t, TypeMessage, readType(t, alice, TypeMessage, TypeLeave).Type)
+
+	require.NoError(t, carol1.Close())
+	require.Equal(t, TypeLeave, readType(t, alice, TypeMessage, TypeLeave).Type)
+}
+
+func TestHubRooms(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Rooms["tiny"] = RoomConfig{MaxMembers: 1, Persistent: true}
+	hub, srv := newTestServerConfig(t, cfg)
+
+	alice := dial(t, wsURL(srv, "/ws"), false)
+	bob := dial(t, wsURL(srv, "/ws/Tiny"), false)
+	waitMembers(t, hub, "tiny", 1)
+
+	// a full room rejects further members
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeJoin, ID: "j1", Room: "tiny"}))
+	m := readType(t, alice, TypeError)
+	require.Equal(t, CodeRoomFull, m.Metadata[MetaCode])
+
+	// one connection can be in several rooms, and only members receive a room's messages
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeJoin, Sender: "alice", Room: "games"}))
+	require.Equal(t, "games", readType(t, alice, TypeJoin).Room)
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeMessage, Room: "lobby", Body: "hi lobby"}))
+	m = readType(t, alice, TypeMessage)
+	require.Equal(t, "lobby", m.Room)
+
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeMessage, ID: "b1", Room: "games", Body: "let me in"}))
+	m = readType(t, bob, TypeError)
+	require.Equal(t, CodeNotMember, m.Metadata[MetaCode])
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeMessage, Body: "tiny talk"}))
+	m = readType(t, bob, TypeMessage)
+	require.Equal(t, "tiny", m.Room)
+	require.Equal(t, "tiny talk", m.Body)
+
+	rooms, err := hub.Rooms(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []RoomInfo{
+		{Name: "games", Members: 1, MaxMembers: 100},
+		{Name: "lobby", Members: 1},
+		{Name: "tiny", Members: 1, MaxMembers: 1},
+	}, rooms)
+
+	// rooms created by clients disappear with their last member
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeLeave, Room: "games"}))
+	waitMembers(t, hub, "games", 0)
+
+	res, err := http.Get(srv.URL + "/rooms")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var listed []RoomInfo
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&listed))
+	require.Len(t, listed, 2)
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	require.NoError(t, cfg.Validate())
+
+	cfg.DefaultRoom = "nowhere"
+	cfg.Rooms["bad name!"] = RoomConfig{MaxMembers: -1}
+	cfg.History.Replay = cfg.History.Size + 1
+	cfg.Flood.ByteBurst = int(cfg.Connection.MaxMessageSize) - 1
+	cfg.Moderation.Filters = []FilterConfig{{Pattern: "(", Action: "hide"}, {Words: []string{""}, Action: FilterReject}}
+	var verr *config.ValidationError
+	require.ErrorAs(t, cfg.Validate(), &verr)
+	require.Len(t, verr.Errors, 8)
+	require.Contains(t, verr.Errors, config.FieldError{Key: "moderation.filters.1.words", Msg: errBlankWord.Error()})
+}
+
+// joinAs joins the default room under name and returns the user id, waiting for the join broadcast
+func joinAs(t *testing.T, conn *websocket.Conn, name string) string {
+	t.Helper()
+
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeJoin, Sender: name}))
+	for {
+		if m := readType(t, conn, TypeJoin, TypeError); m.Sender == name || m.Type == TypeError {
+			require.Equal(t, TypeJoin, m.Type, m.Body)
+			return m.SenderID
+		}
+	}
+}
+
+func TestHubDirectMessages(t *testing.T) {
+	t.Parallel()
+	_, url := newTestServer(t)
+
+	alice, bob, carol := dial(t, url, false), dial(t, url, false), dial(t, url, false)
+	joinAs(t, alice, "alice")
+	bobID := joinAs(t, bob, "bob")
+	joinAs(t, carol, "carol")
+
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeDirect, ID: "d1", To: bobID, Body: "psst"}))
+	ack := readType(t, alice, TypeAck)
+	require.Equal(t, "d1", ack.Metadata[MetaRef])
+
+	m := readType(t, bob, TypeDirect)
+	require.Equal(t, "alice", m.Sender)
+	require.Equal(t, bobID, m.To)
+	require.Equal(t, ack.ID, m.ID)
+
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeDirect, ID: "d2", To: "g-nobody", Body: "hello?"}))
+	m = readType(t, alice, TypeError)
+	require.Equal(t, CodeUserOffline, m.Metadata[MetaCode])
+
+	// carol never sees the direct message
+	require.NoError(t, carol.WriteJSON(Message{Type: TypeMessage, Body: "anyone?"}))
+	require.Equal(t, "anyone?", readType(t, carol, TypeMessage, TypeDirect).Body)
+
+	// clients only set the metadata meant for them
+	forged := map[string]string{MetaAction: "true", MetaQueued: "true", MetaRef: "d1", MetaCommand: "me", MetaFormat: FormatText}
+	require.NoError(t, carol.WriteJSON(Message{Type: TypeMessage, Body: "waves", Metadata: forged}))
+	require.Equal(t, "anyone?", readType(t, bob, TypeMessage).Body)
+	require.Equal(t, map[string]string{MetaFormat: FormatText}, readType(t, bob, TypeMessage).Metadata)
+	require.NoError(t, carol.WriteJSON(Message{Type: TypeDirect, To: bobID, Body: "psst", Metadata: forged}))
+	require.Equal(t, map[string]string{MetaFormat: FormatText}, readType(t, bob, TypeDirect).Metadata)
+}
+
+func TestHubOfflineQueue(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.OfflineQueue = 2
+	cfg.OfflineUsers = 1
+	hub, srv := newTestServerConfig(t, cfg)
+
+	// dave's browser keeps its guest cookie across connections
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	dialer := websocket.Dialer{Jar: jar, Subprotocols: []string{Protocol}}
+	dave, _, err := dialer.Dial(wsURL(srv, "/ws"), nil)
+	require.NoError(t, err)
+	daveID := joinAs(t, dave, "dave")
+	require.NoError(t, dave.Close())
+
+	alice := dial(t, wsURL(srv, "/ws"), false)
+	joinAs(t, alice, "alice")
+	for _, body := range []string{"one", "two", "three"} {
+		require.NoError(t, alice.WriteJSON(Message{Type: TypeDirect, To: daveID, Body: body}))
+		for {
+			ack := readType(t, alice, TypeAck, TypeError)
+			require.Equal(t, TypeAck, ack.Type, ack.Body)
+			if ack.Metadata[MetaQueued] == "true" {
+				break
+			}
+		}
+	}
+
+	// only users the hub knows get queues, and only so many of them
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeDirect, ID: "d1", To: "g-nobody", Body: "hello?"}))
+	require.Equal(t, CodeNoSuchUser, readType(t, alice, TypeError).Metadata[MetaCode])
+	erin := dial(t, wsURL(srv, "/ws"), false)
+	erinID := joinAs(t, erin, "erin")
+	require.NoError(t, erin.Close())
+	waitMembers(t, hub, "lobby", 1)
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeDirect, ID: "d2", To: erinID, Body: "hello?"}))
+	require.Equal(t, CodeUserOffline, readType(t, alice, TypeError).Metadata[MetaCode])
+
+	// the newest messages are delivered when dave is back
+	dave, _, err = dialer.Dial(wsURL(srv, "/ws"), nil)
+	require.NoError(t, err)
+	defer dave.Close()
+	require.Equal(t, "two", readType(t, dave, TypeDirect).Body)
+	require.Equal(t, "three", readType(t, dave, TypeDirect).Body)
+}
+
+func TestExpireOffline(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub()
+	h.cfg.OfflineTTL = time.Hour
+	now := time.Now()
+	h.seen["g-old"] = now.Add(-2 * time.Hour)
+	h.seen["g-new"] = now
+	h.offline["g-old"] = []*Message{{Timestamp: now.Add(-2 * time.Hour)}}
+	h.offline["g-new"] = []*Message{{Body: "old", Timestamp: now.Add(-2 * time.Hour)}, {Body: "new", Timestamp: now}}
+
+	h.expireOffline(now)
+	require.Equal(t, map[string]time.Time{"g-new": now}, h.seen)
+	require.Len(t, h.offline, 1)
+	require.Equal(t, []string{"new"}, bodies(h.offline["g-new"]))
+}
+
+func TestHubIdentity(t *testing.T) {
+	t.Parallel()
+	_, url := newTestServer(t)
+
+	alice := dial(t, url, false)
+	joinAs(t, alice, "alice")
+
+	// guests get generated names and nicknames are unique per room
+	bob := dial(t, url, false)
+	snapshot := readType(t, bob, TypePresence)
+	require.Len(t, snapshot.Users, 2)
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeJoin, ID: "j1", Sender: "ALICE"}))
+	m := readType(t, bob, TypeError)
+	require.Equal(t, CodeNameTaken, m.Metadata[MetaCode])
+
+	// the sender cannot be spoofed
+	require.NoError(t, bob.WriteJSON(Message{Type: TypeMessage, Sender: "alice", Body: "it's me, alice"}))
+	m = readType(t, alice, TypeMessage)
+	require.NotEqual(t, "alice", m.Sender)
+	require.True(t, strings.HasPrefix(m.Sender, "guest-"))
+
+	// presence changes reach the room
+	require.NoError(t, bob.WriteJSON(Message{Type: TypePresence, Body: StatusAway}))
+	m = readType(t, alice, TypePresence)
+	require.Equal(t, StatusAway, m.Body)
+	require.Equal(t, snapshotID(snapshot, m.Sender), m.SenderID)
+}
+
+func snapshotID(snapshot Message, name string) string {
+	for _, u := range snapshot.Users {
+		if u.Name == name {
+			return u.ID
+		}
+	}
+	return ""
+}
+
+func TestHubStop(t *testing.T) {
+	t.Parallel()
+	m, srv := newTestModule(t, DefaultConfig(), nil)
+	hub := m.Hub()
+
+	alice := dial(t, wsURL(srv, "/ws"), false)
+	bob := dial(t, wsURL(srv, "/ws"), true)
+	waitMembers(t, hub, "lobby", 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, m.Stop(ctx))
+	require.NoError(t, m.Stop(ctx), "stopping twice is fine")
+	require.ErrorIs(t, m.Health(ctx), ErrStopped)
+	_, err := hub.Rooms(ctx)
+	require.ErrorIs(t, err, ErrStopped)
+
+	// every client is told why it was closed, and new ones are turned away
+	for _, conn := range []*websocket.Conn{alice, bob, dial(t, wsURL(srv, "/ws"), false)} {
+		for {
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+			if _, _, err = conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		var cerr *websocket.CloseError
+		require.ErrorAs(t, err, &cerr)
+		require.Equal(t, websocket.CloseGoingAway, cerr.Code)
+		require.Equal(t, "server is shutting down", cerr.Text)
+	}
+}
@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	// GuestCookie holds the secret token that keeps a guest's user id across connections
+	GuestCookie = "koch_chat_guest"
+
+	// guestTokenLength is the number of random bytes in a guest token
+	guestTokenLength = 16
+
+	// guestCookieMaxAge is how long a browser keeps its guest identity
+	guestCookieMaxAge = 365 * 24 * time.Hour
+)
+
+var guestTokenPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Presence statuses of a user
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// Identity is who the server knows a connection to be. The hub, not the client,
+// owns the identity of every connection.
+type Identity struct {
+	// UserID is stable for the lifetime of the session and is shared by every connection of a user
+	UserID string
+
+	// Name is the preferred nickname; guests without one get a generated name
+	Name string
+
+	// Guest is set for users who did not sign in
+	Guest bool
+
+	// Session is the id of the sign in session of the connection, empty for guests.
+	// Connections are closed when their session ends.
+	Session string
+}
+
+// IdentifyFunc returns the identity of a WebSocket upgrade request. Headers added to
+// header, such as a Set-Cookie, are sent with the upgrade response. An error
+// rejects the connection with 401 Unauthorized.
+type IdentifyFunc func(r *http.Request, header http.Header) (Identity, error)
+
+// GuestIdentity identifies a browser by a random token kept in GuestCookie, issuing a
+// new token on first contact. The user id is derived from the token, so it can be
+// shown to others without revealing the token.
+func GuestIdentity(r *http.Request, header http.Header) (Identity, error) {
+	token := ""
+	if c, err := r.Cookie(GuestCookie); err == nil && guestTokenPattern.MatchString(c.Value) {
+		token = c.Value
+	}
+
+	if token == "" {
+		b := make([]byte, guestTokenLength)
+		if _, err := rand.Read(b); err != nil {
+			return Identity{}, fmt.Errorf("error generating guest token : %w", err)
+		}
+		token = hex.EncodeToString(b)
+		cookie := &http.Cookie{
+			Name:     GuestCookie,
+			Value:    token,
+			Path:     "/",
+			MaxAge:   int(guestCookieMaxAge / time.Second),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		}
+		header.Add("Set-Cookie", cookie.String())
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return Identity{UserID: "g-" + hex.EncodeToString(sum[:8]), Guest: true}, nil
+}
+
+// guestName generates a nickname for a guest
+func guestName() string {
+	b := make([]byte, 2)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return "guest-" + hex.EncodeToString(b)
+}
+
+// UserInfo describes a user in presence updates and who's online snapshots
+type UserInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Guest  bool   `json:"guest,omitempty"`
+
+	Moderator bool `json:"moderator,omitempty"`
+}
+
+// user is an identity with at least one connection, owned by the hub goroutine
+type user struct {
+	id     string
+	name   string
+	status string
+	guest  bool
+	conns  map[*Client]bool
+
+	// account is the name of the user's account, which no one else may use, empty for guests
+	account string
+
+	moderator bool
+}
+
+func (u *user) info() UserInfo {
+	return UserInfo{ID: u.id, Name: u.name, Status: u.status, Guest: u.guest, Moderator: u.moderator}
+}
@@ -0,0 +1,119 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aljo242/koch/account"
+	"github.com/aljo242/koch/storage"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleAccounts(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Rooms["members"] = RoomConfig{Authenticated: true}
+	cfg.OfflineQueue = 1
+	store := storage.NewMemory()
+	_, srv := newTestModule(t, cfg, store)
+
+	// starting migrates the chat and account buckets
+	for _, scope := range []string{ModuleName, account.Scope} {
+		version, err := storage.Version(context.Background(), store, scope)
+		require.NoError(t, err)
+		require.EqualValues(t, 1, version, scope)
+	}
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+	resp, err := client.PostForm(srv.URL+"/signup", url.Values{"name": {"alice"}, "password": {"password1"}})
+	require.NoError(t, err)
+	var acct struct{ ID string }
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&acct))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// guests cannot join authenticated rooms or take the name of an account
+	guest := dial(t, wsURL(srv, "/ws"), false)
+	require.NoError(t, guest.WriteJSON(Message{Type: TypeJoin, ID: "j1", Room: "members"}))
+	require.Equal(t, CodeSignInRequired, readType(t, guest, TypeError).Metadata[MetaCode])
+	require.NoError(t, guest.WriteJSON(Message{Type: TypeJoin, ID: "j2", Sender: "Alice"}))
+	require.Equal(t, CodeNameTaken, readType(t, guest, TypeError).Metadata[MetaCode])
+
+	// accounts are sent direct messages before they first connect
+	require.NoError(t, guest.WriteJSON(Message{Type: TypeDirect, ID: "d1", To: "u-" + acct.ID, Body: "welcome"}))
+	require.Equal(t, "true", readType(t, guest, TypeAck).Metadata[MetaQueued])
+
+	// the session cookie signs the connection in under the account name
+	dialer := websocket.Dialer{Jar: jar, Subprotocols: []string{Protocol}}
+	alice, _, err := dialer.Dial(wsURL(srv, "/ws"), nil)
+	require.NoError(t, err)
+	defer alice.Close()
+	require.Equal(t, "welcome", readType(t, alice, TypeDirect).Body)
+	m := readType(t, alice, TypeJoin)
+	require.Equal(t, "alice", m.Sender)
+	require.True(t, strings.HasPrefix(m.SenderID, "u-"))
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeJoin, ID: "j3", Room: "members"}))
+	require.Equal(t, "members", readType(t, alice, TypeJoin).Room)
+
+	// only signed in users read the history of authenticated rooms
+	_, status := getHistory(t, srv, "members", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+	resp, err = client.Get(srv.URL + "/rooms/members/history")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// signing out closes the connections of the session
+	resp, err = client.PostForm(srv.URL+"/signout", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NoError(t, alice.SetReadDeadline(time.Now().Add(2*time.Second)))
+	for {
+		if _, _, err := alice.ReadMessage(); err != nil {
+			require.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived), err)
+			break
+		}
+	}
+}
+
+func TestModuleReservedNames(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// accounts created before the module starts are loaded with it
+	store := storage.NewMemory()
+	accounts := account.New(store, account.DefaultConfig())
+	acct, err := accounts.SignUp(ctx, "carol", "password1")
+	require.NoError(t, err)
+	m, srv := newTestModule(t, DefaultConfig(), store)
+
+	guest := dial(t, wsURL(srv, "/ws"), false)
+	require.NoError(t, guest.WriteJSON(Message{Type: TypeJoin, ID: "j1", Sender: "Carol"}))
+	require.Equal(t, CodeNameTaken, readType(t, guest, TypeError).Metadata[MetaCode])
+
+	// deleting the account frees its name
+	require.NoError(t, m.accounts.Delete(ctx, acct.ID))
+	joinAs(t, guest, "Carol")
+}
+
+func TestModuleAnonymousOff(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Anonymous = false
+	_, srv := newTestModule(t, cfg, storage.NewMemory())
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv, "/ws"), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,360 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// Protocol is the WebSocket subprotocol of clients that speak the JSON envelope.
+	// Clients that do not request it are served as legacy plain-text clients.
+	Protocol = "koch.chat.v1"
+
+	// ProtocolVersion is the envelope version understood by the server
+	ProtocolVersion = 1
+
+	// Maximum length of a message body in bytes
+	maxBodyLength = 2048
+
+	// Maximum length of a sender name in characters
+	maxNameLength = 32
+
+	// Maximum number of metadata entries and the length of each key and value
+	maxMetadata       = 16
+	maxMetadataLength = 256
+
+	// MetaRef is the metadata key of acks and errors that holds the client's id of the
+	// message they answer
+	MetaRef = "ref"
+
+	// MetaCode is the metadata key of errors that holds a machine readable error code
+	MetaCode = "code"
+
+	// MetaQueued is set on the ack of a direct message kept for an offline recipient
+	MetaQueued = "queued"
+
+	// MetaFormat is the metadata key of messages that are plain text, set to text,
+	// when the hub renders Markdown
+	MetaFormat = "format"
+
+	// MetaAction is set to true on room messages that describe what their sender is
+	// doing, sent with /me
+	MetaAction = "action"
+
+	// MetaCommand is the metadata key of replies that holds the name of the command they answer
+	MetaCommand = "command"
+
+	// MetaMessage is the metadata key of reports that holds the id of the reported message
+	MetaMessage = "message"
+)
+
+// clientMeta lists the metadata keys clients may set on the messages the hub passes on
+var clientMeta = []string{MetaFormat}
+
+// MessageType is the kind of a Message
+type MessageType string
+
+// Message types. Clients send message, direct, join, leave, presence, history and
+// report requests; the server sends every type.
+const (
+	TypeMessage  MessageType = "message"
+	TypeDirect   MessageType = "direct"
+	TypeJoin     MessageType = "join"
+	TypeLeave    MessageType = "leave"
+	TypeError    MessageType = "error"
+	TypeAck      MessageType = "ack"
+	TypePresence MessageType = "presence"
+	TypeHistory  MessageType = "history"
+	TypeResume   MessageType = "resume"
+
+	// TypeAnnouncement is a notice from the server, such as one posted by an admin
+	TypeAnnouncement MessageType = "announcement"
+
+	// TypeReport reports a room message to the moderators. Clients name the id of the
+	// message in the message metadata and may give a reason in Body; moderators get
+	// the reported message in History.
+	TypeReport MessageType = "report"
+
+	// TypeReply answers a slash command to the client that sent it, see Command
+	TypeReply MessageType = "reply"
+)
+
+// Error codes sent in the code metadata of error messages
+const (
+	CodeInvalidMessage  = "invalid_message"
+	CodeUnsupportedType = "unsupported_type"
+	CodeNotMember       = "not_member"
+	CodeNoSuchRoom      = "no_such_room"
+	CodeRoomFull        = "room_full"
+	CodeTooManyRooms    = "too_many_rooms"
+	CodeUserOffline     = "user_offline"
+	CodeNameTaken       = "name_taken"
+	CodeResync          = "resync"
+	CodeSignInRequired  = "sign_in_required"
+	CodeRateLimited     = "rate_limited"
+	CodeMuted           = "muted"
+	CodeSlowMode        = "slow_mode"
+	CodeDropped         = "dropped"
+	CodeForbidden       = "forbidden"
+	CodeFiltered        = "filtered"
+	CodeNoSuchUser      = "no_such_user"
+	CodeUnknownCommand  = "unknown_command"
+	CodeCommandFailed   = "command_failed"
+)
+
+// Message is the versioned JSON envelope of everything sent over a chat WebSocket.
+// The server assigns ID, Sender, SenderID and Timestamp; values sent by clients are
+// replaced. Direct messages name the user id of their recipient in To instead of a
+// Room. Presence messages carry a status in Body, or a who's online snapshot of a
+// room in Users. History requests ask for up to Limit messages of a room before
+// Cursor; the reply holds them in History, oldest first, with the Cursor of the
+// previous page. Room messages are numbered by Seq, which increases by one with
+// every message sent to the room. A resume message gives a client the Token to
+// resume its connection with, see ServeWs. Announcements come from the server
+// itself and have no SenderID. The server renders the Body of room and direct
+// messages and announcements into sanitized HTML, which clients show instead of
+// the body; HTML sent by clients is replaced.
+type Message struct {
+	Version   int               `json:"version"`
+	Type      MessageType       `json:"type"`
+	ID        string            `json:"id,omitempty"`
+	Sender    string            `json:"sender,omitempty"`
+	SenderID  string            `json:"senderId,omitempty"`
+	Room      string            `json:"room,omitempty"`
+	To        string            `json:"to,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Users     []UserInfo        `json:"users,omitempty"`
+	Cursor    string            `json:"cursor,omitempty"`
+	Limit     int               `json:"limit,omitempty"`
+	History   []*Message        `json:"history,omitempty"`
+	Seq       uint64            `json:"seq,omitempty"`
+	Token     string            `json:"token,omitempty"`
+	HTML      string            `json:"html,omitempty"`
+}
+
+// ProtocolError is a message the server rejected, reported to the sender as an error message
+type ProtocolError struct {
+	Code string
+	Msg  string
+
+	// Ref is the client's id of the rejected message, if it had one
+	Ref string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+// withMeta sets key in metadata, allocating it if needed
+func withMeta(metadata map[string]string, key, value string) map[string]string {
+	if metadata == nil {
+		metadata = make(map[string]string)
+	}
+	metadata[key] = value
+	return metadata
+}
+
+// withRef sets the client message id that a ProtocolError answers
+func withRef(err error, ref string) error {
+	var perr *ProtocolError
+	if errors.As(err, &perr) && perr.Ref == "" {
+		copied := *perr
+		copied.Ref = ref
+		return &copied
+	}
+	return err
+}
+
+// decodeMessage parses a frame received from a client. Frames that are not JSON
+// objects come from legacy clients and become the body of a plain message.
+func decodeMessage(frame []byte) (*Message, error) {
+	trimmed := bytes.TrimSpace(frame)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return &Message{Version: ProtocolVersion, Type: TypeMessage, Body: string(frame)}, validateBody(string(frame), "")
+	}
+
+	var m Message
+	if err := json.Unmarshal(trimmed, &m); err != nil {
+		return nil, &ProtocolError{Code: CodeInvalidMessage, Msg: "malformed JSON envelope"}
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// validate checks a message received from a client
+func (m *Message) validate() error {
+	ref := m.ID
+	if m.Version == 0 {
+		m.Version = ProtocolVersion
+	}
+	if m.Version != ProtocolVersion {
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: fmt.Sprintf("unsupported version %v", m.Version), Ref: ref}
+	}
+
+	switch m.Type {
+	case TypeMessage:
+		if err := validateBody(m.Body, ref); err != nil {
+			return err
+		}
+	case TypeDirect:
+		if err := validateBody(m.Body, ref); err != nil {
+			return err
+		}
+		if m.To == "" || len(m.To) > maxNameLength*2 {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "direct messages need the user id of the recipient in to", Ref: ref}
+		}
+	case TypePresence:
+		if m.Body != StatusOnline && m.Body != StatusAway {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "presence must be online or away", Ref: ref}
+		}
+	case TypeHistory:
+		if m.Limit < 0 {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "limit must not be negative", Ref: ref}
+		}
+		if _, err := parseCursor(m.Cursor); err != nil {
+			return withRef(err, ref)
+		}
+	case TypeReport:
+		if m.Metadata[MetaMessage] == "" {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "reports need the id of the reported message in the message metadata", Ref: ref}
+		}
+		if len(m.Body) > maxReason || !utf8.ValidString(m.Body) {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: fmt.Sprintf("the reason must be valid UTF-8 of at most %v bytes", maxReason), Ref: ref}
+		}
+	case TypeJoin, TypeLeave:
+	default:
+		return &ProtocolError{Code: CodeUnsupportedType, Msg: fmt.Sprintf("clients may not send %q messages", m.Type), Ref: ref}
+	}
+
+	if len(m.Metadata) > maxMetadata {
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: fmt.Sprintf("at most %v metadata entries are allowed", maxMetadata), Ref: ref}
+	}
+	for k, v := range m.Metadata {
+		if len(k) > maxMetadataLength || len(v) > maxMetadataLength {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "metadata entry too long", Ref: ref}
+		}
+	}
+	return nil
+}
+
+func validateBody(body, ref string) error {
+	switch {
+	case strings.TrimSpace(body) == "":
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "body must not be empty", Ref: ref}
+	case len(body) > maxBodyLength:
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: fmt.Sprintf("body exceeds %v bytes", maxBodyLength), Ref: ref}
+	case !utf8.ValidString(body):
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "body must be valid UTF-8", Ref: ref}
+	case strings.IndexFunc(body, isControl) >= 0:
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "body must not contain control characters", Ref: ref}
+	}
+	return nil
+}
+
+// isControl reports whether r is a control character other than a tab or line break
+func isControl(r rune) bool {
+	return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+}
+
+// cleanName trims a client supplied name and reports whether it is acceptable
+func cleanName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+		return "", false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// newID returns a random message id
+func newID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(b)
+}
+
+// stamp assigns a server id and timestamp to m
+func (m *Message) stamp() {
+	m.Version = ProtocolVersion
+	m.ID = newID()
+	m.Timestamp = time.Now().UTC()
+}
+
+// errorMessage reports err to a client
+func errorMessage(err error) *Message {
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		perr = &ProtocolError{Code: CodeInvalidMessage, Msg: err.Error()}
+	}
+	m := &Message{Type: TypeError, Body: perr.Msg, Metadata: map[string]string{MetaCode: perr.Code}}
+	if perr.Ref != "" {
+		m.Metadata[MetaRef] = perr.Ref
+	}
+	m.stamp()
+	return m
+}
+
+// ackMessage confirms to its sender that the message with the client id ref was
+// accepted. The ack carries the id the server assigned to the message.
+func ackMessage(ref, id string) *Message {
+	m := &Message{Type: TypeAck}
+	if ref != "" {
+		m.Metadata = map[string]string{MetaRef: ref}
+	}
+	m.stamp()
+	m.ID = id
+	return m
+}
+
+// encode renders m for a client: JSON for protocol clients and a line of text for
+// legacy clients. Legacy clients show lines as HTML, so the line is escaped. It
+// returns nil for messages legacy clients do not understand.
+func (m *Message) encode(legacy bool) ([]byte, error) {
+	if !legacy {
+		return json.Marshal(m)
+	}
+
+	var line string
+	switch m.Type {
+	case TypeMessage:
+		if m.Metadata[MetaAction] == "true" {
+			line = "* " + m.Sender + " " + m.Body
+		} else {
+			line = m.Sender + ": " + m.Body
+		}
+	case TypeDirect:
+		line = m.Sender + " (private): " + m.Body
+	case TypeJoin:
+		line = m.Sender + " joined " + m.Room
+	case TypeLeave:
+		line = m.Sender + " left " + m.Room
+	case TypeError:
+		line = "error: " + m.Body
+	case TypeAnnouncement:
+		line = "announcement: " + m.Body
+	case TypeReply:
+		line = m.Body
+	default:
+		return nil, nil
+	}
+	return []byte(html.EscapeString(line)), nil
+}
@@ -0,0 +1,48 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	t.Parallel()
+
+	m, err := decodeMessage([]byte(`{"type":"message","id":"c1","body":"a\nb","sender":"spoofed"}`))
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersion, m.Version)
+	require.Equal(t, "a\nb", m.Body)
+
+	// plain text is a legacy message
+	m, err = decodeMessage([]byte("hi\nthere"))
+	require.NoError(t, err)
+	require.Equal(t, TypeMessage, m.Type)
+	require.Equal(t, "hi\nthere", m.Body)
+
+	var perr *ProtocolError
+	_, err = decodeMessage([]byte(`{"type":`))
+	require.True(t, errors.As(err, &perr))
+	require.Equal(t, CodeInvalidMessage, perr.Code)
+
+	_, err = decodeMessage([]byte(`{"type":"ack"}`))
+	require.True(t, errors.As(err, &perr))
+	require.Equal(t, CodeUnsupportedType, perr.Code)
+
+	_, err = decodeMessage([]byte("ring \x07 ring"))
+	require.True(t, errors.As(err, &perr))
+	require.Equal(t, CodeInvalidMessage, perr.Code)
+}
+
+func TestEncodeLegacy(t *testing.T) {
+	t.Parallel()
+
+	frame, err := (&Message{Type: TypeJoin, Sender: "ann", Room: "lobby"}).encode(true)
+	require.NoError(t, err)
+	require.Equal(t, "ann joined lobby", string(frame))
+
+	frame, err = ackMessage("c1", "id").encode(true)
+	require.NoError(t, err)
+	require.Nil(t, frame)
+}
@@ -0,0 +1,677 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aljo242/koch/storage"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// sanctionsBucket holds the bans and mutes in force, keyed by action and target
+	sanctionsBucket = "chat.sanctions"
+
+	// modLogBucket holds the moderation log in the order it was written
+	modLogBucket = "chat.modlog"
+
+	// moderationTimeout bounds loading the sanctions and log before the hub runs
+	moderationTimeout = 5 * time.Second
+
+	// moderationQueue is the number of moderation writes waiting before the hub blocks
+	moderationQueue = 64
+
+	// maxModerateBody bounds the JSON body of a moderation request
+	maxModerateBody = 4 << 10
+
+	// maxReason is the longest reason in bytes kept for a moderation action
+	maxReason = 256
+
+	// AdminModerator is who actions taken through the admin API are logged as taken by
+	AdminModerator = "admin"
+
+	// FilterModerator is who messages flagged by a filter are logged as reported by
+	FilterModerator = "filter"
+)
+
+// Moderation actions. Flag and report are only logged.
+const (
+	ActionKick   = "kick"
+	ActionBan    = "ban"
+	ActionUnban  = "unban"
+	ActionMute   = "mute"
+	ActionUnmute = "unmute"
+	ActionFlag   = "flag"
+	ActionReport = "report"
+)
+
+// Target is who a moderation action applies to: every connection of a user id or
+// every connection from an IP address. Behind a reverse proxy every connection
+// has the address of the proxy, so IP targets are of no use there.
+type Target struct {
+	UserID string `json:"user,omitempty"`
+	IP     string `json:"ip,omitempty"`
+}
+
+func (t Target) String() string {
+	if t.IP != "" {
+		return "ip:" + t.IP
+	}
+	return "user:" + t.UserID
+}
+
+// matches reports whether c is a connection of t
+func (t Target) matches(c *Client) bool {
+	if t.IP != "" {
+		return c.ip == t.IP
+	}
+	return c.user.id == t.UserID
+}
+
+// check normalises the address of t, which must name a user or an address but not both
+func (t *Target) check() error {
+	switch {
+	case (t.UserID == "") == (t.IP == ""):
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "name a user id or an ip address"}
+	case t.IP != "":
+		ip := net.ParseIP(t.IP)
+		if ip == nil {
+			return &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid ip address " + t.IP}
+		}
+		t.IP = ip.String()
+	case len(t.UserID) > maxNameLength*2:
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "invalid user id"}
+	}
+	return nil
+}
+
+// Action is a moderation action: kick, ban, unban, mute or unmute
+type Action struct {
+	Action string
+	Target Target
+
+	// For is how long a ban or mute lasts, 0 until it is lifted
+	For time.Duration
+
+	Reason string
+
+	// By is who took the action: the user id of a moderator, or AdminModerator
+	By string
+}
+
+// Sanction is a ban or mute in force
+type Sanction struct {
+	Action string `json:"action"`
+	Target Target `json:"target"`
+
+	// Until is when the sanction ends, zero if it lasts until it is lifted
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+}
+
+func (s *Sanction) key() string {
+	return sanctionKey(s.Action, s.Target)
+}
+
+func sanctionKey(action string, t Target) string {
+	return action + "/" + t.String()
+}
+
+// active reports whether s is still in force at now
+func (s *Sanction) active(now time.Time) bool {
+	return s.Until.IsZero() || now.Before(s.Until)
+}
+
+// describe tells the sanctioned user about s
+func (s *Sanction) describe(now time.Time) string {
+	text := "banned"
+	if s.Action == ActionMute {
+		text = "muted by a moderator"
+	}
+	if !s.Until.IsZero() {
+		text += " for " + s.Until.Sub(now).Round(time.Second).String()
+	}
+	if s.Reason != "" {
+		text += ": " + s.Reason
+	}
+	return text
+}
+
+// LogEntry is an entry of the moderation log
+type LogEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Target Target    `json:"target"`
+
+	// Until is when a ban or mute ends, if it does
+	Until  *time.Time `json:"until,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+
+	// By is who took the action or reported the message: the user id of a
+	// moderator or reporter, AdminModerator or FilterModerator
+	By string `json:"by"`
+
+	// Message is the flagged or reported message
+	Message *Message `json:"message,omitempty"`
+
+	// Connections is the number of connections that were closed or muted
+	Connections int `json:"connections,omitempty"`
+}
+
+// moderationWrite is a change to the stored sanctions or log, logged as what if it fails
+type moderationWrite struct {
+	what     string
+	sanction string
+	fn       func(tx storage.Tx) error
+}
+
+// moderationStore writes the sanctions and moderation log to a storage.Store in the
+// background, so the hub never waits for the store
+type moderationStore struct {
+	store storage.Store
+
+	writes chan moderationWrite
+	done   chan struct{}
+}
+
+func newModerationStore(s storage.Store) *moderationStore {
+	ms := &moderationStore{
+		store:  s,
+		writes: make(chan moderationWrite, moderationQueue),
+		done:   make(chan struct{}),
+	}
+	go ms.run()
+	return ms
+}
+
+// update queues w to be written
+func (ms *moderationStore) update(w moderationWrite) {
+	ms.writes <- w
+}
+
+// close writes the queued changes and stops the writer
+func (ms *moderationStore) close() {
+	close(ms.writes)
+	<-ms.done
+}
+
+func (ms *moderationStore) run() {
+	defer close(ms.done)
+	for w := range ms.writes {
+		if err := ms.store.Update(context.Background(), w.fn); err != nil {
+			l := log.Error().Err(err)
+			if w.sanction != "" {
+				l = l.Str("sanction", w.sanction)
+			}
+			l.Msg("error " + w.what)
+		}
+	}
+}
+
+// configureModeration sets up the moderators and filters of cfg, and picks up the
+// sanctions and log from the store if there is one
+func (h *Hub) configureModeration(cfg ModerationConfig) {
+	h.moderators = make(map[string]bool)
+	for _, name := range cfg.Moderators {
+		h.moderators[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	h.filters = compileFilters(cfg.Filters)
+	h.sanctions = make(map[string]*Sanction)
+	h.modLog = nil
+	if h.modStore == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	if err := h.loadModeration(ctx); err != nil {
+		log.Error().Err(err).Msg("error loading chat moderation")
+	}
+}
+
+// loadModeration reads the sanctions in force and the latest log entries
+func (h *Hub) loadModeration(ctx context.Context) error {
+	now := time.Now()
+	return h.modStore.store.View(ctx, func(tx storage.Tx) error {
+		sanctions, err := storage.Docs(tx, sanctionsBucket)
+		if err != nil {
+			return err
+		}
+		err = sanctions.ForEach(func(id string, raw json.RawMessage) error {
+			s := &Sanction{}
+			if err := json.Unmarshal(raw, s); err != nil {
+				return fmt.Errorf("error decoding sanction %v : %w", id, err)
+			}
+			if s.active(now) {
+				h.sanctions[s.key()] = s
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		b, err := tx.Bucket(modLogBucket)
+		if err != nil {
+			return err
+		}
+		var entries []LogEntry
+		err = b.Range(nil, true, func(k, v []byte) error {
+			if len(entries) >= h.cfg.Moderation.LogSize {
+				return storage.ErrStop
+			}
+			var e LogEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("error decoding moderation log entry %s : %w", k, err)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		h.modLog = entries
+		return err
+	})
+}
+
+// storeModeration queues w to be written, if there is a store
+func (h *Hub) storeModeration(w moderationWrite) {
+	if h.modStore != nil {
+		h.modStore.update(w)
+	}
+}
+
+// logModeration adds e to the moderation log
+func (h *Hub) logModeration(e LogEntry) {
+	e.Time = time.Now().UTC()
+	log.Info().
+		Str("action", e.Action).
+		Str("target", e.Target.String()).
+		Str("by", e.By).
+		Str("reason", e.Reason).
+		Int("connections", e.Connections).
+		Msg("chat moderation")
+
+	if size := h.cfg.Moderation.LogSize; size > 0 {
+		h.modLog = append(h.modLog, e)
+		if len(h.modLog) > size {
+			h.modLog = append([]LogEntry(nil), h.modLog[len(h.modLog)-size:]...)
+		}
+	}
+	h.storeModeration(moderationWrite{what: "storing chat moderation log", fn: func(tx storage.Tx) error {
+		entries, err := storage.Docs(tx, modLogBucket)
+		if err != nil {
+			return err
+		}
+		_, err = entries.Insert(e)
+		return err
+	}})
+}
+
+// isModerator reports whether u may moderate the chat
+func (h *Hub) isModerator(u *user) bool {
+	return !u.guest && h.moderators[strings.ToLower(u.account)]
+}
+
+// sanctioned returns the sanction of kind in force against c, forgetting expired ones
+func (h *Hub) sanctioned(kind string, c *Client, now time.Time) *Sanction {
+	targets := []Target{{UserID: c.identity.UserID}}
+	if c.ip != "" {
+		targets = append(targets, Target{IP: c.ip})
+	}
+	for _, t := range targets {
+		key := sanctionKey(kind, t)
+		s, ok := h.sanctions[key]
+		if !ok {
+			continue
+		}
+		if s.active(now) {
+			return s
+		}
+		h.lift(key)
+	}
+	return nil
+}
+
+// lift removes the sanction key
+func (h *Hub) lift(key string) {
+	delete(h.sanctions, key)
+	h.storeModeration(moderationWrite{what: "removing chat sanction", sanction: key, fn: func(tx storage.Tx) error {
+		sanctions, err := storage.Docs(tx, sanctionsBucket)
+		if err != nil {
+			return err
+		}
+		return sanctions.Delete(key)
+	}})
+}
+
+// moderate takes the action a, which has been checked, and returns the number of
+// connections it closed or muted
+func (h *Hub) moderate(a Action) (int, error) {
+	now := time.Now()
+	entry := LogEntry{Action: a.Action, Target: a.Target, Reason: a.Reason, By: a.By}
+
+	var conns []*Client
+	for c := range h.clients {
+		if a.Target.matches(c) {
+			conns = append(conns, c)
+		}
+	}
+
+	switch a.Action {
+	case ActionKick:
+		reason := a.Reason
+		if reason == "" {
+			reason = "kicked by a moderator"
+		}
+		for _, c := range conns {
+			c.token = "" // a kicked connection cannot be resumed
+			h.disconnect(c, websocket.ClosePolicyViolation, reason)
+		}
+	case ActionBan, ActionMute:
+		s := &Sanction{Action: a.Action, Target: a.Target, Reason: a.Reason, By: a.By}
+		if a.For > 0 {
+			s.Until = now.Add(a.For).UTC()
+			entry.Until = &s.Until
+		}
+		h.sanctions[s.key()] = s
+		h.storeModeration(moderationWrite{what: "storing chat sanction", sanction: s.key(), fn: func(tx storage.Tx) error {
+			sanctions, err := storage.Docs(tx, sanctionsBucket)
+			if err != nil {
+				return err
+			}
+			return sanctions.Put(s.key(), s)
+		}})
+		for _, c := range conns {
+			if a.Action == ActionBan {
+				c.token = ""
+				h.disconnect(c, websocket.ClosePolicyViolation, s.describe(now))
+			} else {
+				h.deliver(c, errorMessage(&ProtocolError{Code: CodeMuted, Msg: s.describe(now)}))
+			}
+		}
+	case ActionUnban, ActionUnmute:
+		key := sanctionKey(strings.TrimPrefix(a.Action, "un"), a.Target)
+		if s, ok := h.sanctions[key]; !ok || !s.active(now) {
+			return 0, &ProtocolError{Code: CodeInvalidMessage, Msg: fmt.Sprintf("%v has no %v to lift", a.Target, strings.TrimPrefix(a.Action, "un"))}
+		}
+		h.lift(key)
+		conns = nil
+	}
+
+	entry.Connections = len(conns)
+	h.logModeration(entry)
+	return len(conns), nil
+}
+
+// checkAction validates a moderation action before it is taken
+func checkAction(a *Action) error {
+	switch a.Action {
+	case ActionKick, ActionBan, ActionUnban, ActionMute, ActionUnmute:
+	default:
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: fmt.Sprintf("unknown moderation action %q", a.Action)}
+	}
+	if a.For < 0 {
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: "duration must not be negative"}
+	}
+	if len(a.Reason) > maxReason {
+		return &ProtocolError{Code: CodeInvalidMessage, Msg: fmt.Sprintf("reason exceeds %v bytes", maxReason)}
+	}
+	return a.Target.check()
+}
+
+// Moderate takes the action a right away on every connection of its target, and
+// returns how many connections it closed or muted. Bans and mutes also apply to
+// connections made while they are in force.
+func (h *Hub) Moderate(ctx context.Context, a Action) (int, error) {
+	if err := checkAction(&a); err != nil {
+		return 0, err
+	}
+	if a.By == "" {
+		a.By = AdminModerator
+	}
+	n := 0
+	var err error
+	if doErr := h.do(ctx, func() { n, err = h.moderate(a) }); doErr != nil {
+		return 0, doErr
+	}
+	return n, err
+}
+
+// Sanctions lists the bans and mutes in force, sorted by action and target
+func (h *Hub) Sanctions(ctx context.Context) ([]Sanction, error) {
+	sanctions := []Sanction{}
+	err := h.do(ctx, func() {
+		now := time.Now()
+		for _, s := range h.sanctions {
+			if s.active(now) {
+				sanctions = append(sanctions, *s)
+			}
+		}
+	})
+	sort.Slice(sanctions, func(i, j int) bool { return sanctions[i].key() < sanctions[j].key() })
+	return sanctions, err
+}
+
+// ModerationLog returns up to limit of the latest moderation log entries, newest first
+func (h *Hub) ModerationLog(ctx context.Context, limit int) ([]LogEntry, error) {
+	entries := []LogEntry{}
+	err := h.do(ctx, func() {
+		for i := len(h.modLog) - 1; i >= 0 && (limit <= 0 || len(entries) < limit); i-- {
+			entries = append(entries, h.modLog[i])
+		}
+	})
+	return entries, err
+}
+
+// filter applies the filters to a room or direct message from c before it is sent,
+// reporting whether it may be sent and whether it must be flagged once it is
+func (h *Hub) filter(c *Client, m *Message) (ok, flagged bool) {
+	body, reject, flag := applyFilters(h.filters, m.Body)
+	if reject {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeFiltered, Msg: "message rejected by a filter", Ref: m.ID}))
+		return false, false
+	}
+	m.Body = body
+	return true, flag
+}
+
+// flag reports m, which was sent after a flag filter matched it, to the moderators
+func (h *Hub) flag(m *Message) {
+	h.logModeration(LogEntry{Action: ActionFlag, Target: Target{UserID: m.SenderID}, By: FilterModerator, Message: sent(m)})
+	notice := &Message{Type: TypeReport, Room: m.Room, Body: "flagged by a filter", History: []*Message{m}}
+	notice.stamp()
+	h.toModerators(notice)
+}
+
+// report records the report of c on a recent message of the room it names
+func (h *Hub) report(c *Client, m *Message, room string) {
+	ref := m.ID
+	r, ok := h.rooms[room]
+	var reported *Message
+	if ok {
+		reported = r.recent.find(m.Metadata[MetaMessage])
+	}
+	if reported == nil {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeInvalidMessage, Msg: "no recent message " + m.Metadata[MetaMessage] + " in " + room, Ref: ref}))
+		return
+	}
+
+	h.logModeration(LogEntry{Action: ActionReport, Target: Target{UserID: reported.SenderID}, Reason: m.Body, By: c.user.id, Message: reported})
+	h.deliver(c, ackMessage(ref, ""))
+
+	notice := &Message{Type: TypeReport, Room: room, Body: m.Body}
+	h.sign(c, notice)
+	notice.History = []*Message{reported}
+	h.toModerators(notice)
+}
+
+// toModerators delivers m to every connection of the moderators who are online
+func (h *Hub) toModerators(m *Message) {
+	for _, u := range h.users {
+		if !u.moderator {
+			continue
+		}
+		for c := range u.conns {
+			h.deliver(c, m)
+		}
+	}
+}
+
+// moderationCommands returns the slash commands that take moderation actions
+func moderationCommands() []Command {
+	const target = "<name|user id|ip>"
+	return []Command{
+		{Name: ActionKick, Args: target + " [reason]", Help: "close every connection of a user", MinArgs: 1, MaxArgs: 2, Permission: PermissionModerator, Run: runModeration(ActionKick)},
+		{Name: ActionBan, Args: target + " [duration] [reason]", Help: "keep a user out, for a duration such as 1h or until unbanned", MinArgs: 1, MaxArgs: 2, Permission: PermissionModerator, Run: runModeration(ActionBan)},
+		{Name: ActionUnban, Args: target, Help: "lift a ban", MinArgs: 1, MaxArgs: 1, Permission: PermissionModerator, Run: runModeration(ActionUnban)},
+		{Name: ActionMute, Args: target + " [duration] [reason]", Help: "stop a user from sending messages, for a duration such as 10m or until unmuted", MinArgs: 1, MaxArgs: 2, Permission: PermissionModerator, Run: runModeration(ActionMute)},
+		{Name: ActionUnmute, Args: target, Help: "lift a mute", MinArgs: 1, MaxArgs: 1, Permission: PermissionModerator, Run: runModeration(ActionUnmute)},
+	}
+}
+
+// runModeration returns a command taking the moderation action against its first
+// argument. Bans and mutes take an optional duration before the reason.
+func runModeration(action string) CommandFunc {
+	return func(call *Call) error {
+		h := call.hub
+		target, err := h.resolve(call.Args[0])
+		if err != nil {
+			return err
+		}
+
+		a := Action{Action: action, Target: target, By: call.User.ID}
+		if len(call.Args) > 1 {
+			a.Reason = call.Args[1]
+			if fields := strings.Fields(a.Reason); (action == ActionBan || action == ActionMute) && len(fields) > 0 {
+				if d, err := time.ParseDuration(fields[0]); err == nil {
+					a.For = d
+					a.Reason = strings.TrimSpace(strings.TrimPrefix(a.Reason, fields[0]))
+				}
+			}
+		}
+		if err := checkAction(&a); err != nil {
+			return err
+		}
+		n, err := h.moderate(a)
+		if err != nil {
+			return err
+		}
+		call.Reply(fmt.Sprintf("%v %v, %v connections affected", action, target, n))
+		return nil
+	}
+}
+
+// resolve finds the target a moderator named: an ip address, the name of an online
+// user or a user id
+func (h *Hub) resolve(arg string) (Target, error) {
+	if ip := net.ParseIP(arg); ip != nil {
+		return Target{IP: ip.String()}, nil
+	}
+	for _, u := range h.users {
+		if strings.EqualFold(u.name, arg) {
+			return Target{UserID: u.id}, nil
+		}
+	}
+	if _, ok := h.users[arg]; ok || strings.HasPrefix(arg, "u-") || strings.HasPrefix(arg, "g-") {
+		return Target{UserID: arg}, nil
+	}
+	return Target{}, &ProtocolError{Code: CodeNoSuchUser, Msg: "no user called " + arg}
+}
+
+// ModerationRequest is the body of a moderation request, see ModerateHandler
+type ModerationRequest struct {
+	Action string `json:"action"`
+	User   string `json:"user"`
+	IP     string `json:"ip"`
+
+	// For is a duration such as 30m, empty for bans and mutes until they are lifted
+	For    string `json:"for"`
+	Reason string `json:"reason"`
+}
+
+// ModerateHandler takes the action of the ModerationRequest in the request body,
+// answering with the number of connections it affected. It is an admin route.
+func ModerateHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ModerationRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxModerateBody)).Decode(&req); err != nil {
+			http.Error(w, "invalid moderation request", http.StatusBadRequest)
+			return
+		}
+		a := Action{Action: req.Action, Target: Target{UserID: req.User, IP: req.IP}, Reason: req.Reason, By: AdminModerator}
+		if req.For != "" {
+			d, err := time.ParseDuration(req.For)
+			if err != nil {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			a.For = d
+		}
+
+		n, err := hub.Moderate(r.Context(), a)
+		var perr *ProtocolError
+		switch {
+		case errors.As(err, &perr):
+			http.Error(w, perr.Msg, http.StatusBadRequest)
+			return
+		case err != nil:
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]int{"connections": n}); err != nil {
+			log.Error().Err(err).Msg("error writing chat moderation result")
+		}
+	}
+}
+
+// SanctionsHandler lists the bans and mutes in force. It is an admin route.
+func SanctionsHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sanctions, err := hub.Sanctions(r.Context())
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sanctions); err != nil {
+			log.Error().Err(err).Msg("error writing chat sanctions")
+		}
+	}
+}
+
+// ModerationLogHandler lists the latest moderation log entries, newest first, up to
+// the limit query parameter. It is an admin route.
+func ModerationLogHandler(hub *Hub) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := 0
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := hub.ModerationLog(r.Context(), limit)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(entries); err != nil {
+			log.Error().Err(err).Msg("error writing chat moderation log")
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aljo242/koch/storage"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyFilters(t *testing.T) {
+	t.Parallel()
+
+	filters := compileFilters([]FilterConfig{
+		{Words: []string{"darn", "heck"}, Action: FilterMask},
+		{Pattern: `(?i)buy\s+now`, Action: FilterReject},
+		{Words: []string{"password"}, Action: FilterFlag},
+		{Pattern: `(`, Action: FilterMask},
+		{Words: []string{"ok", " "}, Action: FilterReject},
+		{Words: []string{"ignored"}, Pattern: `Secret`, Action: FilterFlag},
+	})
+	require.Len(t, filters, 4, "invalid filters are skipped")
+
+	body, reject, flag := applyFilters(filters, "Darn it, what the heck? darned")
+	require.Equal(t, "**** it, what the ****? darned", body)
+	require.False(t, reject)
+	require.False(t, flag)
+
+	_, reject, _ = applyFilters(filters, "BUY  now!")
+	require.True(t, reject)
+
+	body, _, flag = applyFilters(filters, "my password is heck")
+	require.Equal(t, "my password is ****", body)
+	require.True(t, flag)
+
+	// only words ignore case, not the pattern next to them
+	_, _, flag = applyFilters(filters, "a secret")
+	require.False(t, flag)
+	_, _, flag = applyFilters(filters, "a Secret")
+	require.True(t, flag)
+}
+
+// dialJar connects a client that keeps its cookies in jar
+func dialJar(t *testing.T, srv *httptest.Server, jar http.CookieJar) *websocket.Conn {
+	t.Helper()
+
+	dialer := websocket.Dialer{Jar: jar, Subprotocols: []string{Protocol}}
+	conn, _, err := dialer.Dial(wsURL(srv, "/ws"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// command sends a room message and reads the ack, reply or error answering it
+func command(t *testing.T, conn *websocket.Conn, id, body string) Message {
+	t.Helper()
+
+	require.NoError(t, conn.WriteJSON(Message{Type: TypeMessage, ID: id, Body: body}))
+	for {
+		if m := readType(t, conn, TypeAck, TypeReply, TypeError); m.Metadata[MetaRef] == id {
+			return m
+		}
+	}
+}
+
+// readClose reads until conn is closed and returns the close error
+func readClose(t *testing.T, conn *websocket.Conn) *websocket.CloseError {
+	t.Helper()
+
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var cerr *websocket.CloseError
+			require.ErrorAs(t, err, &cerr)
+			return cerr
+		}
+	}
+}
+
+func TestModeration(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Moderation.Moderators = []string{"Mod"}
+	cfg.Moderation.Filters = []FilterConfig{
+		{Words: []string{"heck"}, Action: FilterMask},
+		{Words: []string{"spam"}, Action: FilterReject},
+		{Words: []string{"password"}, Action: FilterFlag},
+	}
+	store := storage.NewMemory()
+	m, srv := newTestModule(t, cfg, store)
+	hub := m.Hub()
+	ctx := context.Background()
+
+	modJar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	resp, err := (&http.Client{Jar: modJar}).PostForm(srv.URL+"/signup", url.Values{"name": {"mod"}, "password": {"password1"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	mod := dialJar(t, srv, modJar)
+
+	aliceJar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	alice := dialJar(t, srv, aliceJar)
+	aliceID := joinAs(t, alice, "alice")
+	waitMembers(t, hub, "lobby", 2)
+
+	// only moderators may moderate
+	require.Equal(t, CodeForbidden, command(t, alice, "a1", "/kick mod").Metadata[MetaCode])
+	require.Equal(t, CodeNoSuchUser, command(t, mod, "m1", "/kick nobody").Metadata[MetaCode])
+
+	// filters mask, reject and flag messages
+	require.Equal(t, TypeAck, command(t, alice, "a2", "what the heck").Type)
+	require.Equal(t, "what the ****", readType(t, mod, TypeMessage).Body)
+	require.Equal(t, CodeFiltered, command(t, alice, "a3", "spam spam").Metadata[MetaCode])
+	require.Equal(t, TypeAck, command(t, alice, "a4", "my password is hunter2").Type)
+	report := readType(t, mod, TypeReport)
+	require.Equal(t, "my password is hunter2", report.History[0].Body)
+
+	// mutes apply to every connection right away and can be lifted
+	require.Equal(t, TypeReply, command(t, mod, "m2", "/mute alice 1h stop it").Type)
+	require.Equal(t, CodeMuted, readType(t, alice, TypeError).Metadata[MetaCode])
+	muted := command(t, alice, "a5", "hello?")
+	require.Equal(t, CodeMuted, muted.Metadata[MetaCode])
+	require.Contains(t, muted.Body, "stop it")
+	require.Equal(t, TypeReply, command(t, mod, "m3", "/unmute "+aliceID).Type)
+	require.Equal(t, TypeAck, command(t, alice, "a6", "sorry").Type)
+
+	// users report recent room messages to the moderators
+	hello := command(t, mod, "m4", "hello alice")
+	require.NoError(t, alice.WriteJSON(Message{Type: TypeReport, ID: "a7", Body: "rude", Metadata: map[string]string{MetaMessage: hello.ID}}))
+	require.Equal(t, "a7", readType(t, alice, TypeAck).Metadata[MetaRef])
+	report = readType(t, mod, TypeReport)
+	require.Equal(t, "rude", report.Body)
+	require.Equal(t, aliceID, report.SenderID)
+	require.Equal(t, "hello alice", report.History[0].Body)
+
+	// bans close every connection and keep the user out until they are lifted
+	require.Equal(t, TypeReply, command(t, mod, "m5", "/ban alice 1h").Type)
+	cerr := readClose(t, alice)
+	require.Equal(t, websocket.ClosePolicyViolation, cerr.Code)
+	require.True(t, strings.HasPrefix(cerr.Text, "banned for"), cerr.Text)
+	require.Equal(t, websocket.ClosePolicyViolation, readClose(t, dialJar(t, srv, aliceJar)).Code)
+
+	sanctions, err := hub.Sanctions(ctx)
+	require.NoError(t, err)
+	require.Len(t, sanctions, 1)
+	require.Equal(t, Target{UserID: aliceID}, sanctions[0].Target)
+
+	rec := httptest.NewRecorder()
+	ModerateHandler(hub)(rec, httptest.NewRequest(http.MethodPost, "/moderate", strings.NewReader(`{"action":"unban","user":"`+aliceID+`"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	ModerateHandler(hub)(rec, httptest.NewRequest(http.MethodPost, "/moderate", strings.NewReader(`{"action":"ban","ip":"nowhere"}`)))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	alice = dialJar(t, srv, aliceJar)
+	readType(t, alice, TypeJoin)
+
+	entries, err := hub.ModerationLog(ctx, 0)
+	require.NoError(t, err)
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	require.Equal(t, []string{ActionUnban, ActionBan, ActionReport, ActionUnmute, ActionMute, ActionFlag}, actions)
+	require.Equal(t, AdminModerator, entries[0].By)
+	require.Equal(t, 1, entries[1].Connections)
+
+	// bans by address cover every user connecting from it
+	n, err := hub.Moderate(ctx, Action{Action: ActionBan, Target: Target{IP: "127.0.0.1"}, For: time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.NoError(t, m.Stop(ctx))
+
+	// the sanctions and log are kept in the store
+	m, _ = newTestModule(t, cfg, store)
+	sanctions, err = m.Hub().Sanctions(ctx)
+	require.NoError(t, err)
+	require.Len(t, sanctions, 1)
+	require.Equal(t, "127.0.0.1", sanctions[0].Target.IP)
+	entries, err = m.Hub().ModerationLog(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, ActionBan, entries[0].Action)
+	require.Equal(t, ActionUnban, entries[1].Action)
+}
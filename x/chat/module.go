@@ -1,3 +1,261 @@
 package chat
 
-// TODO add module interfaces
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/aljo242/koch/account"
+	"github.com/aljo242/koch/session"
+	"github.com/aljo242/koch/storage"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// ModuleName is the name of the chat module and its [modules.chat] config section
+const ModuleName = "chat"
+
+var (
+	// ErrNotRunning is reported by the health check before the hub is started
+	ErrNotRunning = errors.New("chat hub is not running")
+
+	// ErrSignInRequired rejects guest connections when anonymous chat is off
+	ErrSignInRequired = errors.New("sign in to chat")
+)
+
+// accountTimeout bounds loading the accounts and telling the hub about account changes
+const accountTimeout = 5 * time.Second
+
+// reloadTimeout bounds handing reloaded settings to the hub
+const reloadTimeout = 5 * time.Second
+
+// Module mounts the chat WebSocket endpoint and runs its Hub.
+// It implements koch.StatefulModule, koch.SessionModule, koch.AdminModule and
+// koch.ReloadableModule.
+type Module struct {
+	cfg      Config
+	hub      *Hub
+	store    storage.Store
+	sessions *session.Manager
+	running  int32
+
+	// accounts signs users in; nil without a store and sessions
+	accounts *account.Accounts
+}
+
+// NewModule returns a chat module with a new Hub
+func NewModule() *Module {
+	return &Module{cfg: DefaultConfig(), hub: NewHub()}
+}
+
+// Name returns ModuleName
+func (m *Module) Name() string {
+	return ModuleName
+}
+
+// Config returns the settings decoded from [modules.chat]
+func (m *Module) Config() interface{} {
+	return &m.cfg
+}
+
+// NewConfig returns the default settings for Reload to decode [modules.chat] into
+func (m *Module) NewConfig() interface{} {
+	cfg := DefaultConfig()
+	return &cfg
+}
+
+// Reload applies the flood limits of cfg, a *Config from NewConfig, to the running
+// hub. The other settings only take effect on the next start.
+func (m *Module) Reload(cfg interface{}) error {
+	next := *cfg.(*Config)
+	flood := next.Flood
+	next.Flood = m.cfg.Flood
+	if !reflect.DeepEqual(next, m.cfg) {
+		log.Warn().Msg("chat settings other than flood changed, restart to apply them")
+	}
+
+	if atomic.LoadInt32(&m.running) == 1 {
+		ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+		defer cancel()
+		if err := m.hub.setFlood(ctx, flood); err != nil {
+			return err
+		}
+	}
+	m.cfg.Flood = flood
+	return nil
+}
+
+// Hub returns the hub serving the module's clients
+func (m *Module) Hub() *Hub {
+	return m.hub
+}
+
+// UseStore sets the store that room history, accounts and moderation are persisted to
+func (m *Module) UseStore(s storage.Store) {
+	m.store = s
+}
+
+// UseSessions sets the session manager whose sessions accounts sign in to
+func (m *Module) UseSessions(s *session.Manager) {
+	m.sessions = s
+}
+
+// Routes registers the WebSocket endpoint at <prefix>/ws, or <prefix>/ws/<room> to
+// join a room other than the default one, the room listing at <prefix>/rooms and
+// the history of a room at <prefix>/rooms/<room>/history and the hub's Stats at
+// <prefix>/stats. Accounts are managed at
+// <prefix>/signup, /signin, /signout and /account/delete.
+func (m *Module) Routes(r *mux.Router) {
+	r.HandleFunc("/ws", ServeWs(m.hub))
+	r.HandleFunc("/ws/{room}", ServeWs(m.hub))
+	r.HandleFunc("/rooms", RoomsHandler(m.hub)).Methods("GET")
+	r.HandleFunc("/rooms/{room}/history", HistoryHandler(m.hub)).Methods("GET")
+	r.HandleFunc("/stats", StatsHandler(m.hub)).Methods("GET")
+
+	r.HandleFunc("/signup", m.withAccounts((*account.Accounts).SignUpHandler)).Methods("POST")
+	r.HandleFunc("/signin", m.withAccounts((*account.Accounts).SignInHandler)).Methods("POST")
+	r.HandleFunc("/signout", m.withAccounts((*account.Accounts).SignOutHandler)).Methods("POST")
+	r.HandleFunc("/account/delete", m.withAccounts((*account.Accounts).DeleteHandler)).Methods("POST")
+}
+
+// AdminRoutes registers AnnounceHandler at /admin/<prefix>/announce, the
+// connections at /admin/<prefix>/clients, ModerateHandler at
+// /admin/<prefix>/moderate and the bans and mutes in force and moderation log at
+// /admin/<prefix>/moderation/sanctions and /admin/<prefix>/moderation/log
+func (m *Module) AdminRoutes(r *mux.Router) {
+	r.HandleFunc("/announce", AnnounceHandler(m.hub)).Methods("POST")
+	r.HandleFunc("/clients", ClientsHandler(m.hub)).Methods("GET")
+	r.HandleFunc("/moderate", ModerateHandler(m.hub)).Methods("POST")
+	r.HandleFunc("/moderation/sanctions", SanctionsHandler(m.hub)).Methods("GET")
+	r.HandleFunc("/moderation/log", ModerationLogHandler(m.hub)).Methods("GET")
+}
+
+// withAccounts serves an account handler once the module has started with a store and sessions
+func (m *Module) withAccounts(handler func(*account.Accounts) func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m.accounts == nil {
+			http.Error(w, "accounts are not available", http.StatusServiceUnavailable)
+			return
+		}
+		handler(m.accounts)(w, r)
+	}
+}
+
+// identify signs in connections whose session is signed in to an account, and lets
+// the others in as guests if anonymous chat is on
+func (m *Module) identify(r *http.Request, header http.Header) (Identity, error) {
+	if m.accounts != nil {
+		s, acct, err := m.accounts.FromRequest(r)
+		if err == nil {
+			return Identity{UserID: "u-" + acct.ID, Name: acct.Name, Session: s.ID()}, nil
+		}
+		if !errors.Is(err, account.ErrNoSession) {
+			return Identity{}, err
+		}
+	}
+	if !m.cfg.Anonymous {
+		return Identity{}, ErrSignInRequired
+	}
+	return GuestIdentity(r, header)
+}
+
+// loadAccounts tells the hub the user ids and names of the accounts in the store
+func (m *Module) loadAccounts() {
+	ctx, cancel := context.WithTimeout(context.Background(), accountTimeout)
+	defer cancel()
+
+	m.hub.accounts = make(map[string]string)
+	m.hub.accountNames = make(map[string]string)
+	err := m.accounts.ForEach(ctx, func(acct *account.Account) error {
+		m.hub.setAccount("u-"+acct.ID, acct.Name)
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("error loading chat accounts")
+	}
+}
+
+// tellHub runs fn, which updates the hub after an account change, giving up after accountTimeout
+func (m *Module) tellHub(what string, fn func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), accountTimeout)
+	defer cancel()
+	if err := fn(ctx); err != nil {
+		log.Error().Err(err).Msg("error updating the chat hub after " + what)
+	}
+}
+
+// migrations evolve the history and moderation buckets, see storage.Migrate
+var migrations = []storage.Migration{
+	{Version: 1, Name: "create chat buckets", Up: storage.CreateBuckets(historyBucket, historySeqBucket, sanctionsBucket, modLogBucket)},
+}
+
+// migrate brings the buckets of the chat and its accounts up to date
+func (m *Module) migrate(ctx context.Context) error {
+	if err := storage.Migrate(ctx, m.store, ModuleName, migrations); err != nil {
+		return err
+	}
+	if m.sessions != nil {
+		return account.Migrate(ctx, m.store)
+	}
+	return nil
+}
+
+// Start migrates the store, then configures the hub from [modules.chat] and runs it
+func (m *Module) Start(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&m.running, 0, 1) {
+		if m.store != nil {
+			if err := m.migrate(ctx); err != nil {
+				atomic.StoreInt32(&m.running, 0)
+				return err
+			}
+		}
+		if m.cfg.History.Persist && m.store != nil {
+			m.hub.history = newHistoryStore(m.store, m.cfg.History)
+		}
+		if m.store != nil {
+			m.hub.modStore = newModerationStore(m.store)
+		}
+		if m.store != nil && m.sessions != nil {
+			m.accounts = account.New(m.store, m.cfg.Accounts)
+			m.accounts.OnSignUp(func(acct *account.Account) {
+				m.tellHub("a sign up", func(ctx context.Context) error { return m.hub.addAccount(ctx, "u-"+acct.ID, acct.Name) })
+			})
+			m.accounts.OnDelete(func(acct *account.Account) {
+				m.tellHub("an account deletion", func(ctx context.Context) error { return m.hub.endUser(ctx, "u-"+acct.ID) })
+			})
+			m.sessions.OnEnd(func(id string) {
+				m.tellHub("a sign out", func(ctx context.Context) error { return m.hub.endSession(ctx, id) })
+			})
+			m.loadAccounts()
+		}
+		m.hub.SetIdentify(m.identify)
+		m.hub.configure(m.cfg)
+		go m.hub.Run()
+	}
+	return nil
+}
+
+// Stop closes the connections of the hub and writes the history and moderation
+// changes that are still queued for the store, see Hub.Stop
+func (m *Module) Stop(ctx context.Context) error {
+	if atomic.LoadInt32(&m.running) == 0 {
+		return nil
+	}
+	return m.hub.Stop(ctx)
+}
+
+// Health reports ErrNotRunning until the module is started, and ErrStopped once its hub has stopped
+func (m *Module) Health(_ context.Context) error {
+	if atomic.LoadInt32(&m.running) == 0 {
+		return ErrNotRunning
+	}
+	select {
+	case <-m.hub.done:
+		return ErrStopped
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// resumeRequest is the token of the connection a client resumes and the last sequence
+// number it saw in each room
+type resumeRequest struct {
+	token string
+	since map[string]uint64
+}
+
+// resumeState is what a closed connection leaves behind for its client to resume
+type resumeState struct {
+	userID  string
+	room    string
+	rooms   map[string]*room
+	expires time.Time
+}
+
+// parseSince parses the room:seq pairs of a resume request
+func parseSince(s string) (map[string]uint64, error) {
+	since := make(map[string]uint64)
+	if s == "" {
+		return since, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid since %q : expected room:seq", pair)
+		}
+		name, ok := roomName(pair[:i])
+		seq, err := strconv.ParseUint(pair[i+1:], 10, 64)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid since %q : expected room:seq", pair)
+		}
+		since[name] = seq
+	}
+	return since, nil
+}
+
+// keepResume remembers the rooms of c, which is closing, so its client can resume the
+// connection until the resume TTL passes
+func (h *Hub) keepResume(c *Client) {
+	now := time.Now()
+	for token, st := range h.resumable {
+		if now.After(st.expires) {
+			delete(h.resumable, token)
+		}
+	}
+	if c.token == "" || len(c.rooms) == 0 {
+		return
+	}
+
+	st := &resumeState{
+		userID:  c.user.id,
+		room:    c.room,
+		rooms:   make(map[string]*room, len(c.rooms)),
+		expires: now.Add(h.cfg.Resume.TTL),
+	}
+	for name := range c.rooms {
+		st.rooms[name] = h.rooms[name]
+	}
+	h.resumable[c.token] = st
+}
+
+// resume rejoins c to the rooms of the connection its client resumes and sends it the
+// messages it missed in each. It reports false if c should join its initial room instead.
+func (h *Hub) resume(c *Client) bool {
+	st, ok := h.resumable[c.resume.token]
+	if !ok || st.userID != c.user.id || time.Now().After(st.expires) {
+		h.deliver(c, errorMessage(&ProtocolError{Code: CodeResync, Msg: "the connection cannot be resumed"}))
+		return false
+	}
+	delete(h.resumable, c.resume.token)
+
+	names := make([]string, 0, len(st.rooms))
+	for name := range st.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := h.join(c, name); err != nil {
+			m := errorMessage(err)
+			m.Room = name
+			h.deliver(c, m)
+			continue
+		}
+		h.announce(c, TypeJoin, name, "")
+		h.catchUp(c, name, c.resume.since[name], st.rooms[name])
+	}
+	if len(c.rooms) == 0 {
+		return false
+	}
+
+	c.room = st.room
+	if !c.rooms[c.room] {
+		c.room = names[0]
+	}
+	return true
+}
+
+// catchUp sends c the messages of the room called name after since. If they are not
+// all available it sends a resync error and the latest messages instead.
+func (h *Hub) catchUp(c *Client, name string, since uint64, was *room) {
+	missed, ok := h.missed(h.rooms[name], since, was)
+	if !ok {
+		m := errorMessage(&ProtocolError{Code: CodeResync, Msg: "missed messages of " + name + " are not available"})
+		m.Room = name
+		h.deliver(c, m)
+		h.replay(c, name)
+		return
+	}
+	for _, m := range missed {
+		h.deliver(c, m)
+	}
+}
+
+// missed returns the messages of r after since and whether they are all available
+// and within the resume gap. was is the room the client was in before.
+func (h *Hub) missed(r *room, since uint64, was *room) ([]*Message, bool) {
+	// without a store a room that was dropped and created again counts from 1 again
+	if since > r.seq || r != was && h.history == nil {
+		return nil, false
+	}
+	gap := r.seq - since
+	if gap == 0 {
+		return nil, true
+	}
+	if gap > uint64(h.cfg.Resume.MaxGap) {
+		return nil, false
+	}
+
+	msgs := r.recent.after(since)
+	if uint64(len(msgs)) < gap && h.history != nil {
+		before := r.seq + 1
+		if len(msgs) > 0 {
+			before = msgs[0].Seq
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), historyTimeout)
+		defer cancel()
+		older, err := h.history.before(ctx, r.name, before, int(gap)-len(msgs))
+		if err != nil {
+			log.Error().Err(err).Str("room", r.name).Msg("error reading chat history")
+			return nil, false
+		}
+		msgs = append(older, msgs...)
+	}
+
+	// sequence numbers have no gaps, so the right count starting after since is complete
+	return msgs, uint64(len(msgs)) == gap && msgs[0].Seq == since+1
+}
@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"net/http/cookiejar"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSince(t *testing.T) {
+	t.Parallel()
+
+	since, err := parseSince("lobby:4,Games:0")
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"lobby": 4, "games": 0}, since)
+
+	for _, s := range []string{"lobby", "lobby:-1", "bad room:1", "lobby:1,"} {
+		_, err := parseSince(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestHubResume(t *testing.T) {
+	t.Parallel()
+
+	cfg := DefaultConfig()
+	cfg.Resume.MaxGap = 3
+	_, srv := newTestServerConfig(t, cfg)
+
+	// alice keeps her guest cookie, and so her user id, across connections
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	dialer := websocket.Dialer{Jar: jar, Subprotocols: []string{Protocol}}
+	reconnect := func(query string) *websocket.Conn {
+		conn, _, err := dialer.Dial(wsURL(srv, "/ws"+query), nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	alice := reconnect("")
+	token := readType(t, alice, TypeResume).Token
+	require.NotEmpty(t, token)
+	send(t, alice, "1")
+	require.NoError(t, alice.Close())
+
+	bob := dial(t, wsURL(srv, "/ws"), false)
+	send(t, bob, "2", "3")
+
+	// the resumed connection gets exactly the missed messages and no replay
+	alice = reconnect("?resume=" + token + "&since=lobby:1")
+	token = readType(t, alice, TypeResume).Token
+	send(t, bob, "4")
+	var got []string
+	for len(got) == 0 || got[len(got)-1] != "4" {
+		m := readType(t, alice, TypeMessage, TypeHistory, TypeError)
+		require.Equal(t, TypeMessage, m.Type)
+		got = append(got, m.Body)
+	}
+	require.Equal(t, []string{"2", "3", "4"}, got)
+	require.NoError(t, alice.Close())
+
+	// a gap larger than MaxGap asks the client to resync and replays the latest messages
+	send(t, bob, "5", "6", "7", "8")
+	alice = reconnect("?resume=" + token + "&since=lobby:4")
+	m := readType(t, alice, TypeError)
+	require.Equal(t, CodeResync, m.Metadata[MetaCode])
+	require.Equal(t, "lobby", m.Room)
+	history := readType(t, alice, TypeHistory).History
+	require.Equal(t, uint64(8), history[len(history)-1].Seq)
+
+	// tokens are single use
+	alice2 := reconnect("?resume=" + token + "&since=lobby:8")
+	require.Equal(t, CodeResync, readType(t, alice2, TypeError).Metadata[MetaCode])
+	require.Equal(t, "lobby", readType(t, alice2, TypeJoin).Room)
+}